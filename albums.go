@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/feeds"
+	"github.com/toomore/lazyflickrgo/jsonstruct"
+	"github.com/toomore/toomorephotos/cache"
+	"github.com/toomore/toomorephotos/db"
+)
+
+const albumPageSize = tagPageSize
+
+// albumPathExpr matches /a/{setid} and its feeds /a/{setid}/rss, /atom and
+// /feed.json.
+var albumPathExpr = regexp.MustCompile(`^/a/([0-9]+)(?:/(rss|atom|feed\.json))?$`)
+
+// albumListResponse is flickr.photosets.getList. Flickr returns some numbers
+// as strings depending on the endpoint version, hence json.Number.
+type albumListResponse struct {
+	Photosets struct {
+		Page     json.Number `json:"page"`
+		Pages    json.Number `json:"pages"`
+		Photoset []struct {
+			ID          string             `json:"id"`
+			Primary     string             `json:"primary"`
+			Secret      string             `json:"secret"`
+			Server      string             `json:"server"`
+			Farm        json.Number        `json:"farm"`
+			CountPhotos json.Number        `json:"count_photos"`
+			Title       jsonstruct.Content `json:"title"`
+			Description jsonstruct.Content `json:"description"`
+			DateCreate  string             `json:"date_create"`
+			DateUpdate  string             `json:"date_update"`
+		} `json:"photoset"`
+	} `json:"photosets"`
+	Stat    string `json:"stat"`
+	Code    int64  `json:"code"`
+	Message string `json:"message"`
+}
+
+// albumPhotosResponse is flickr.photosets.getPhotos.
+type albumPhotosResponse struct {
+	Photoset struct {
+		Pages json.Number `json:"pages"`
+		Photo []struct {
+			ID string `json:"id"`
+		} `json:"photo"`
+	} `json:"photoset"`
+	Stat    string `json:"stat"`
+	Code    int64  `json:"code"`
+	Message string `json:"message"`
+}
+
+func unixPtr(s string) *time.Time {
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || sec == 0 {
+		return nil
+	}
+	t := time.Unix(sec, 0)
+	return &t
+}
+
+// fetchAlbums lists every album of UserID in Flickr order.
+func fetchAlbums(ctx context.Context, app *App) ([]db.Album, error) {
+	var albums []db.Album
+	for page := 1; ; page++ {
+		var resp albumListResponse
+		args := map[string]string{
+			"method":   "flickr.photosets.getList",
+			"user_id":  app.UserID,
+			"per_page": "500",
+			"page":     strconv.Itoa(page),
+		}
+		if err := flickrGet(ctx, app, args, &resp); err != nil {
+			return nil, err
+		}
+		if resp.Stat != "ok" {
+			return nil, &flickrError{Stat: resp.Stat, Code: resp.Code, Message: resp.Message}
+		}
+		for _, s := range resp.Photosets.Photoset {
+			farm, _ := s.Farm.Int64()
+			count, _ := s.CountPhotos.Int64()
+			albums = append(albums, db.Album{
+				ID:             s.ID,
+				Title:          s.Title.Content,
+				Description:    s.Description.Content,
+				PrimaryPhotoID: s.Primary,
+				Farm:           farm,
+				Server:         s.Server,
+				Secret:         s.Secret,
+				Position:       len(albums),
+				CountPhotos:    int(count),
+				CreatedAt:      unixPtr(s.DateCreate),
+				UpdatedAt:      unixPtr(s.DateUpdate),
+			})
+		}
+		if pages, _ := resp.Photosets.Pages.Int64(); int64(page) >= pages {
+			return albums, nil
+		}
+	}
+}
+
+// fetchAlbumPhotoIDs lists the public photos of an album in album order.
+func fetchAlbumPhotoIDs(ctx context.Context, app *App, albumID string) ([]string, error) {
+	var ids []string
+	for page := 1; ; page++ {
+		var resp albumPhotosResponse
+		args := map[string]string{
+			"method":         "flickr.photosets.getPhotos",
+			"photoset_id":    albumID,
+			"user_id":        app.UserID,
+			"privacy_filter": "1",
+			"per_page":       "500",
+			"page":           strconv.Itoa(page),
+		}
+		if err := flickrGet(ctx, app, args, &resp); err != nil {
+			return nil, err
+		}
+		if resp.Stat != "ok" {
+			return nil, &flickrError{Stat: resp.Stat, Code: resp.Code, Message: resp.Message}
+		}
+		for _, p := range resp.Photoset.Photo {
+			ids = append(ids, p.ID)
+		}
+		if pages, _ := resp.Photoset.Pages.Int64(); int64(page) >= pages {
+			return ids, nil
+		}
+	}
+}
+
+// syncAlbums stores the album list and refetches photos of albums updated on
+// Flickr since the last sync, returning those albums. An empty album list is
+// not applied, so a Flickr hiccup cannot wipe every album.
+func syncAlbums(ctx context.Context, app *App, limiter *tokenBucket) (refreshed []string, err error) {
+	var albums []db.Album
+	_, err = withRetry(ctx, "相簿列表", func() (err error) {
+		if err = limiter.Wait(ctx); err != nil {
+			return err
+		}
+		albums, err = fetchAlbums(ctx, app)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("取得相簿列表失敗: %w", err)
+	}
+	if len(albums) == 0 {
+		log.Println("Sync: Flickr 回傳 0 個相簿，略過相簿同步")
+		return nil, nil
+	}
+	if err := app.DB.ReplaceAlbums(ctx, albums); err != nil {
+		return nil, fmt.Errorf("寫入相簿失敗: %w", err)
+	}
+	stale, err := app.DB.GetStaleAlbumIDs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("讀取相簿失敗: %w", err)
+	}
+	log.Printf("Sync: %d 個相簿，%d 個需要更新照片", len(albums), len(stale))
+	var failed int
+	for _, id := range stale {
+		var ids []string
+		_, err := withRetry(ctx, "相簿 "+id, func() (err error) {
+			if err = limiter.Wait(ctx); err != nil {
+				return err
+			}
+			ids, err = fetchAlbumPhotoIDs(ctx, app, id)
+			return err
+		})
+		if ctx.Err() != nil {
+			return refreshed, ctx.Err()
+		}
+		if err == nil {
+			err = app.DB.SetAlbumPhotos(ctx, id, ids)
+		}
+		if err != nil {
+			log.Printf("Sync: 相簿 %s 失敗: %v", id, err)
+			failed++
+			continue
+		}
+		_ = app.Cache.Delete(ctx, "album:"+id, "album-feed:"+id)
+		refreshed = append(refreshed, id)
+	}
+	_ = app.Cache.Delete(ctx, "albums")
+	if failed > 0 {
+		return refreshed, fmt.Errorf("%d 個相簿同步失敗", failed)
+	}
+	return refreshed, nil
+}
+
+// albumData is an album with its visible photos in album order.
+type albumData struct {
+	Album  db.Album
+	Photos []jsonstruct.Photo
+}
+
+// fromPhotoset reads an album through Flickr when DATABASE_URL is not set.
+// ok is false when Flickr does not know the album or it is not UserID's.
+func (a *App) fromPhotoset(ctx context.Context, albumID string) (data albumData, ok bool, err error) {
+	var info jsonstruct.PhotosetsGetInfo
+	args := map[string]string{"method": "flickr.photosets.getInfo", "photoset_id": albumID, "user_id": a.UserID}
+	if err := flickrGet(ctx, a, args, &info); err != nil {
+		return albumData{}, false, err
+	}
+	s := info.Photoset
+	if s.ID == "" || s.Owner != a.UserID {
+		return albumData{}, false, nil
+	}
+	count, _ := strconv.Atoi(s.CountPhotos)
+	data = albumData{Album: db.Album{
+		ID:             s.ID,
+		Title:          s.Title.Content,
+		Description:    s.Description.Content,
+		PrimaryPhotoID: s.Primary,
+		Farm:           int64(s.Farm),
+		Server:         s.Server,
+		Secret:         s.Secret,
+		CountPhotos:    count,
+		CreatedAt:      unixPtr(s.DateCreate),
+		UpdatedAt:      unixPtr(s.DateUpdate),
+	}}
+	for page, pages := 1, 1; page <= pages; page++ {
+		var resp jsonstruct.PhotosetsGetPhotos
+		args := map[string]string{
+			"method":      "flickr.photosets.getPhotos",
+			"photoset_id": albumID,
+			"user_id":     a.UserID,
+			"per_page":    "500",
+			"page":        strconv.Itoa(page),
+		}
+		if err := flickrGet(ctx, a, args, &resp); err != nil {
+			return albumData{}, false, err
+		}
+		if resp.Common.Stat != "ok" {
+			return albumData{}, false, &flickrError{Stat: resp.Common.Stat, Code: resp.Common.Code, Message: resp.Common.Message}
+		}
+		pages = int(resp.Photoset.Pages)
+		for _, p := range resp.Photoset.Photo {
+			if p.Ispublic != 0 {
+				data.Photos = append(data.Photos, p)
+			}
+		}
+	}
+	return data, true, nil
+}
+
+// getCachedAlbum returns the album and its photos from cache, then DB when
+// DATABASE_URL is set, otherwise Flickr.
+func (a *App) getCachedAlbum(albumID string) (albumData, bool) {
+	ctx := context.Background()
+	key := "album:" + albumID
+	// An unknown album is cached too, as albumData{}.
+	result, _ := cache.Fetch(ctx, a.ReadThrough, key, a.cacheOpts(a.IndexCacheTTL), func(ctx context.Context) (albumData, error) {
+		// With a DB, sync imports every album, so one missing there is gone.
+		if a.DB != nil {
+			album, ok, err := a.DB.GetAlbum(ctx, albumID)
+			if err != nil || !ok {
+				return albumData{}, err
+			}
+			photos, err := a.DB.GetAlbumPhotos(ctx, albumID, false)
+			if err != nil {
+				return albumData{}, err
+			}
+			return albumData{Album: album, Photos: photos}, nil
+		}
+		result, _, err := a.fromPhotoset(ctx, albumID)
+		return result, err
+	})
+	return result, result.Album.ID != ""
+}
+
+// getCachedAlbums returns all albums for the sitemap. Without DB the album
+// list comes straight from Flickr.
+func (a *App) getCachedAlbums() []db.Album {
+	ctx := context.Background()
+	key := "albums"
+	result, err := cache.Fetch(ctx, a.ReadThrough, key, a.cacheOpts(a.SitemapCacheTTL), func(ctx context.Context) ([]db.Album, error) {
+		if a.DB != nil {
+			if albums, err := a.DB.GetAlbums(ctx); err == nil && len(albums) > 0 {
+				return albums, nil
+			}
+		}
+		return fetchAlbums(ctx, a)
+	})
+	if err != nil {
+		log.Printf("albums: %v", err)
+		return nil
+	}
+	return result
+}
+
+// getCachedAlbumFeed builds the album feed from its newest photos.
+func (a *App) getCachedAlbumFeed(album albumData) *photoFeed {
+	ctx := context.Background()
+	key := "album-feed:" + album.Album.ID
+	f, _ := cache.Fetch(ctx, a.ReadThrough, key, a.cacheOpts(a.FeedCacheTTL), func(ctx context.Context) (*photoFeed, error) {
+		photos := album.Photos
+		if a.DB != nil {
+			if newest, err := a.DB.GetAlbumPhotos(ctx, album.Album.ID, true); err == nil {
+				photos = newest
+			}
+		}
+		f := a.createFeeds(photos)
+		f.Title = album.Album.Title + " - " + a.Config.Site.Title
+		f.Link = &feeds.Link{Href: fmt.Sprintf("%s/a/%s", a.Config.Site.URL, album.Album.ID)}
+		if album.Album.Description != "" {
+			f.Description = album.Album.Description
+		}
+		return f, nil
+	})
+	return f
+}
+
+// album serves /a/{setid}?page=N and its feeds.
+func (a *App) album(w http.ResponseWriter, r *http.Request) {
+	logs(r, "")
+	m := albumPathExpr.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		a.notFound(w, r)
+		return
+	}
+	album, ok := a.getCachedAlbum(m[1])
+	if !ok || len(album.Photos) == 0 {
+		a.notFound(w, r)
+		return
+	}
+	if format := feedPathSegments[m[2]]; format != "" {
+		a.writeFeed(w, r, a.getCachedAlbumFeed(album), format, a.albumFeedURL(m[1], format))
+		return
+	}
+
+	page, ok := parsePage(r)
+	if !ok {
+		a.notFound(w, r)
+		return
+	}
+	p := newPager(page, albumPageSize, len(album.Photos))
+	if page > p.Pages {
+		a.notFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "max-age=120")
+	data := struct {
+		Album db.Album
+		R     []jsonstruct.Photo
+		Pager pager
+	}{album.Album, album.Photos[p.offset(albumPageSize):min(p.offset(albumPageSize)+albumPageSize, len(album.Photos))], p}
+	if err := a.TplAlbum.Execute(w, data); err != nil {
+		log.Printf("template execute error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
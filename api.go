@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/toomore/lazyflickrgo/jsonstruct"
+	"github.com/toomore/toomorephotos/db"
+)
+
+// The /api/v1/ schemas below are a public contract: add fields, never rename
+// or remove them. Fields are always present; missing values are null or "".
+
+type apiImages struct {
+	Thumbnail string `json:"thumbnail"` // 150x150 square
+	Medium    string `json:"medium"`    // 240 on longest side
+	Large     string `json:"large"`     // 1024 on longest side
+}
+
+type apiLicense struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type apiLocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// apiPhotoSummary is a photo in a list.
+type apiPhotoSummary struct {
+	ID     string    `json:"id"`
+	Title  string    `json:"title"`
+	URL    string    `json:"url"`
+	Images apiImages `json:"images"`
+}
+
+// apiPhoto is the photo detail.
+type apiPhoto struct {
+	apiPhotoSummary
+	Description string       `json:"description"`
+	Tags        []string     `json:"tags"`
+	License     *apiLicense  `json:"license"`
+	Posted      string       `json:"posted"`
+	Taken       string       `json:"taken"`
+	LastUpdate  string       `json:"lastupdate"`
+	Views       int64        `json:"views"`
+	Width       int64        `json:"width"`
+	Height      int64        `json:"height"`
+	Location    *apiLocation `json:"location"`
+	FlickrURL   string       `json:"flickr_url"`
+}
+
+type apiPhotoList struct {
+	Photos     []apiPhotoSummary `json:"photos"`
+	Total      int               `json:"total"`
+	NextCursor *string           `json:"next_cursor"`
+}
+
+type apiError struct {
+	Error struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (a *App) apiImagesFor(farm int64, server, secret, id string) apiImages {
+	f := func(size string) string {
+		return fmt.Sprintf("%s/f/%s/%d/%s/%s/%s.jpg", a.Config.Site.URL, size, farm, server, secret, id)
+	}
+	return apiImages{Thumbnail: f("q"), Medium: f("m"), Large: f("b")}
+}
+
+func (a *App) newAPIPhotoSummary(p jsonstruct.Photo) apiPhotoSummary {
+	return apiPhotoSummary{
+		ID:     p.ID,
+		Title:  p.Title,
+		URL:    fmt.Sprintf("%s/p/%s", a.Config.Site.URL, p.ID),
+		Images: a.apiImagesFor(p.Farm, p.Server, p.Secret, p.ID),
+	}
+}
+
+func (a *App) newAPIPhotoList(photos []jsonstruct.Photo) []apiPhotoSummary {
+	list := make([]apiPhotoSummary, 0, len(photos))
+	for _, p := range photos {
+		if p.Ispublic != 0 {
+			list = append(list, a.newAPIPhotoSummary(p))
+		}
+	}
+	return list
+}
+
+// apiDate formats a Flickr date as RFC 3339, or "" when it is missing.
+func apiDate(stamp string) string {
+	if stamp == "" || stamp == "0" {
+		return ""
+	}
+	return iso8601(stamp)
+}
+
+// encodeCursor and decodeCursor keep the page number opaque to clients.
+func encodeCursor(page int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("p:" + strconv.Itoa(page)))
+}
+
+func decodeCursor(cursor string) (int, bool) {
+	if cursor == "" {
+		return 1, true
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(raw), "p:") {
+		return 0, false
+	}
+	page, err := strconv.Atoi(string(raw[2:]))
+	if err != nil || page < 1 {
+		return 0, false
+	}
+	return page, true
+}
+
+// apiHandler returns the /api/v1/ router wrapped with CORS handling.
+func (a *App) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/photos/{id}", a.apiPhoto)
+	mux.HandleFunc("GET /api/v1/photos/{id}/related", a.apiRelated)
+	mux.HandleFunc("GET /api/v1/tags", a.apiTags)
+	mux.HandleFunc("GET /api/v1/tags/{tag}/photos", a.apiTagPhotos)
+	mux.HandleFunc("GET /api/v1/licenses", a.apiLicenses)
+	mux.HandleFunc("GET /api/v1/geo", a.apiGeo)
+	mux.HandleFunc("/api/v1/", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "not found")
+	})
+	return a.cors(mux)
+}
+
+// cors adds CORS headers for origins in APICORSOrigins ("*" allows any) and
+// answers preflight requests.
+func (a *App) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logs(r, "[api]")
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin != "" {
+			for _, allowed := range a.APICORSOrigins {
+				if allowed == "*" || allowed == origin {
+					w.Header().Set("Access-Control-Allow-Origin", allowed)
+					w.Header().Set("Access-Control-Expose-Headers", "ETag")
+					break
+				}
+			}
+		}
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "If-None-Match")
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeAPIJSON encodes v with a strong ETag of the body and answers
+// If-None-Match with 304.
+func writeAPIJSON(w http.ResponseWriter, r *http.Request, v interface{}, maxAge int) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("api json encode error: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	etagStr := fmt.Sprintf("\"%x\"", sha1.Sum(body))
+	w.Header().Set("ETag", etagStr)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+	if r.Header.Get("If-None-Match") == etagStr {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	var e apiError
+	e.Error.Status = status
+	e.Error.Message = message
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// getAPIPhotoInfo returns the photo if it exists and belongs to UserID.
+func (a *App) getAPIPhotoInfo(id string) (jsonstruct.PhotosGetInfo, bool) {
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		return jsonstruct.PhotosGetInfo{}, false
+	}
+	info := a.getCachedPhotosGetInfo(id)
+	if info.Common.Stat != "ok" || info.Photo.Owner.Nsid != a.UserID {
+		return jsonstruct.PhotosGetInfo{}, false
+	}
+	return info, true
+}
+
+func (a *App) apiPhoto(w http.ResponseWriter, r *http.Request) {
+	info, ok := a.getAPIPhotoInfo(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "photo not found")
+		return
+	}
+	p := info.Photo
+	photo := apiPhoto{
+		apiPhotoSummary: apiPhotoSummary{
+			ID:     p.ID,
+			Title:  p.Title.Content,
+			URL:    fmt.Sprintf("%s/p/%s", a.Config.Site.URL, p.ID),
+			Images: a.apiImagesFor(p.Farm, p.Server, p.Secret, p.ID),
+		},
+		Description: p.Description.Content,
+		Tags:        []string{},
+		Posted:      apiDate(p.Dates.Posted),
+		Taken:       apiDate(p.Dates.Taken),
+		LastUpdate:  apiDate(p.Dates.Lastupdate),
+		FlickrURL:   fmt.Sprintf("https://www.flickr.com/photos/%s/%s", p.Owner.Nsid, p.ID),
+	}
+	photo.Views, _ = strconv.ParseInt(p.Views, 10, 64)
+	for _, t := range p.Tags.Tag {
+		photo.Tags = append(photo.Tags, t.Raw)
+	}
+	if l, ok := a.Licenses[p.License]; ok {
+		photo.License = &apiLicense{ID: p.License, Name: l.Name, URL: l.URL}
+	}
+	if lat, lon, ok := photoLocation(p.Location.Latitude, p.Location.Longitude); ok {
+		photo.Location = &apiLocation{Latitude: lat, Longitude: lon}
+	}
+	if w, h, ok := a.getCachedPhotosGetSizes(p.ID); ok {
+		photo.Width, photo.Height = w, h
+	}
+	writeAPIJSON(w, r, photo, 600)
+}
+
+func (a *App) apiRelated(w http.ResponseWriter, r *http.Request) {
+	info, ok := a.getAPIPhotoInfo(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "photo not found")
+		return
+	}
+	var tagRaws []string
+	for _, t := range info.Photo.Tags.Tag {
+		tagRaws = append(tagRaws, t.Raw)
+	}
+	related := a.getCachedRelatedPhotos(info.Photo.ID, tagRaws)
+	writeAPIJSON(w, r, apiPhotoList{Photos: a.newAPIPhotoList(related), Total: len(related)}, 600)
+}
+
+func (a *App) apiTags(w http.ResponseWriter, r *http.Request) {
+	tags := a.getCachedTagCounts()
+	if tags == nil {
+		tags = []db.TagCount{}
+	}
+	writeAPIJSON(w, r, struct {
+		Tags []db.TagCount `json:"tags"`
+	}{tags}, 600)
+}
+
+func (a *App) apiTagPhotos(w http.ResponseWriter, r *http.Request) {
+	tag := r.PathValue("tag")
+	page, ok := decodeCursor(r.URL.Query().Get("cursor"))
+	if tag == "" || !ok {
+		writeAPIError(w, http.StatusBadRequest, "invalid tag or cursor")
+		return
+	}
+	// An unknown tag or a page past the end is an empty list.
+	result, _ := a.getCachedTagPage(tag, page)
+	list := apiPhotoList{Photos: a.newAPIPhotoList(result.Photos), Total: result.Total}
+	if p := newPager(page, tagPageSize, result.Total); p.Next > 0 {
+		next := encodeCursor(p.Next)
+		list.NextCursor = &next
+	}
+	writeAPIJSON(w, r, list, 120)
+}
+
+func (a *App) apiLicenses(w http.ResponseWriter, r *http.Request) {
+	licenses := make([]apiLicense, 0, len(a.Licenses))
+	for id, l := range a.Licenses {
+		licenses = append(licenses, apiLicense{ID: id, Name: l.Name, URL: l.URL})
+	}
+	sort.Slice(licenses, func(i, j int) bool {
+		a, _ := strconv.Atoi(licenses[i].ID)
+		b, _ := strconv.Atoi(licenses[j].ID)
+		return a < b
+	})
+	writeAPIJSON(w, r, struct {
+		Licenses []apiLicense `json:"licenses"`
+	}{licenses}, 86400)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"html/template"
 	"log"
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
@@ -15,34 +16,70 @@ import (
 	"github.com/toomore/lazyflickrgo/jsonstruct"
 	"github.com/toomore/toomorephotos/cache"
 	"github.com/toomore/toomorephotos/db"
+	"golang.org/x/sync/singleflight"
 )
 
 type App struct {
-	Flickr        *flickr.Flickr
+	Config *Config
+	Flickr *flickr.Flickr
+	// FlickrAPI serves every Flickr call after startup; unlike Flickr it
+	// returns transport errors.
+	FlickrAPI     *flickrAPI
 	Licenses      map[string]jsonstruct.License
 	Tags          []string
 	UserID        string
 	TplIndex      *template.Template
 	TplPhoto      *template.Template
-	TplSitemap    *template.Template
+	TplTag        *template.Template
+	TplTags       *template.Template
+	TplSearch     *template.Template
+	TplMap        *template.Template
+	TplGear       *template.Template
+	TplAlbum      *template.Template
 	HashCache     map[string]string
 	PhotoPageExpr *regexp.Regexp
 
 	Cache cache.Cache
-	DB    *db.DB
+	// ReadThrough fills Cache for the getCached* helpers.
+	ReadThrough *cache.ReadThrough
+	DB          *db.DB
+	Scheduler   *syncScheduler
 
 	MapboxToken string
+	MapProvider MapProvider
 
-	IndexCacheTTL        time.Duration
-	PhotoCacheTTL        time.Duration
-	PhotoSizesCacheTTL   time.Duration
+	MapTileURL         string
+	MapTileAttribution string
+
+	ImageCache    *cache.DiskCache
+	ImageUpstream string
+	// imageFetches coalesces concurrent misses on the same image.
+	imageFetches singleflight.Group
+
+	APICORSOrigins []string
+
+	// WebSubHubs are pinged after sync; WebSubBuiltinHub also serves /websub.
+	WebSubHubs       []string
+	WebSubBuiltinHub bool
+
+	// AdminToken enables /admin/purge and /sync/status for "Authorization:
+	// Bearer" requests.
+	AdminToken string
+
+	IndexCacheTTL         time.Duration
+	PhotoCacheTTL         time.Duration
+	PhotoSizesCacheTTL    time.Duration
 	RelatedPhotosCacheTTL time.Duration
-	SitemapCacheTTL      time.Duration
-	FeedCacheTTL         time.Duration
+	SitemapCacheTTL       time.Duration
+	FeedCacheTTL          time.Duration
+	MapCacheTTL           time.Duration
 }
 
-func newTemplateFuncs(licenses map[string]jsonstruct.License) template.FuncMap {
+func newTemplateFuncs(licenses map[string]jsonstruct.License, site *SiteConfig) template.FuncMap {
 	return template.FuncMap{
+		"Site": func() *SiteConfig {
+			return site
+		},
 		"isHTML": func(content string) (template.HTML, error) {
 			return template.HTML(strings.Replace(content, "\n", "<br>", -1)), nil
 		},
@@ -57,6 +94,10 @@ func newTemplateFuncs(licenses map[string]jsonstruct.License) template.FuncMap {
 			content = strings.Replace(content, "+", "\\u002b", -1)
 			return content
 		},
+		"hasPrefixFold": func(s, prefix string) bool {
+			return strings.HasPrefix(strings.ToLower(s), strings.ToLower(prefix))
+		},
+		"pathEscape": url.PathEscape,
 		"replaceHover": func(content string) string {
 			return strings.Replace(content, " ", "-", -1)
 		},
@@ -73,18 +114,27 @@ func newTemplateFuncs(licenses map[string]jsonstruct.License) template.FuncMap {
 		"licensesURL": func(lno string) string {
 			return licenses[lno].URL
 		},
-		"iso8601": func(stamp string) string {
-			ts, err := time.Parse("2006-01-02 15:04:05", stamp)
-			if err == nil {
-				return ts.Format(time.RFC3339)
-			}
-			times, _ := strconv.Atoi(stamp)
-			return time.Unix(int64(times), 0).Format(time.RFC3339)
-		},
+		"iso8601": iso8601,
+	}
+}
+
+// iso8601 formats a Flickr date, either "2006-01-02 15:04:05" (taken) or unix
+// seconds (posted, lastupdate), as RFC 3339.
+func iso8601(stamp string) string {
+	ts, err := time.Parse("2006-01-02 15:04:05", stamp)
+	if err == nil {
+		return ts.Format(time.RFC3339)
 	}
+	times, _ := strconv.Atoi(stamp)
+	return time.Unix(int64(times), 0).Format(time.RFC3339)
 }
 
 func NewApp() (*App, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	tags, err := getTags("./tags.txt")
 	if err != nil {
 		return nil, fmt.Errorf("無法讀取 tags.txt，請確認檔案存在並編輯加入至少一個標籤: %w", err)
@@ -104,20 +154,23 @@ func NewApp() (*App, error) {
 	f := flickr.NewFlickr(os.Getenv("FLICKRAPIKEY"), os.Getenv("FLICKRSECRET"))
 	f.AuthToken = os.Getenv("FLICKRUSERTOKEN")
 	userID := os.Getenv("FLICKRUSER")
+	if cfg.Site.FlickrPath == "" {
+		cfg.Site.FlickrPath = userID
+	}
 
 	licenses := make(map[string]jsonstruct.License)
 	for _, data := range f.PhotosLicensesGetInfo().Licenses.License {
 		if data.URL == "" {
-			data.URL = "https://toomore.net/"
+			data.URL = cfg.Site.Author.URL
 		}
 		licenseID := strconv.FormatInt(data.ID, 10)
 		licenses[licenseID] = data
 	}
 	log.Printf("Licenses: %+v", licenses)
 
-	funcs := newTemplateFuncs(licenses)
+	funcs := newTemplateFuncs(licenses, &cfg.Site)
 
-	tIndex, err := template.ParseFiles("./base.htm")
+	tIndex, err := template.New("base.htm").Funcs(funcs).ParseFiles("./base.htm")
 	if err != nil {
 		return nil, err
 	}
@@ -126,7 +179,7 @@ func NewApp() (*App, error) {
 		return nil, err
 	}
 
-	tPhoto, err := template.ParseFiles("./base_2019.html")
+	tPhoto, err := template.New("base_2019.html").Funcs(funcs).ParseFiles("./base_2019.html")
 	if err != nil {
 		return nil, err
 	}
@@ -135,7 +188,56 @@ func NewApp() (*App, error) {
 		return nil, err
 	}
 
-	tplSitemap, err := template.ParseFiles("./sitemap.htm")
+	tTag, err := template.New("base.htm").Funcs(funcs).ParseFiles("./base.htm")
+	if err != nil {
+		return nil, err
+	}
+	tplTag, err := tTag.Funcs(funcs).ParseFiles("./tag.htm")
+	if err != nil {
+		return nil, err
+	}
+
+	tTags, err := template.New("base.htm").Funcs(funcs).ParseFiles("./base.htm")
+	if err != nil {
+		return nil, err
+	}
+	tplTags, err := tTags.Funcs(funcs).ParseFiles("./tags.htm")
+	if err != nil {
+		return nil, err
+	}
+
+	tSearch, err := template.New("base.htm").Funcs(funcs).ParseFiles("./base.htm")
+	if err != nil {
+		return nil, err
+	}
+	tplSearch, err := tSearch.Funcs(funcs).ParseFiles("./search.htm")
+	if err != nil {
+		return nil, err
+	}
+
+	tMap, err := template.New("base.htm").Funcs(funcs).ParseFiles("./base.htm")
+	if err != nil {
+		return nil, err
+	}
+	tplMap, err := tMap.Funcs(funcs).ParseFiles("./map.htm")
+	if err != nil {
+		return nil, err
+	}
+
+	tGear, err := template.New("base.htm").Funcs(funcs).ParseFiles("./base.htm")
+	if err != nil {
+		return nil, err
+	}
+	tplGear, err := tGear.Funcs(funcs).ParseFiles("./gear.htm")
+	if err != nil {
+		return nil, err
+	}
+
+	tAlbum, err := template.New("base.htm").Funcs(funcs).ParseFiles("./base.htm")
+	if err != nil {
+		return nil, err
+	}
+	tplAlbum, err := tAlbum.Funcs(funcs).ParseFiles("./album.htm")
 	if err != nil {
 		return nil, err
 	}
@@ -147,33 +249,128 @@ func NewApp() (*App, error) {
 		if err != nil {
 			return nil, fmt.Errorf("DATABASE_URL 連線失敗: %w", err)
 		}
-		if err := database.InitSchema(context.Background()); err != nil {
+		if _, err := database.MigrateUp(context.Background()); err != nil {
 			database.Close()
-			return nil, fmt.Errorf("DB schema 初始化失敗: %w", err)
+			return nil, fmt.Errorf("DB migration 失敗: %w", err)
 		}
 	} else {
 		log.Println("DB: DATABASE_URL 未設定，跳過本地資料庫")
 	}
 
+	imageCacheDir := os.Getenv("IMAGE_CACHE_DIR")
+	if imageCacheDir == "" {
+		imageCacheDir = "./imgcache"
+	}
+	imageCacheMax := int64(1 << 30) // 1 GiB
+	if v := os.Getenv("IMAGE_CACHE_MAX_BYTES"); v != "" {
+		if imageCacheMax, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("IMAGE_CACHE_MAX_BYTES 格式錯誤: %w", err)
+		}
+	}
+	imageCache, err := cache.NewDiskCache(imageCacheDir, imageCacheMax)
+	if err != nil {
+		return nil, fmt.Errorf("圖片快取目錄初始化失敗: %w", err)
+	}
+	mapboxToken := os.Getenv("MAPBOX_ACCESS_TOKEN")
+	var mapProvider MapProvider
+	if mapboxToken != "" {
+		mapbox := NewMapboxProvider(mapboxToken)
+		if style := os.Getenv("MAPBOX_STYLE"); style != "" {
+			mapbox.Style = style
+		}
+		mapProvider = mapbox
+	}
+
+	// /map tiles; any {z}/{x}/{y} raster tile server works.
+	mapTileURL := os.Getenv("MAP_TILE_URL")
+	mapTileAttribution := os.Getenv("MAP_TILE_ATTRIBUTION")
+	if mapTileURL == "" {
+		mapTileURL = "https://tile.openstreetmap.org/{z}/{x}/{y}.png"
+		mapTileAttribution = `&copy; <a href="https://www.openstreetmap.org/copyright">OpenStreetMap</a> contributors`
+	}
+
+	corsOrigins := []string{"*"}
+	if v := os.Getenv("API_CORS_ORIGINS"); v != "" {
+		corsOrigins = strings.Split(v, ",")
+		for i := range corsOrigins {
+			corsOrigins[i] = strings.TrimSpace(corsOrigins[i])
+		}
+	}
+
+	imageUpstream := os.Getenv("IMAGE_UPSTREAM")
+	if imageUpstream == "" {
+		imageUpstream = defaultImageUpstream
+	}
+
+	webSubHubs := []string{defaultWebSubHub}
+	if v := os.Getenv("WEBSUB_HUBS"); v == "none" {
+		webSubHubs = nil
+	} else if v != "" {
+		webSubHubs = nil
+		for _, hub := range strings.Split(v, ",") {
+			if hub = strings.TrimSpace(hub); hub != "" {
+				webSubHubs = append(webSubHubs, hub)
+			}
+		}
+	}
+	var webSubBuiltinHub bool
+	if v := os.Getenv("WEBSUB_BUILTIN_HUB"); v != "" {
+		if webSubBuiltinHub, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("WEBSUB_BUILTIN_HUB 格式錯誤: %w", err)
+		}
+		if webSubBuiltinHub && database == nil {
+			log.Println("WebSub: 內建 hub 需要 DATABASE_URL，已停用")
+			webSubBuiltinHub = false
+		}
+	}
+
+	// validate checked the name.
+	codec, _ := cache.CodecByName(cfg.Cache.Codec)
+	appCache := cache.New(cache.Options{
+		MemoryMaxBytes:   int64(cfg.Cache.MemoryMaxBytes),
+		MemoryMaxEntries: cfg.Cache.MemoryMaxEntries,
+		L1:               cfg.Cache.L1,
+		L1MaxBytes:       int64(cfg.Cache.L1MaxBytes),
+		L1TTL:            cfg.Cache.L1TTL,
+		Codec:            codec,
+	})
 	return &App{
-		Flickr:               f,
-		Licenses:             licenses,
-		Tags:                 tags,
-		UserID:               userID,
-		TplIndex:             tplIndex,
-		TplPhoto:             tplPhoto,
-		TplSitemap:           tplSitemap,
-		HashCache:            make(map[string]string),
-		PhotoPageExpr:        regexp.MustCompile(`/p/([0-9]+)-?(.+)?`),
-		Cache:                cache.New(),
-		DB:                   database,
-		MapboxToken:          os.Getenv("MAPBOX_ACCESS_TOKEN"),
-		IndexCacheTTL:        10 * time.Minute,
-		PhotoCacheTTL:        30 * 24 * time.Hour,     // 30 天
-		PhotoSizesCacheTTL:   365 * 24 * time.Hour,    // 365 天
-		RelatedPhotosCacheTTL: 1 * time.Hour,
-		SitemapCacheTTL:      30 * time.Minute,
-		FeedCacheTTL:         30 * time.Minute,
+		Config:                cfg,
+		Flickr:                f,
+		FlickrAPI:             newFlickrAPI(os.Getenv("FLICKRAPIKEY"), os.Getenv("FLICKRSECRET"), f.AuthToken),
+		Licenses:              licenses,
+		Tags:                  tags,
+		UserID:                userID,
+		TplIndex:              tplIndex,
+		TplPhoto:              tplPhoto,
+		TplTag:                tplTag,
+		TplTags:               tplTags,
+		TplSearch:             tplSearch,
+		TplMap:                tplMap,
+		TplGear:               tplGear,
+		TplAlbum:              tplAlbum,
+		HashCache:             make(map[string]string),
+		PhotoPageExpr:         regexp.MustCompile(`/p/([0-9]+)-?(.+)?`),
+		Cache:                 appCache,
+		ReadThrough:           cache.NewReadThrough(appCache, cfg.Cache.FillLock),
+		DB:                    database,
+		MapboxToken:           mapboxToken,
+		MapProvider:           mapProvider,
+		MapTileURL:            mapTileURL,
+		MapTileAttribution:    mapTileAttribution,
+		ImageCache:            imageCache,
+		ImageUpstream:         imageUpstream,
+		APICORSOrigins:        corsOrigins,
+		WebSubHubs:            webSubHubs,
+		WebSubBuiltinHub:      webSubBuiltinHub,
+		AdminToken:            os.Getenv("ADMIN_TOKEN"),
+		IndexCacheTTL:         cfg.Cache.Index,
+		PhotoCacheTTL:         cfg.Cache.Photo,
+		PhotoSizesCacheTTL:    cfg.Cache.PhotoSizes,
+		RelatedPhotosCacheTTL: cfg.Cache.Related,
+		SitemapCacheTTL:       cfg.Cache.Sitemap,
+		FeedCacheTTL:          cfg.Cache.Feed,
+		MapCacheTTL:           cfg.Cache.Map,
 	}, nil
 }
 
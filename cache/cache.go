@@ -1,11 +1,16 @@
 package cache
 
 import (
+	"container/list"
 	"context"
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"log"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -13,61 +18,310 @@ import (
 
 const keyPrefix = "toomorephotos:"
 
+// tagSetPrefix namespaces the Redis sets behind TagKeys.
+const tagSetPrefix = "tagset:"
+
+// lockPrefix namespaces TryLock keys, which DeleteByPrefix leaves alone.
+const lockPrefix = "lock:"
+
+// scanCount is the SCAN COUNT hint and UNLINK batch size of DeleteByPrefix.
+const scanCount = 500
+
 // Cache defines the interface for cache operations.
 type Cache interface {
 	Get(ctx context.Context, key string, dest interface{}) (bool, error)
 	Set(ctx context.Context, key string, val interface{}, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+	// DeleteByPrefix deletes every key starting with prefix and returns how
+	// many were deleted.
+	DeleteByPrefix(ctx context.Context, prefix string) (int, error)
+	// TagKeys adds keys to the invalidation group tag for at least ttl.
+	TagKeys(ctx context.Context, tag string, ttl time.Duration, keys ...string) error
+	// InvalidateTags deletes the keys of each group and the groups, and
+	// returns how many keys were deleted.
+	InvalidateTags(ctx context.Context, tags ...string) (int, error)
+}
+
+// Locker is implemented by caches shared across instances that can provide
+// a distributed lock.
+type Locker interface {
+	TryLock(ctx context.Context, name string, ttl time.Duration) (release func(), ok bool, err error)
 }
 
-// MemoryCache is an in-memory cache implementation.
+// memoryEntryOverhead approximates the map, list and struct bookkeeping of
+// one entry, so many small entries still count against maxBytes.
+const memoryEntryOverhead = 128
+
+// janitorInterval is how often MemoryCache drops expired entries.
+const janitorInterval = time.Minute
+
+// MemoryCache is an in-memory cache bounded by bytes and entries, evicting
+// the least recently used entries. A janitor drops expired ones.
 type MemoryCache struct {
-	mu    sync.RWMutex
-	store map[string]memoryEntry
+	maxBytes   int64
+	maxEntries int
+	codec      Codec
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List // front = most recently used
+	store map[string]*list.Element
+	tags  map[string]map[string]struct{}
+
+	hits, misses, evictions, expired atomic.Uint64
+
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
 type memoryEntry struct {
-	data     []byte
+	key       string
+	data      []byte
 	expiresAt time.Time
 }
 
-// NewMemoryCache creates a new in-memory cache.
-func NewMemoryCache() *MemoryCache {
-	return &MemoryCache{store: make(map[string]memoryEntry)}
+func (e *memoryEntry) size() int64 {
+	return int64(len(e.key)+len(e.data)) + memoryEntryOverhead
+}
+
+// Stats is a snapshot of MemoryCache counters for monitoring.
+type Stats struct {
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	Evictions  uint64 `json:"evictions"`
+	Expired    uint64 `json:"expired"`
+	Entries    int    `json:"entries"`
+	Bytes      int64  `json:"bytes"`
+	MaxBytes   int64  `json:"max_bytes"`
+	MaxEntries int    `json:"max_entries"`
+}
+
+// NewMemoryCache creates an in-memory cache holding at most maxBytes and
+// maxEntries (<= 0 is unlimited) and starts its janitor. A nil codec is
+// JSON.
+func NewMemoryCache(maxBytes int64, maxEntries int, codec Codec) *MemoryCache {
+	if codec == nil {
+		codec = JSON
+	}
+	m := &MemoryCache{
+		maxBytes:   maxBytes,
+		maxEntries: maxEntries,
+		codec:      codec,
+		lru:        list.New(),
+		store:      make(map[string]*list.Element),
+		tags:       make(map[string]map[string]struct{}),
+		stop:       make(chan struct{}),
+	}
+	go m.janitor(janitorInterval)
+	return m
+}
+
+// Close stops the janitor.
+func (m *MemoryCache) Close() {
+	m.stopOnce.Do(func() { close(m.stop) })
 }
 
 func (m *MemoryCache) Get(ctx context.Context, key string, dest interface{}) (bool, error) {
-	fullKey := keyPrefix + key
-	m.mu.RLock()
-	ent, ok := m.store[fullKey]
-	m.mu.RUnlock()
-	if !ok || time.Now().After(ent.expiresAt) {
+	data, ok := m.getRaw(key)
+	if !ok {
 		return false, nil
 	}
-	if err := json.Unmarshal(ent.data, dest); err != nil {
+	if err := m.codec.Unmarshal(data, dest); err != nil {
 		return false, err
 	}
 	return true, nil
 }
 
+// getRaw returns the encoded value of key. The bytes are never modified
+// after Set, so they are safe to read unlocked.
+func (m *MemoryCache) getRaw(key string) ([]byte, bool) {
+	fullKey := keyPrefix + key
+	var data []byte
+	m.mu.Lock()
+	el, ok := m.store[fullKey]
+	if ok {
+		e := el.Value.(*memoryEntry)
+		if time.Now().After(e.expiresAt) {
+			m.removeLocked(el)
+			m.expired.Add(1)
+			ok = false
+		} else {
+			m.lru.MoveToFront(el)
+			data = e.data
+		}
+	}
+	m.mu.Unlock()
+	if !ok {
+		m.misses.Add(1)
+		return nil, false
+	}
+	m.hits.Add(1)
+	return data, true
+}
+
 func (m *MemoryCache) Set(ctx context.Context, key string, val interface{}, ttl time.Duration) error {
-	data, err := json.Marshal(val)
+	data, err := m.codec.Marshal(val)
 	if err != nil {
 		return err
 	}
-	fullKey := keyPrefix + key
+	return m.setRaw(key, data, ttl)
+}
+
+func (m *MemoryCache) setRaw(key string, data []byte, ttl time.Duration) error {
+	e := &memoryEntry{key: keyPrefix + key, data: data, expiresAt: time.Now().Add(ttl)}
 	m.mu.Lock()
-	m.store[fullKey] = memoryEntry{data: data, expiresAt: time.Now().Add(ttl)}
+	defer m.mu.Unlock()
+	if el, ok := m.store[e.key]; ok {
+		m.removeLocked(el)
+	}
+	if m.maxBytes > 0 && e.size() > m.maxBytes {
+		return fmt.Errorf("cache: %s is %d bytes, over the %d byte limit", key, e.size(), m.maxBytes)
+	}
+	m.store[e.key] = m.lru.PushFront(e)
+	m.size += e.size()
+	m.evictLocked()
+	return nil
+}
+
+func (m *MemoryCache) Delete(ctx context.Context, keys ...string) error {
+	m.mu.Lock()
+	for _, key := range keys {
+		if el, ok := m.store[keyPrefix+key]; ok {
+			m.removeLocked(el)
+		}
+	}
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryCache) DeleteByPrefix(ctx context.Context, prefix string) (int, error) {
+	fullPrefix := keyPrefix + prefix
+	n := 0
+	m.mu.Lock()
+	for key, el := range m.store {
+		if strings.HasPrefix(key, fullPrefix) {
+			m.removeLocked(el)
+			n++
+		}
+	}
+	m.mu.Unlock()
+	return n, nil
+}
+
+func (m *MemoryCache) TagKeys(ctx context.Context, tag string, ttl time.Duration, keys ...string) error {
+	m.mu.Lock()
+	group, ok := m.tags[tag]
+	if !ok {
+		group = make(map[string]struct{})
+		m.tags[tag] = group
+	}
+	for _, key := range keys {
+		group[keyPrefix+key] = struct{}{}
+	}
 	m.mu.Unlock()
 	return nil
 }
 
+func (m *MemoryCache) InvalidateTags(ctx context.Context, tags ...string) (int, error) {
+	n := 0
+	m.mu.Lock()
+	for _, tag := range tags {
+		for key := range m.tags[tag] {
+			if el, ok := m.store[key]; ok {
+				m.removeLocked(el)
+				n++
+			}
+		}
+		delete(m.tags, tag)
+	}
+	m.mu.Unlock()
+	return n, nil
+}
+
+// Stats returns the counters and current size.
+func (m *MemoryCache) Stats() Stats {
+	m.mu.Lock()
+	entries, size := m.lru.Len(), m.size
+	m.mu.Unlock()
+	return Stats{
+		Hits:       m.hits.Load(),
+		Misses:     m.misses.Load(),
+		Evictions:  m.evictions.Load(),
+		Expired:    m.expired.Load(),
+		Entries:    entries,
+		Bytes:      size,
+		MaxBytes:   m.maxBytes,
+		MaxEntries: m.maxEntries,
+	}
+}
+
+func (m *MemoryCache) removeLocked(el *list.Element) {
+	e := el.Value.(*memoryEntry)
+	m.lru.Remove(el)
+	delete(m.store, e.key)
+	m.size -= e.size()
+}
+
+// evictLocked drops least recently used entries until both limits hold.
+func (m *MemoryCache) evictLocked() {
+	for (m.maxBytes > 0 && m.size > m.maxBytes) || (m.maxEntries > 0 && m.lru.Len() > m.maxEntries) {
+		el := m.lru.Back()
+		if el == nil {
+			return
+		}
+		m.removeLocked(el)
+		m.evictions.Add(1)
+	}
+}
+
+func (m *MemoryCache) janitor(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-t.C:
+			m.sweep()
+		}
+	}
+}
+
+// sweep drops expired entries and the group members they leave behind.
+func (m *MemoryCache) sweep() {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, el := range m.store {
+		if now.After(el.Value.(*memoryEntry).expiresAt) {
+			m.removeLocked(el)
+			m.expired.Add(1)
+		}
+	}
+	for tag, group := range m.tags {
+		for key := range group {
+			if _, ok := m.store[key]; !ok {
+				delete(group, key)
+			}
+		}
+		if len(group) == 0 {
+			delete(m.tags, tag)
+		}
+	}
+}
+
 // RedisCache is a Redis-backed cache implementation.
 type RedisCache struct {
 	client *redis.Client
+	codec  Codec
 }
 
-// NewRedisCache creates a new Redis cache from REDIS_URL.
-func NewRedisCache(addr string) (*RedisCache, error) {
+// NewRedisCache creates a new Redis cache from REDIS_URL. A nil codec is
+// JSON.
+func NewRedisCache(addr string, codec Codec) (*RedisCache, error) {
+	if codec == nil {
+		codec = JSON
+	}
 	opt, err := redis.ParseURL(addr)
 	if err != nil {
 		return nil, err
@@ -76,7 +330,7 @@ func NewRedisCache(addr string) (*RedisCache, error) {
 	if err := client.Ping(context.Background()).Err(); err != nil {
 		return nil, err
 	}
-	return &RedisCache{client: client}, nil
+	return &RedisCache{client: client, codec: codec}, nil
 }
 
 func (r *RedisCache) Get(ctx context.Context, key string, dest interface{}) (bool, error) {
@@ -88,14 +342,38 @@ func (r *RedisCache) Get(ctx context.Context, key string, dest interface{}) (boo
 	if err != nil {
 		return false, err
 	}
-	if err := json.Unmarshal(val, dest); err != nil {
+	if err := r.codec.Unmarshal(val, dest); err != nil {
 		return false, err
 	}
 	return true, nil
 }
 
+// getRaw returns the encoded value of key and its remaining TTL, which is
+// <= 0 for a key without expiry.
+func (r *RedisCache) getRaw(ctx context.Context, key string) ([]byte, time.Duration, bool, error) {
+	fullKey := keyPrefix + key
+	var get *redis.StringCmd
+	var ttl *redis.DurationCmd
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.Get(ctx, fullKey)
+		ttl = pipe.PTTL(ctx, fullKey)
+		return nil
+	})
+	if err == redis.Nil {
+		return nil, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, false, err
+	}
+	data, err := get.Bytes()
+	if err != nil {
+		return nil, 0, false, err
+	}
+	return data, ttl.Val(), true, nil
+}
+
 func (r *RedisCache) Set(ctx context.Context, key string, val interface{}, ttl time.Duration) error {
-	data, err := json.Marshal(val)
+	data, err := r.codec.Marshal(val)
 	if err != nil {
 		return err
 	}
@@ -103,18 +381,200 @@ func (r *RedisCache) Set(ctx context.Context, key string, val interface{}, ttl t
 	return r.client.Set(ctx, fullKey, data, ttl).Err()
 }
 
+func (r *RedisCache) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	fullKeys := make([]string, len(keys))
+	for i, key := range keys {
+		fullKeys[i] = keyPrefix + key
+	}
+	return r.client.Del(ctx, fullKeys...).Err()
+}
+
+// DeleteByPrefix walks the matching keys with SCAN and removes them with
+// UNLINK, so a large purge does not block Redis. Locks are kept.
+func (r *RedisCache) DeleteByPrefix(ctx context.Context, prefix string) (int, error) {
+	match := globEscape(keyPrefix+prefix) + "*"
+	n := 0
+	iter := r.client.Scan(ctx, 0, match, scanCount).Iterator()
+	batch := make([]string, 0, scanCount)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		deleted, err := r.client.Unlink(ctx, batch...).Result()
+		n += int(deleted)
+		batch = batch[:0]
+		return err
+	}
+	for iter.Next(ctx) {
+		if strings.HasPrefix(iter.Val(), keyPrefix+lockPrefix) {
+			continue
+		}
+		batch = append(batch, iter.Val())
+		if len(batch) == scanCount {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return n, err
+	}
+	return n, flush()
+}
+
+// TagKeys keeps a group as a Redis set of full keys. The set expires with
+// its longest-lived member: EXPIRE NX gives a new set a TTL and EXPIRE GT
+// only ever extends it (Redis 7+).
+func (r *RedisCache) TagKeys(ctx context.Context, tag string, ttl time.Duration, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	members := make([]interface{}, len(keys))
+	for i, key := range keys {
+		members[i] = keyPrefix + key
+	}
+	setKey := keyPrefix + tagSetPrefix + tag
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, setKey, members...)
+		pipe.ExpireNX(ctx, setKey, ttl)
+		pipe.ExpireGT(ctx, setKey, ttl)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisCache) InvalidateTags(ctx context.Context, tags ...string) (int, error) {
+	n, _, err := r.invalidateTags(ctx, tags...)
+	return n, err
+}
+
+// invalidateTags is InvalidateTags also returning every member of the
+// groups, without keyPrefix, for TieredCache to drop from L1.
+func (r *RedisCache) invalidateTags(ctx context.Context, tags ...string) (int, []string, error) {
+	n := 0
+	var members []string
+	for _, tag := range tags {
+		setKey := keyPrefix + tagSetPrefix + tag
+		keys, err := r.client.SMembers(ctx, setKey).Result()
+		if err != nil {
+			return n, members, err
+		}
+		if len(keys) > 0 {
+			deleted, err := r.client.Unlink(ctx, keys...).Result()
+			if err != nil {
+				return n, members, err
+			}
+			n += int(deleted)
+			for _, key := range keys {
+				members = append(members, strings.TrimPrefix(key, keyPrefix))
+			}
+		}
+		if err := r.client.Unlink(ctx, setKey).Err(); err != nil {
+			return n, members, err
+		}
+	}
+	return n, members, nil
+}
+
+// globEscape escapes the SCAN MATCH metacharacters in s.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+var (
+	unlockScript  = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`)
+	refreshScript = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) end return 0`)
+)
+
+// TryLock takes the lock name with SET NX without waiting. While held, the
+// lock is refreshed every ttl/3 so long work does not outlive it; if the
+// process dies it expires after ttl. ok is false if someone else holds it.
+func (r *RedisCache) TryLock(ctx context.Context, name string, ttl time.Duration) (release func(), ok bool, err error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, false, err
+	}
+	token := hex.EncodeToString(buf)
+	lockKey := keyPrefix + lockPrefix + name
+	ok, err = r.client.SetNX(ctx, lockKey, token, ttl).Result()
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(ttl / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if err := refreshScript.Run(context.Background(), r.client, []string{lockKey}, token, ttl.Milliseconds()).Err(); err != nil {
+					log.Printf("Cache: refresh lock %s: %v", name, err)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			close(done)
+			if err := unlockScript.Run(context.Background(), r.client, []string{lockKey}, token).Err(); err != nil {
+				log.Printf("Cache: unlock %s: %v", name, err)
+			}
+		})
+	}
+	return release, true, nil
+}
+
+// Options configures New.
+type Options struct {
+	// MemoryMaxBytes and MemoryMaxEntries bound the MemoryCache; <= 0 is
+	// unlimited.
+	MemoryMaxBytes   int64
+	MemoryMaxEntries int
+	// L1 puts an in-memory cache of at most L1MaxBytes, with entries living
+	// at most L1TTL, in front of Redis. See TieredCache.
+	L1         bool
+	L1MaxBytes int64
+	L1TTL      time.Duration
+	// Codec encodes values; nil is JSON.
+	Codec Codec
+}
+
 // New returns a Cache implementation based on REDIS_URL.
-// If REDIS_URL is set, returns RedisCache; otherwise returns MemoryCache.
-func New() Cache {
+// If REDIS_URL is set, returns RedisCache, or TieredCache with opts.L1;
+// otherwise returns MemoryCache.
+func New(opts Options) Cache {
 	addr := os.Getenv("REDIS_URL")
 	if addr == "" {
 		log.Println("Cache: using in-memory (REDIS_URL not set)")
-		return NewMemoryCache()
+		return NewMemoryCache(opts.MemoryMaxBytes, opts.MemoryMaxEntries, opts.Codec)
 	}
-	rc, err := NewRedisCache(addr)
+	rc, err := NewRedisCache(addr, opts.Codec)
 	if err != nil {
 		log.Printf("Cache: Redis connect failed (%v), falling back to memory", err)
-		return NewMemoryCache()
+		return NewMemoryCache(opts.MemoryMaxBytes, opts.MemoryMaxEntries, opts.Codec)
+	}
+	if opts.L1 {
+		tc, err := NewTieredCache(rc, opts.L1MaxBytes, opts.L1TTL)
+		if err == nil {
+			log.Println("Cache: using Redis with in-memory L1")
+			return tc
+		}
+		log.Printf("Cache: L1 subscribe failed (%v), using Redis only", err)
 	}
 	log.Println("Cache: using Redis")
 	return rc
@@ -0,0 +1,264 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestMemoryCache(t testing.TB, maxBytes int64, maxEntries int) *MemoryCache {
+	t.Helper()
+	m := NewMemoryCache(maxBytes, maxEntries, nil)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// has reports whether key is cached, without touching the LRU order or the
+// hit counters.
+func (m *MemoryCache) has(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.store[keyPrefix+key]
+	return ok
+}
+
+func TestMemoryCacheGetSet(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMemoryCache(t, 0, 0)
+	if err := m.Set(ctx, "a", map[string]int{"n": 1}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]int
+	if ok, err := m.Get(ctx, "a", &got); err != nil || !ok || got["n"] != 1 {
+		t.Errorf("Get = %v, %v, %v", got, ok, err)
+	}
+	if ok, _ := m.Get(ctx, "missing", &got); ok {
+		t.Error("Get of a missing key hit")
+	}
+}
+
+func TestMemoryCacheLRUOrder(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMemoryCache(t, 0, 3)
+	for _, key := range []string{"a", "b", "c"} {
+		m.Set(ctx, key, key, time.Minute)
+	}
+	// a is now the most recently used, b the least.
+	var v string
+	m.Get(ctx, "a", &v)
+	m.Set(ctx, "d", "d", time.Minute)
+	if m.has("b") {
+		t.Error("b was not evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if !m.has(key) {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+
+	// Overwriting refreshes recency too.
+	m.Set(ctx, "c", "c2", time.Minute)
+	m.Set(ctx, "e", "e", time.Minute)
+	if m.has("a") {
+		t.Error("a was not evicted")
+	}
+	if !m.has("c") {
+		t.Error("c was evicted after being overwritten")
+	}
+}
+
+func TestMemoryCacheByteLimit(t *testing.T) {
+	ctx := context.Background()
+	value := strings.Repeat("x", 100)
+	m := newTestMemoryCache(t, 0, 0)
+	m.Set(ctx, "k0", value, time.Minute)
+	perEntry := m.Stats().Bytes
+
+	m = newTestMemoryCache(t, 3*perEntry, 0)
+	for i := range 5 {
+		if err := m.Set(ctx, fmt.Sprintf("k%d", i), value, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := m.Stats()
+	if s.Entries != 3 || s.Bytes != 3*perEntry || s.Bytes > s.MaxBytes {
+		t.Errorf("Stats = %+v, want 3 entries of %d bytes", s, perEntry)
+	}
+	if s.Evictions != 2 {
+		t.Errorf("Evictions = %d, want 2", s.Evictions)
+	}
+	for i, want := range []bool{false, false, true, true, true} {
+		if got := m.has(fmt.Sprintf("k%d", i)); got != want {
+			t.Errorf("k%d cached = %v, want %v", i, got, want)
+		}
+	}
+
+	// A value larger than the whole cache is refused, not stored.
+	if err := m.Set(ctx, "huge", strings.Repeat("x", int(4*perEntry)), time.Minute); err == nil {
+		t.Error("oversized Set succeeded")
+	}
+	if m.has("huge") || m.Stats().Entries != 3 {
+		t.Error("oversized Set changed the cache")
+	}
+}
+
+func TestMemoryCacheEntryLimit(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMemoryCache(t, 0, 10)
+	for i := range 25 {
+		m.Set(ctx, fmt.Sprintf("k%d", i), i, time.Minute)
+	}
+	s := m.Stats()
+	if s.Entries != 10 || s.Evictions != 15 {
+		t.Errorf("Stats = %+v, want 10 entries and 15 evictions", s)
+	}
+	if !m.has("k24") || m.has("k14") {
+		t.Error("did not keep the 10 newest entries")
+	}
+}
+
+func TestMemoryCacheJanitor(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMemoryCache(t, 0, 0)
+	m.Set(ctx, "short", 1, 10*time.Millisecond)
+	m.Set(ctx, "long", 1, time.Hour)
+	m.TagKeys(ctx, "group", time.Hour, "short", "long")
+	go m.janitor(5 * time.Millisecond)
+
+	deadline := time.Now().Add(time.Second)
+	for m.has("short") {
+		if time.Now().After(deadline) {
+			t.Fatal("janitor did not drop the expired entry")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	s := m.Stats()
+	if s.Entries != 1 || s.Expired != 1 || !m.has("long") {
+		t.Errorf("Stats = %+v, want only long left and 1 expired", s)
+	}
+	m.mu.Lock()
+	_, stale := m.tags["group"][keyPrefix+"short"]
+	m.mu.Unlock()
+	if stale {
+		t.Error("janitor left the expired key in its group")
+	}
+}
+
+func TestMemoryCacheExpiredOnGet(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMemoryCache(t, 0, 0)
+	m.Set(ctx, "a", 1, -time.Second)
+	var v int
+	if ok, _ := m.Get(ctx, "a", &v); ok {
+		t.Error("Get returned an expired entry")
+	}
+	if s := m.Stats(); s.Expired != 1 || s.Entries != 0 {
+		t.Errorf("Stats = %+v, want 1 expired and no entries", s)
+	}
+}
+
+func TestMemoryCacheStats(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMemoryCache(t, 1<<20, 100)
+	m.Set(ctx, "a", "value", time.Minute)
+	var v string
+	m.Get(ctx, "a", &v)
+	m.Get(ctx, "a", &v)
+	m.Get(ctx, "b", &v)
+
+	s := m.Stats()
+	want := Stats{Hits: 2, Misses: 1, Entries: 1, MaxBytes: 1 << 20, MaxEntries: 100}
+	want.Bytes = s.Bytes
+	if s != want {
+		t.Errorf("Stats = %+v, want %+v", s, want)
+	}
+	if s.Bytes <= memoryEntryOverhead {
+		t.Errorf("Bytes = %d, want key and value counted over the %d overhead", s.Bytes, memoryEntryOverhead)
+	}
+
+	m.Delete(ctx, "a")
+	if s := m.Stats(); s.Entries != 0 || s.Bytes != 0 {
+		t.Errorf("after Delete Stats = %+v, want empty", s)
+	}
+}
+
+func TestMemoryCacheInvalidateTags(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMemoryCache(t, 0, 0)
+	for _, key := range []string{"photo:1", "related:1", "photo:2"} {
+		m.Set(ctx, key, key, time.Minute)
+	}
+	m.TagKeys(ctx, "p1", time.Minute, "photo:1", "related:1")
+	n, err := m.InvalidateTags(ctx, "p1", "unknown")
+	if err != nil || n != 2 {
+		t.Errorf("InvalidateTags = %d, %v, want 2", n, err)
+	}
+	if m.has("photo:1") || m.has("related:1") || !m.has("photo:2") {
+		t.Error("InvalidateTags deleted the wrong keys")
+	}
+}
+
+// benchmarkValue is about the size of a cached photo info.
+var benchmarkValue = strings.Repeat("x", 2048)
+
+func BenchmarkMemoryCacheGet(b *testing.B) {
+	ctx := context.Background()
+	m := newTestMemoryCache(b, 0, 0)
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("photo:%d", i)
+		m.Set(ctx, keys[i], benchmarkValue, time.Hour)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	var v string
+	for i := 0; i < b.N; i++ {
+		m.Get(ctx, keys[i%len(keys)], &v)
+	}
+}
+
+func BenchmarkMemoryCacheSet(b *testing.B) {
+	ctx := context.Background()
+	m := newTestMemoryCache(b, 0, 0)
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("photo:%d", i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Set(ctx, keys[i%len(keys)], benchmarkValue, time.Hour)
+	}
+}
+
+// BenchmarkMemoryCacheSetEvict writes new keys into a full cache, so every
+// Set evicts one entry.
+func BenchmarkMemoryCacheSetEvict(b *testing.B) {
+	ctx := context.Background()
+	m := newTestMemoryCache(b, 0, 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Set(ctx, fmt.Sprintf("photo:%d", i), benchmarkValue, time.Hour)
+	}
+}
+
+func BenchmarkMemoryCacheGetParallel(b *testing.B) {
+	ctx := context.Background()
+	m := newTestMemoryCache(b, 0, 0)
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("photo:%d", i)
+		m.Set(ctx, keys[i], benchmarkValue, time.Hour)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var v string
+		for i := 0; pb.Next(); i++ {
+			m.Get(ctx, keys[i%len(keys)], &v)
+		}
+	})
+}
@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encoded values start with a version byte naming their format, so the
+// codec can change without breaking values already in Redis. Values
+// written before codecs existed are plain JSON, which never starts with
+// these bytes.
+const (
+	versionJSON byte = 1
+	versionGob  byte = 2
+	// versionZstd wraps another encoded value, version byte included.
+	versionZstd byte = 3
+)
+
+// zstdMinSize is the smallest encoding worth compressing; smaller values
+// are stored as the inner codec wrote them.
+const zstdMinSize = 1024
+
+// zstdMaxSize bounds a decompressed value, so a corrupt entry cannot
+// exhaust memory.
+const zstdMaxSize = 256 << 20
+
+// Codec encodes cache values. Every Codec here decodes every format, so
+// switching codecs only changes how new values are written.
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSON is the default codec.
+	JSON Codec = jsonCodec{}
+	// Gob is smaller and faster to decode than JSON for large structs.
+	Gob Codec = gobCodec{}
+)
+
+// Zstd compresses what inner writes when it is at least zstdMinSize.
+func Zstd(inner Codec) Codec {
+	return zstdCodec{inner: inner}
+}
+
+// CodecByName returns "json", "gob", "json+zstd" or "gob+zstd".
+func CodecByName(name string) (Codec, error) {
+	base, compress := strings.CutSuffix(name, "+zstd")
+	var c Codec
+	switch base {
+	case "json":
+		c = JSON
+	case "gob":
+		c = Gob
+	default:
+		return nil, fmt.Errorf("cache: unknown codec %q", name)
+	}
+	if compress {
+		if _, _, err := zstdCoders(); err != nil {
+			return nil, err
+		}
+		c = Zstd(c)
+	}
+	return c, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{versionJSON}, data...), nil
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return decode(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(versionGob)
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error { return decode(data, v) }
+
+type zstdCodec struct {
+	inner Codec
+}
+
+func (c zstdCodec) Name() string { return c.inner.Name() + "+zstd" }
+
+func (c zstdCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := c.inner.Marshal(v)
+	if err != nil || len(data) < zstdMinSize {
+		return data, err
+	}
+	enc, _, err := zstdCoders()
+	if err != nil {
+		return nil, err
+	}
+	return enc.EncodeAll(data, []byte{versionZstd}), nil
+}
+
+func (zstdCodec) Unmarshal(data []byte, v interface{}) error { return decode(data, v) }
+
+// decode reads any format by its version byte.
+func decode(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return json.Unmarshal(data, v)
+	}
+	switch data[0] {
+	case versionJSON:
+		return json.Unmarshal(data[1:], v)
+	case versionGob:
+		return gob.NewDecoder(bytes.NewReader(data[1:])).Decode(v)
+	case versionZstd:
+		_, dec, err := zstdCoders()
+		if err != nil {
+			return err
+		}
+		inner, err := dec.DecodeAll(data[1:], nil)
+		if err != nil {
+			return err
+		}
+		if len(inner) > 0 && inner[0] == versionZstd {
+			return fmt.Errorf("cache: nested zstd value")
+		}
+		return decode(inner, v)
+	default:
+		return json.Unmarshal(data, v)
+	}
+}
+
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+	zstdErr  error
+)
+
+// zstdCoders returns the shared encoder and decoder; EncodeAll and
+// DecodeAll are safe for concurrent use.
+func zstdCoders() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		if zstdEnc, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault)); zstdErr != nil {
+			zstdErr = fmt.Errorf("cache: zstd encoder: %w", zstdErr)
+			return
+		}
+		if zstdDec, zstdErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(zstdMaxSize)); zstdErr != nil {
+			zstdErr = fmt.Errorf("cache: zstd decoder: %w", zstdErr)
+		}
+	})
+	return zstdEnc, zstdDec, zstdErr
+}
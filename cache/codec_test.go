@@ -0,0 +1,229 @@
+package cache
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/feeds"
+	"github.com/klauspost/compress/zstd"
+)
+
+// testFeed mirrors the main package's photoFeed, the largest cached value:
+// a feeds.Feed embedded next to per-item photos.
+type testFeed struct {
+	feeds.Feed
+	Photos   []testFeedPhoto `json:"photos"`
+	Modified time.Time       `json:"modified"`
+}
+
+type testFeedPhoto struct {
+	Image     string   `json:"image"`
+	Width     int64    `json:"width"`
+	Height    int64    `json:"height"`
+	Thumbnail string   `json:"thumbnail"`
+	Tags      []string `json:"tags"`
+}
+
+// newTestFeed builds a feed of n items about the size of the site's feeds.
+func newTestFeed(n int) *testFeed {
+	updated := time.Date(2026, 10, 1, 8, 30, 0, 0, time.UTC)
+	f := &testFeed{
+		Feed: feeds.Feed{
+			Title:       "Toomore Photos",
+			Link:        &feeds.Link{Href: "https://photos.example.com/"},
+			Description: "Photos by Toomore.",
+			Author:      &feeds.Author{Name: "Toomore"},
+			Updated:     updated,
+			Created:     updated,
+			Image:       &feeds.Image{Url: "https://photos.example.com/logo.png", Title: "Toomore Photos", Width: 144, Height: 144},
+		},
+		Modified: updated,
+	}
+	for i := range n {
+		id := fmt.Sprint(53000000000 + i)
+		f.Items = append(f.Items, &feeds.Item{
+			Title:       "Photo " + id,
+			Link:        &feeds.Link{Href: "https://photos.example.com/p/" + id},
+			Author:      &feeds.Author{Name: "Toomore"},
+			Description: strings.Repeat("A walk through the old town at dusk. ", 8),
+			Id:          "https://photos.example.com/p/" + id,
+			Created:     updated.Add(-time.Duration(i) * time.Hour),
+			Updated:     updated.Add(-time.Duration(i) * time.Hour),
+			Enclosure:   &feeds.Enclosure{Url: "https://live.staticflickr.com/65535/" + id + "_abcdef1234_b.jpg", Length: "0", Type: "image/jpeg"},
+			Content:     `<p><img src="https://live.staticflickr.com/65535/` + id + `_abcdef1234_b.jpg" alt="Photo ` + id + `"></p>`,
+		})
+		f.Photos = append(f.Photos, testFeedPhoto{
+			Image:     "https://live.staticflickr.com/65535/" + id + "_abcdef1234_b.jpg",
+			Width:     1024,
+			Height:    683,
+			Thumbnail: "https://live.staticflickr.com/65535/" + id + "_abcdef1234_q.jpg",
+			Tags:      []string{"taipei", "street", "night"},
+		})
+	}
+	return f
+}
+
+var testCodecs = []Codec{JSON, Gob, Zstd(JSON), Zstd(Gob)}
+
+func TestCodecRoundTrip(t *testing.T) {
+	want := entry[*testFeed]{Value: newTestFeed(20), FreshUntil: time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)}
+	for _, c := range testCodecs {
+		t.Run(c.Name(), func(t *testing.T) {
+			data, err := c.Marshal(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got entry[*testFeed]
+			if err := c.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("round trip changed the value:\ngot  %+v\nwant %+v", got.Value.Feed, want.Value.Feed)
+			}
+		})
+	}
+}
+
+func TestCodecVersionByte(t *testing.T) {
+	feed := newTestFeed(20)
+	small := "small"
+	tests := []struct {
+		codec Codec
+		value interface{}
+		want  byte
+	}{
+		{JSON, feed, versionJSON},
+		{Gob, feed, versionGob},
+		{Zstd(JSON), feed, versionZstd},
+		{Zstd(Gob), feed, versionZstd},
+		// Values under zstdMinSize are left uncompressed.
+		{Zstd(JSON), small, versionJSON},
+		{Zstd(Gob), small, versionGob},
+	}
+	for _, tt := range tests {
+		data, err := tt.codec.Marshal(tt.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data[0] != tt.want {
+			t.Errorf("%s of %T: version byte %d, want %d", tt.codec.Name(), tt.value, data[0], tt.want)
+		}
+	}
+}
+
+// TestCodecReadsEveryFormat switches codecs over existing values: each
+// codec must decode what the others wrote.
+func TestCodecReadsEveryFormat(t *testing.T) {
+	want := newTestFeed(20)
+	for _, writer := range testCodecs {
+		data, err := writer.Marshal(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, reader := range testCodecs {
+			var got *testFeed
+			if err := reader.Unmarshal(data, &got); err != nil {
+				t.Errorf("%s reading %s: %v", reader.Name(), writer.Name(), err)
+				continue
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s reading %s changed the value", reader.Name(), writer.Name())
+			}
+		}
+	}
+}
+
+func TestCodecVersionMismatch(t *testing.T) {
+	// Values written before the version byte are plain JSON.
+	var legacy map[string]int
+	if err := Gob.Unmarshal([]byte(`{"n":1}`), &legacy); err != nil || legacy["n"] != 1 {
+		t.Errorf("legacy JSON = %v, %v", legacy, err)
+	}
+
+	gobData, _ := Gob.Marshal(newTestFeed(2))
+	jsonData, _ := JSON.Marshal(newTestFeed(2))
+	enc, _, err := zstdCoders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nested := enc.EncodeAll(enc.EncodeAll(jsonData, []byte{versionZstd}), []byte{versionZstd})
+	plainZstd, _ := zstd.NewWriter(nil)
+	defer plainZstd.Close()
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		// A version from a newer build, not legacy JSON.
+		{"unknown version", append([]byte{versionZstd + 1}, jsonData[1:]...)},
+		{"gob labelled json", append([]byte{versionJSON}, gobData[1:]...)},
+		{"json labelled gob", append([]byte{versionGob}, jsonData[1:]...)},
+		{"zstd without version", plainZstd.EncodeAll(jsonData, nil)},
+		{"truncated zstd", enc.EncodeAll(jsonData, []byte{versionZstd})[:20]},
+		{"nested zstd", nested},
+		{"empty", nil},
+	}
+	for _, tt := range tests {
+		for _, c := range testCodecs {
+			var got testFeed
+			if err := c.Unmarshal(tt.data, &got); err == nil {
+				t.Errorf("%s: %s decoded without error", tt.name, c.Name())
+			}
+		}
+	}
+}
+
+func TestCodecByName(t *testing.T) {
+	for _, name := range []string{"json", "gob", "json+zstd", "gob+zstd"} {
+		c, err := CodecByName(name)
+		if err != nil || c.Name() != name {
+			t.Errorf("CodecByName(%q) = %v, %v", name, c, err)
+		}
+	}
+	for _, name := range []string{"", "msgpack", "zstd", "gob+gzip"} {
+		if _, err := CodecByName(name); err == nil {
+			t.Errorf("CodecByName(%q) succeeded", name)
+		}
+	}
+}
+
+// The feed benchmarks use 50 items, about 55 KiB of JSON, like the home
+// page feed.
+func BenchmarkCodecMarshal(b *testing.B) {
+	v := entry[*testFeed]{Value: newTestFeed(50), FreshUntil: time.Now()}
+	for _, c := range testCodecs {
+		b.Run(c.Name(), func(b *testing.B) {
+			data, _ := c.Marshal(v)
+			b.ReportMetric(float64(len(data)), "bytes")
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.Marshal(v); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCodecUnmarshal(b *testing.B) {
+	v := entry[*testFeed]{Value: newTestFeed(50), FreshUntil: time.Now()}
+	for _, c := range testCodecs {
+		b.Run(c.Name(), func(b *testing.B) {
+			data, err := c.Marshal(v)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				var got entry[*testFeed]
+				if err := c.Unmarshal(data, &got); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// lastModSuffix names the empty sidecar file whose mtime is a blob's
+	// Last-Modified; the blob's own mtime is its last access.
+	lastModSuffix = ".lastmod"
+	// diskTouchInterval limits how often Open updates a blob's mtime.
+	diskTouchInterval = time.Minute
+)
+
+// DiskCache is a size-bounded on-disk blob store with LRU eviction.
+// Blobs are addressed by the SHA-256 of their key and sharded by the first
+// two hex characters, e.g. dir/ab/abcdef.... The LRU order survives restarts
+// through the blobs' mtimes.
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List // front = most recently used
+	index map[string]*list.Element
+}
+
+type diskEntry struct {
+	name     string
+	size     int64
+	modTime  time.Time // Last-Modified
+	accessed time.Time
+}
+
+// DiskObject describes a cached blob returned by DiskCache.Open.
+type DiskObject struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// NewDiskCache creates dir if needed and indexes existing blobs.
+// maxBytes <= 0 disables eviction.
+func NewDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	d := &DiskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		index:    make(map[string]*list.Element),
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	log.Printf("DiskCache: %s, %d objects, %d bytes", dir, d.lru.Len(), d.size)
+	return d, nil
+}
+
+// load walks dir and rebuilds the LRU list, least recently accessed at the
+// back. Files that are not blobs or sidecars of this cache are left alone.
+func (d *DiskCache) load() error {
+	var entries []*diskEntry
+	lastMods := make(map[string]time.Time)
+	err := filepath.WalkDir(d.dir, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if de.IsDir() {
+			return nil
+		}
+		name := de.Name()
+		if filepath.Ext(name) == ".tmp" {
+			_ = os.Remove(path)
+			return nil
+		}
+		blob := strings.TrimSuffix(name, lastModSuffix)
+		if !isDigest(blob) || filepath.Base(filepath.Dir(path)) != blob[:2] {
+			return nil
+		}
+		fi, err := de.Info()
+		if err != nil {
+			return nil
+		}
+		if blob != name {
+			lastMods[blob] = fi.ModTime()
+			return nil
+		}
+		entries = append(entries, &diskEntry{name: name, size: fi.Size(), accessed: fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if t, ok := lastMods[e.name]; ok {
+			e.modTime = t
+			delete(lastMods, e.name)
+		} else {
+			// Written before sidecars, when mtime was Last-Modified.
+			e.modTime = e.accessed
+		}
+	}
+	for name := range lastMods {
+		_ = os.Remove(d.path(name) + lastModSuffix)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].accessed.After(entries[j].accessed) })
+	for _, e := range entries {
+		d.index[e.name] = d.lru.PushBack(e)
+		d.size += e.size
+	}
+	d.mu.Lock()
+	victims := d.evictLocked()
+	d.mu.Unlock()
+	d.unlink(victims)
+	return nil
+}
+
+// isDigest reports whether name is a lowercase hex SHA-256, as Name returns.
+func isDigest(name string) bool {
+	if len(name) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range name {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Name returns the content address for key.
+func (d *DiskCache) Name(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *DiskCache) path(name string) string {
+	return filepath.Join(d.dir, name[:2], name)
+}
+
+// Open returns the blob stored under key. ok is false on miss.
+// The caller must close the returned file.
+func (d *DiskCache) Open(key string) (f *os.File, obj DiskObject, ok bool) {
+	name := d.Name(key)
+	now := time.Now()
+	var touch bool
+	d.mu.Lock()
+	el, found := d.index[name]
+	if found {
+		d.lru.MoveToFront(el)
+		e := el.Value.(*diskEntry)
+		obj = DiskObject{Name: name, Size: e.size, ModTime: e.modTime}
+		if now.Sub(e.accessed) >= diskTouchInterval {
+			e.accessed, touch = now, true
+		}
+	}
+	d.mu.Unlock()
+	if !found {
+		return nil, DiskObject{}, false
+	}
+	f, err := os.Open(d.path(name))
+	if err != nil {
+		d.remove(name)
+		return nil, DiskObject{}, false
+	}
+	if touch {
+		_ = os.Chtimes(d.path(name), now, now)
+	}
+	return f, obj, true
+}
+
+// Put streams r into the cache under key, evicting old blobs as needed.
+// modTime is kept as the blob's Last-Modified. The write is atomic: readers
+// never see a partial blob. A body over maxBytes is rejected before it is
+// fully written.
+func (d *DiskCache) Put(key string, r io.Reader, modTime time.Time) (DiskObject, error) {
+	name := d.Name(key)
+	path := d.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return DiskObject{}, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), name+"-*.tmp")
+	if err != nil {
+		return DiskObject{}, err
+	}
+	if d.maxBytes > 0 {
+		r = io.LimitReader(r, d.maxBytes+1)
+	}
+	n, err := io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && d.maxBytes > 0 && n > d.maxBytes {
+		err = fmt.Errorf("diskcache: object exceeds limit %d", d.maxBytes)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return DiskObject{}, err
+	}
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	modTime = modTime.Truncate(time.Second)
+	// The sidecar goes first, so a blob is never seen without it.
+	if err := writeLastMod(path+lastModSuffix, modTime); err != nil {
+		os.Remove(tmp.Name())
+		return DiskObject{}, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return DiskObject{}, err
+	}
+
+	now := time.Now()
+	d.mu.Lock()
+	if el, ok := d.index[name]; ok {
+		d.size -= el.Value.(*diskEntry).size
+		d.lru.Remove(el)
+	}
+	d.index[name] = d.lru.PushFront(&diskEntry{name: name, size: n, modTime: modTime, accessed: now})
+	d.size += n
+	victims := d.evictLocked()
+	d.mu.Unlock()
+	d.unlink(victims)
+	return DiskObject{Name: name, Size: n, ModTime: modTime}, nil
+}
+
+// writeLastMod creates the empty sidecar at path with mtime t.
+func writeLastMod(path string, t time.Time) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(path, t, t)
+}
+
+// Delete removes the blob stored under key.
+func (d *DiskCache) Delete(key string) {
+	d.remove(d.Name(key))
+}
+
+func (d *DiskCache) remove(name string) {
+	d.mu.Lock()
+	if el, ok := d.index[name]; ok {
+		d.size -= el.Value.(*diskEntry).size
+		d.lru.Remove(el)
+		delete(d.index, name)
+	}
+	d.mu.Unlock()
+	_ = os.Remove(d.path(name))
+	_ = os.Remove(d.path(name) + lastModSuffix)
+}
+
+// evictLocked drops least recently used blobs from the index until size
+// fits maxBytes, and returns their names for unlink, which runs after d.mu
+// is released.
+func (d *DiskCache) evictLocked() []string {
+	if d.maxBytes <= 0 {
+		return nil
+	}
+	var victims []string
+	for d.size > d.maxBytes {
+		el := d.lru.Back()
+		if el == nil {
+			break
+		}
+		e := el.Value.(*diskEntry)
+		d.lru.Remove(el)
+		delete(d.index, e.name)
+		d.size -= e.size
+		victims = append(victims, e.name)
+	}
+	return victims
+}
+
+// unlink removes evicted blobs and their sidecars from disk.
+func (d *DiskCache) unlink(names []string) {
+	for _, name := range names {
+		if err := os.Remove(d.path(name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("DiskCache: evict %s: %v", name, err)
+		}
+		_ = os.Remove(d.path(name) + lastModSuffix)
+	}
+}
+
+// Size returns the total bytes and number of cached blobs.
+func (d *DiskCache) Size() (bytes int64, objects int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.size, d.lru.Len()
+}
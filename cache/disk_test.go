@@ -0,0 +1,166 @@
+package cache
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestDiskCache(t *testing.T, dir string, maxBytes int64) *DiskCache {
+	t.Helper()
+	d, err := NewDiskCache(dir, maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// readBlob returns the blob under key, or ok false on miss.
+func readBlob(t *testing.T, d *DiskCache, key string) (string, DiskObject, bool) {
+	t.Helper()
+	f, obj, ok := d.Open(key)
+	if !ok {
+		return "", DiskObject{}, false
+	}
+	defer f.Close()
+	body, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body), obj, true
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestDiskCachePutOpen(t *testing.T) {
+	d := newTestDiskCache(t, t.TempDir(), 0)
+	modTime := time.Date(2026, 10, 1, 8, 30, 0, 500, time.UTC)
+	put, err := d.Put("k", strings.NewReader("jpeg"), modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, obj, ok := readBlob(t, d, "k")
+	if !ok || body != "jpeg" {
+		t.Fatalf("Open = %q, %v", body, ok)
+	}
+	want := DiskObject{Name: d.Name("k"), Size: 4, ModTime: modTime.Truncate(time.Second)}
+	if obj != want || !put.ModTime.Equal(want.ModTime) {
+		t.Errorf("Open = %+v, Put = %+v, want %+v", obj, put, want)
+	}
+	if _, _, ok := d.Open("missing"); ok {
+		t.Error("Open of a missing key hit")
+	}
+
+	path := d.path(obj.Name)
+	if filepath.Base(filepath.Dir(path)) != obj.Name[:2] {
+		t.Errorf("blob at %s, want sharded by %s", path, obj.Name[:2])
+	}
+	fi, err := os.Stat(path + lastModSuffix)
+	if err != nil {
+		t.Fatalf("no sidecar: %v", err)
+	}
+	if fi.Size() != 0 || !fi.ModTime().Equal(want.ModTime) {
+		t.Errorf("sidecar size %d mtime %v, want empty at %v", fi.Size(), fi.ModTime(), want.ModTime)
+	}
+
+	d.Delete("k")
+	if exists(path) || exists(path+lastModSuffix) {
+		t.Error("Delete left files behind")
+	}
+	if n, objects := d.Size(); n != 0 || objects != 0 {
+		t.Errorf("Size = %d, %d after Delete", n, objects)
+	}
+}
+
+func TestDiskCachePutTooLarge(t *testing.T) {
+	dir := t.TempDir()
+	d := newTestDiskCache(t, dir, 8)
+	if _, err := d.Put("k", strings.NewReader("123456789"), time.Time{}); err == nil {
+		t.Fatal("Put over the limit succeeded")
+	}
+	if _, _, ok := d.Open("k"); ok {
+		t.Error("rejected blob is cached")
+	}
+	shard := filepath.Dir(d.path(d.Name("k")))
+	if left, _ := os.ReadDir(shard); len(left) != 0 {
+		t.Errorf("rejected Put left %d files", len(left))
+	}
+}
+
+func TestDiskCacheEvictsLRU(t *testing.T) {
+	d := newTestDiskCache(t, t.TempDir(), 30)
+	body := strings.Repeat("x", 10)
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := d.Put(key, strings.NewReader(body), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a is now the most recently used, b the least.
+	readBlob(t, d, "a")
+	d.Put("d", strings.NewReader(body), time.Time{})
+
+	if n, objects := d.Size(); n != 30 || objects != 3 {
+		t.Errorf("Size = %d, %d, want 30, 3", n, objects)
+	}
+	if _, _, ok := d.Open("b"); ok {
+		t.Error("b was not evicted")
+	}
+	path := d.path(d.Name("b"))
+	if exists(path) || exists(path+lastModSuffix) {
+		t.Error("eviction left b's files behind")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, _, ok := d.Open(key); !ok {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+}
+
+func TestDiskCacheReload(t *testing.T) {
+	dir := t.TempDir()
+	d := newTestDiskCache(t, dir, 0)
+	modTime := time.Date(2026, 10, 1, 8, 30, 0, 0, time.UTC)
+	body := strings.Repeat("x", 10)
+	for _, key := range []string{"old", "new"} {
+		d.Put(key, strings.NewReader(body), modTime)
+	}
+	// The blob mtimes are the access times the LRU order is rebuilt from.
+	now := time.Now()
+	os.Chtimes(d.path(d.Name("old")), now.Add(-time.Hour), now.Add(-time.Hour))
+	os.Chtimes(d.path(d.Name("new")), now, now)
+
+	// Leftovers: a partial write, a sidecar without its blob and a file
+	// that is not ours.
+	orphan := d.path(d.Name("gone")) + lastModSuffix
+	os.MkdirAll(filepath.Dir(orphan), 0o755)
+	os.WriteFile(orphan, nil, 0o644)
+	tmp := d.path(d.Name("new")) + "-123.tmp"
+	os.WriteFile(tmp, []byte("part"), 0o644)
+	foreign := filepath.Join(dir, "README")
+	os.WriteFile(foreign, []byte("keep"), 0o644)
+
+	// A restart with room for one blob keeps the most recently used.
+	d = newTestDiskCache(t, dir, 10)
+	if n, objects := d.Size(); n != 10 || objects != 1 {
+		t.Errorf("Size = %d, %d, want 10, 1", n, objects)
+	}
+	if _, _, ok := d.Open("old"); ok {
+		t.Error("old survived the restart")
+	}
+	_, obj, ok := readBlob(t, d, "new")
+	if !ok || !obj.ModTime.Equal(modTime) {
+		t.Errorf("Open(new) = %+v, %v, want ModTime %v from the sidecar", obj, ok, modTime)
+	}
+	if exists(orphan) || exists(tmp) {
+		t.Error("load left the orphan sidecar or the partial write")
+	}
+	if !exists(foreign) {
+		t.Error("load removed a file it does not own")
+	}
+}
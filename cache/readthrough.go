@@ -0,0 +1,166 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// fillLockTTL bounds a fill lock left by a crashed instance; TryLock
+	// keeps it alive while the load runs.
+	fillLockTTL = 30 * time.Second
+	// fillWait is how long a miss waits for another instance's load before
+	// loading itself.
+	fillWait = 5 * time.Second
+	// fillPoll is how often a waiting miss looks for that load's result.
+	fillPoll = 100 * time.Millisecond
+)
+
+// errFillBusy reports a refresh skipped because another instance holds the
+// fill lock.
+var errFillBusy = errors.New("cache: fill in progress elsewhere")
+
+// FetchOptions are the TTLs of one Fetch. A value is fresh for SoftTTL and
+// kept until HardTTL; in between it is served stale while it is refreshed
+// in the background. HardTTL <= SoftTTL disables serving stale.
+type FetchOptions struct {
+	SoftTTL time.Duration
+	HardTTL time.Duration
+	// Groups are TagKeys invalidation groups of the key.
+	Groups []string
+}
+
+// ReadThrough fills a Cache on misses. Concurrent misses of a key in this
+// process share one load; with a Locker (Redis) one instance loads while
+// the others wait for its result.
+type ReadThrough struct {
+	cache  Cache
+	locker Locker
+	group  singleflight.Group
+	// refreshing holds keys with a background refresh running.
+	refreshing sync.Map
+}
+
+// NewReadThrough wraps c. lock enables the cross-instance fill lock when c
+// is a Locker.
+func NewReadThrough(c Cache, lock bool) *ReadThrough {
+	rt := &ReadThrough{cache: c}
+	if l, ok := c.(Locker); ok && lock {
+		rt.locker = l
+	}
+	return rt
+}
+
+// entry is what Fetch stores: the value and when it turns stale.
+type entry[T any] struct {
+	Value      T         `json:"v"`
+	FreshUntil time.Time `json:"fresh_until"`
+}
+
+// Fetch returns the value of key, calling load on a miss. A stale value is
+// returned at once and refreshed in the background. Errors from load are
+// returned and not cached.
+func Fetch[T any](ctx context.Context, rt *ReadThrough, key string, opts FetchOptions, load func(ctx context.Context) (T, error)) (T, error) {
+	var e entry[T]
+	// Entries written before Fetch have no FreshUntil and count as misses.
+	if ok, err := rt.cache.Get(ctx, key, &e); err == nil && ok && !e.FreshUntil.IsZero() {
+		if time.Now().After(e.FreshUntil) {
+			rt.refresh(key, func(ctx context.Context) error {
+				_, err, _ := rt.group.Do(key, func() (interface{}, error) {
+					return fill(ctx, rt, key, opts, load, false)
+				})
+				return err
+			})
+		}
+		return e.Value, nil
+	}
+
+	// The load is shared by every waiting caller, so it must not be
+	// cancelled with the first one.
+	v, err, _ := rt.group.Do(key, func() (interface{}, error) {
+		return fill(context.WithoutCancel(ctx), rt, key, opts, load, true)
+	})
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return v.(T), nil
+}
+
+// refresh runs fn in the background unless a refresh of key is running.
+func (rt *ReadThrough) refresh(key string, fn func(ctx context.Context) error) {
+	if _, running := rt.refreshing.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+	go func() {
+		defer rt.refreshing.Delete(key)
+		if err := fn(context.Background()); err != nil && !errors.Is(err, errFillBusy) {
+			log.Printf("Cache: refresh %s: %v", key, err)
+		}
+	}()
+}
+
+// fill loads key and stores it. If another instance holds the fill lock, a
+// miss (wait) waits for its result and a refresh gives up.
+func fill[T any](ctx context.Context, rt *ReadThrough, key string, opts FetchOptions, load func(ctx context.Context) (T, error), wait bool) (T, error) {
+	var zero T
+	if rt.locker != nil {
+		release, ok, err := rt.locker.TryLock(ctx, "fill:"+key, fillLockTTL)
+		switch {
+		case err != nil:
+			// Without a working lock, loading here beats not serving.
+			log.Printf("Cache: fill lock %s: %v", key, err)
+		case ok:
+			defer release()
+		case !wait:
+			return zero, errFillBusy
+		default:
+			if v, ok := waitFill[T](ctx, rt, key); ok {
+				return v, nil
+			}
+		}
+	}
+
+	v, err := load(ctx)
+	if err != nil {
+		return zero, err
+	}
+	hard := max(opts.HardTTL, opts.SoftTTL)
+	if err := rt.cache.Set(ctx, key, entry[T]{Value: v, FreshUntil: time.Now().Add(opts.SoftTTL)}, hard); err != nil {
+		log.Printf("Cache: set %s: %v", key, err)
+		return v, nil
+	}
+	for _, group := range opts.Groups {
+		if err := rt.cache.TagKeys(ctx, group, hard, key); err != nil {
+			log.Printf("Cache: tag %s %s: %v", group, key, err)
+		}
+	}
+	return v, nil
+}
+
+// waitFill polls for the value another instance is loading, up to fillWait.
+func waitFill[T any](ctx context.Context, rt *ReadThrough, key string) (T, bool) {
+	t := time.NewTicker(fillPoll)
+	defer t.Stop()
+	deadline := time.After(fillWait)
+	for {
+		select {
+		case <-ctx.Done():
+			var zero T
+			return zero, false
+		case <-deadline:
+			var zero T
+			return zero, false
+		case <-t.C:
+			var e entry[T]
+			if ok, err := rt.cache.Get(ctx, key, &e); err == nil && ok && !e.FreshUntil.IsZero() {
+				return e.Value, true
+			}
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingLoad returns a load that counts its calls and returns val.
+func countingLoad(calls *atomic.Int32, val string) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		calls.Add(1)
+		return val, nil
+	}
+}
+
+// waitFor polls cond until it holds or five seconds pass.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFetchConcurrentMissesLoadOnce(t *testing.T) {
+	rt := NewReadThrough(newTestMemoryCache(t, 0, 0), false)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	load := func(ctx context.Context) (string, error) {
+		calls.Add(1)
+		<-release
+		return "v", nil
+	}
+
+	const n = 20
+	var started, done sync.WaitGroup
+	started.Add(n)
+	done.Add(n)
+	for range n {
+		go func() {
+			defer done.Done()
+			started.Done()
+			v, err := Fetch(context.Background(), rt, "k", FetchOptions{SoftTTL: time.Hour}, load)
+			if err != nil || v != "v" {
+				t.Errorf("Fetch = %q, %v", v, err)
+			}
+		}()
+	}
+	started.Wait()
+	waitFor(t, "the first load", func() bool { return calls.Load() > 0 })
+	close(release)
+	done.Wait()
+	if got := calls.Load(); got != 1 {
+		t.Errorf("load called %d times, want 1", got)
+	}
+}
+
+func TestFetchServesStaleAndRefreshesOnce(t *testing.T) {
+	c := newTestMemoryCache(t, 0, 0)
+	rt := NewReadThrough(c, false)
+	ctx := context.Background()
+	opts := FetchOptions{SoftTTL: time.Millisecond, HardTTL: time.Hour}
+	var calls atomic.Int32
+	if _, err := Fetch(ctx, rt, "k", opts, countingLoad(&calls, "old")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	release := make(chan struct{})
+	var refreshes atomic.Int32
+	refresh := func(ctx context.Context) (string, error) {
+		refreshes.Add(1)
+		<-release
+		return "new", nil
+	}
+	for range 10 {
+		v, err := Fetch(ctx, rt, "k", opts, refresh)
+		if err != nil || v != "old" {
+			t.Fatalf("Fetch of a stale entry = %q, %v, want old at once", v, err)
+		}
+	}
+	close(release)
+	waitFor(t, "the refresh", func() bool {
+		var e entry[string]
+		ok, _ := c.Get(ctx, "k", &e)
+		return ok && e.Value == "new"
+	})
+	if got := refreshes.Load(); got != 1 {
+		t.Errorf("refreshed %d times, want 1", got)
+	}
+}
+
+func TestFetchErrorNotCached(t *testing.T) {
+	rt := NewReadThrough(newTestMemoryCache(t, 0, 0), false)
+	ctx := context.Background()
+	opts := FetchOptions{SoftTTL: time.Hour}
+	errLoad := errors.New("upstream down")
+	_, err := Fetch(ctx, rt, "k", opts, func(ctx context.Context) (string, error) {
+		return "ignored", errLoad
+	})
+	if !errors.Is(err, errLoad) {
+		t.Fatalf("err = %v, want %v", err, errLoad)
+	}
+
+	var calls atomic.Int32
+	v, err := Fetch(ctx, rt, "k", opts, countingLoad(&calls, "v"))
+	if err != nil || v != "v" || calls.Load() != 1 {
+		t.Errorf("Fetch after an error = %q, %v with %d loads, want a fresh load", v, err, calls.Load())
+	}
+}
+
+func TestFetchReloadsPastHardTTL(t *testing.T) {
+	rt := NewReadThrough(newTestMemoryCache(t, 0, 0), false)
+	ctx := context.Background()
+	opts := FetchOptions{SoftTTL: 5 * time.Millisecond, HardTTL: 10 * time.Millisecond}
+	var calls atomic.Int32
+	Fetch(ctx, rt, "k", opts, countingLoad(&calls, "old"))
+	time.Sleep(20 * time.Millisecond)
+
+	v, err := Fetch(ctx, rt, "k", opts, countingLoad(&calls, "new"))
+	if err != nil || v != "new" {
+		t.Errorf("Fetch past HardTTL = %q, %v, want new", v, err)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("load called %d times, want 2", got)
+	}
+}
+
+// lockedCache is a MemoryCache whose fill locks are held by another
+// instance.
+type lockedCache struct {
+	*MemoryCache
+	tries atomic.Int32
+}
+
+func (c *lockedCache) TryLock(ctx context.Context, name string, ttl time.Duration) (func(), bool, error) {
+	c.tries.Add(1)
+	return nil, false, nil
+}
+
+func TestFetchWaitsForOtherInstance(t *testing.T) {
+	c := &lockedCache{MemoryCache: newTestMemoryCache(t, 0, 0)}
+	rt := NewReadThrough(c, true)
+	ctx := context.Background()
+	opts := FetchOptions{SoftTTL: time.Hour}
+
+	// The other instance stores its result while this one waits.
+	go func() {
+		time.Sleep(fillPoll / 2)
+		c.Set(ctx, "k", entry[string]{Value: "theirs", FreshUntil: time.Now().Add(time.Hour)}, time.Hour)
+	}()
+	var calls atomic.Int32
+	v, err := Fetch(ctx, rt, "k", opts, countingLoad(&calls, "ours"))
+	if err != nil || v != "theirs" {
+		t.Errorf("Fetch = %q, %v, want the other instance's value", v, err)
+	}
+	if calls.Load() != 0 || c.tries.Load() != 1 {
+		t.Errorf("load called %d times with %d lock tries, want 0 and 1", calls.Load(), c.tries.Load())
+	}
+}
+
+func TestFillRefreshBusy(t *testing.T) {
+	c := &lockedCache{MemoryCache: newTestMemoryCache(t, 0, 0)}
+	rt := NewReadThrough(c, true)
+	var calls atomic.Int32
+	_, err := fill(context.Background(), rt, "k", FetchOptions{SoftTTL: time.Hour}, countingLoad(&calls, "v"), false)
+	if !errors.Is(err, errFillBusy) {
+		t.Errorf("err = %v, want errFillBusy", err)
+	}
+	if calls.Load() != 0 {
+		t.Error("refresh loaded while another instance held the lock")
+	}
+}
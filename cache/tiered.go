@@ -0,0 +1,224 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// invalidateChannel carries TieredCache invalidations between instances.
+const invalidateChannel = keyPrefix + "invalidate"
+
+// TieredCache keeps a small MemoryCache (L1) in front of a RedisCache (L2).
+// Writes and deletes go to Redis and are published on invalidateChannel so
+// the other instances drop their L1 copies. L1 entries live at most l1TTL,
+// which bounds staleness when a message is lost.
+type TieredCache struct {
+	l1    *MemoryCache
+	l2    *RedisCache
+	l1TTL time.Duration
+	// origin tells this instance's messages apart from the others'.
+	origin string
+	pubsub *redis.PubSub
+	done   chan struct{}
+
+	// mu and gen keep a Get from refilling L1 with a value read from Redis
+	// before an invalidation: every L1 write or drop bumps gen, and Get
+	// only fills L1 when gen has not moved since its Redis read.
+	mu  sync.Mutex
+	gen uint64
+}
+
+// invalidation is a message on invalidateChannel. Keys and prefixes have no
+// keyPrefix.
+type invalidation struct {
+	Origin   string   `json:"origin"`
+	Keys     []string `json:"keys,omitempty"`
+	Prefixes []string `json:"prefixes,omitempty"`
+}
+
+// NewTieredCache puts an L1 of at most l1MaxBytes (<= 0 is unlimited) whose
+// entries live at most l1TTL in front of l2, and subscribes to
+// invalidations.
+func NewTieredCache(l2 *RedisCache, l1MaxBytes int64, l1TTL time.Duration) (*TieredCache, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	t := &TieredCache{
+		l1:     NewMemoryCache(l1MaxBytes, 0, l2.codec),
+		l2:     l2,
+		l1TTL:  l1TTL,
+		origin: hex.EncodeToString(buf),
+		done:   make(chan struct{}),
+	}
+	t.pubsub = l2.client.Subscribe(context.Background(), invalidateChannel)
+	// Wait for the subscription, so writes right after New are not missed.
+	if _, err := t.pubsub.Receive(context.Background()); err != nil {
+		t.pubsub.Close()
+		t.l1.Close()
+		return nil, err
+	}
+	go t.listen()
+	return t, nil
+}
+
+// Close stops listening for invalidations and the L1 janitor.
+func (t *TieredCache) Close() {
+	close(t.done)
+	t.pubsub.Close()
+	t.l1.Close()
+}
+
+// listen applies invalidations from the other instances. go-redis
+// resubscribes after a dropped connection; messages sent meanwhile are
+// lost, so L1 is cleared then.
+func (t *TieredCache) listen() {
+	ctx := context.Background()
+	for {
+		msg, err := t.pubsub.Receive(ctx)
+		if err != nil {
+			select {
+			case <-t.done:
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			if msg.Kind == "subscribe" {
+				var n int
+				t.invalidateL1(func() { n, _ = t.l1.DeleteByPrefix(ctx, "") })
+				log.Printf("Cache: L1 resubscribed, cleared %d entries", n)
+			}
+		case *redis.Message:
+			var inv invalidation
+			if err := json.Unmarshal([]byte(msg.Payload), &inv); err != nil {
+				log.Printf("Cache: invalidation message: %v", err)
+				continue
+			}
+			if inv.Origin == t.origin {
+				continue
+			}
+			t.invalidateL1(func() {
+				_ = t.l1.Delete(ctx, inv.Keys...)
+				for _, prefix := range inv.Prefixes {
+					_, _ = t.l1.DeleteByPrefix(ctx, prefix)
+				}
+			})
+		}
+	}
+}
+
+// invalidateL1 runs change on L1 and makes Gets already reading Redis skip
+// their L1 fill.
+func (t *TieredCache) invalidateL1(change func()) {
+	t.mu.Lock()
+	t.gen++
+	change()
+	t.mu.Unlock()
+}
+
+// publish tells the other instances to drop keys and prefixes from L1.
+func (t *TieredCache) publish(ctx context.Context, keys, prefixes []string) {
+	if len(keys) == 0 && len(prefixes) == 0 {
+		return
+	}
+	msg, err := json.Marshal(invalidation{Origin: t.origin, Keys: keys, Prefixes: prefixes})
+	if err != nil {
+		return
+	}
+	if err := t.l2.client.Publish(ctx, invalidateChannel, msg).Err(); err != nil {
+		log.Printf("Cache: publish invalidation: %v", err)
+	}
+}
+
+func (t *TieredCache) Get(ctx context.Context, key string, dest interface{}) (bool, error) {
+	if data, ok := t.l1.getRaw(key); ok {
+		if err := t.l2.codec.Unmarshal(data, dest); err == nil {
+			return true, nil
+		}
+	}
+	t.mu.Lock()
+	gen := t.gen
+	t.mu.Unlock()
+	data, ttl, ok, err := t.l2.getRaw(ctx, key)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := t.l2.codec.Unmarshal(data, dest); err != nil {
+		return false, err
+	}
+	if ttl <= 0 || ttl > t.l1TTL {
+		ttl = t.l1TTL
+	}
+	t.mu.Lock()
+	if t.gen == gen {
+		_ = t.l1.setRaw(key, data, ttl)
+	}
+	t.mu.Unlock()
+	return true, nil
+}
+
+func (t *TieredCache) Set(ctx context.Context, key string, val interface{}, ttl time.Duration) error {
+	data, err := t.l2.codec.Marshal(val)
+	if err != nil {
+		return err
+	}
+	if err := t.l2.client.Set(ctx, keyPrefix+key, data, ttl).Err(); err != nil {
+		return err
+	}
+	l1TTL := t.l1TTL
+	if ttl > 0 {
+		l1TTL = min(ttl, l1TTL)
+	}
+	t.invalidateL1(func() { _ = t.l1.setRaw(key, data, l1TTL) })
+	t.publish(ctx, []string{key}, nil)
+	return nil
+}
+
+func (t *TieredCache) Delete(ctx context.Context, keys ...string) error {
+	// Redis first, so a Get starting after the L1 drop reads no old value.
+	err := t.l2.Delete(ctx, keys...)
+	t.invalidateL1(func() { _ = t.l1.Delete(ctx, keys...) })
+	if err != nil {
+		return err
+	}
+	t.publish(ctx, keys, nil)
+	return nil
+}
+
+func (t *TieredCache) DeleteByPrefix(ctx context.Context, prefix string) (int, error) {
+	n, err := t.l2.DeleteByPrefix(ctx, prefix)
+	t.invalidateL1(func() { _, _ = t.l1.DeleteByPrefix(ctx, prefix) })
+	t.publish(ctx, nil, []string{prefix})
+	return n, err
+}
+
+func (t *TieredCache) TagKeys(ctx context.Context, tag string, ttl time.Duration, keys ...string) error {
+	return t.l2.TagKeys(ctx, tag, ttl, keys...)
+}
+
+func (t *TieredCache) InvalidateTags(ctx context.Context, tags ...string) (int, error) {
+	n, keys, err := t.l2.invalidateTags(ctx, tags...)
+	t.invalidateL1(func() { _ = t.l1.Delete(ctx, keys...) })
+	t.publish(ctx, keys, nil)
+	return n, err
+}
+
+// TryLock uses the Redis lock.
+func (t *TieredCache) TryLock(ctx context.Context, name string, ttl time.Duration) (release func(), ok bool, err error) {
+	return t.l2.TryLock(ctx, name, ttl)
+}
+
+// Stats returns the L1 counters.
+func (t *TieredCache) Stats() Stats {
+	return t.l1.Stats()
+}
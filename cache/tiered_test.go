@@ -0,0 +1,153 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newTestTieredCaches starts a miniredis and two TieredCaches sharing it, as
+// two instances of the site would.
+func newTestTieredCaches(t *testing.T) (*miniredis.Miniredis, *TieredCache, *TieredCache) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	newTiered := func() *TieredCache {
+		rc, err := NewRedisCache("redis://"+mr.Addr(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc, err := NewTieredCache(rc, 0, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			tc.Close()
+			rc.client.Close()
+		})
+		return tc
+	}
+	return mr, newTiered(), newTiered()
+}
+
+// fillL1 reads key through c until c keeps a copy in L1. A Get skips the
+// fill while invalidations for earlier writes are still arriving.
+func fillL1(t *testing.T, c *TieredCache, key, want string) {
+	t.Helper()
+	waitFor(t, key+" in L1", func() bool {
+		var got string
+		if ok, err := c.Get(context.Background(), key, &got); err != nil || !ok || got != want {
+			t.Fatalf("Get(%s) = %q, %v, %v, want %q", key, got, ok, err, want)
+		}
+		return c.l1.has(key)
+	})
+}
+
+func TestTieredCacheSetEvictsOtherL1(t *testing.T) {
+	ctx := context.Background()
+	_, a, b := newTestTieredCaches(t)
+	a.Set(ctx, "k", "v1", time.Hour)
+	fillL1(t, b, "k", "v1")
+
+	a.Set(ctx, "k", "v2", time.Hour)
+	waitFor(t, "b to drop k", func() bool { return !b.l1.has("k") })
+	fillL1(t, b, "k", "v2")
+}
+
+func TestTieredCacheDeleteEvictsOtherL1(t *testing.T) {
+	ctx := context.Background()
+	_, a, b := newTestTieredCaches(t)
+	a.Set(ctx, "k", "v", time.Hour)
+	fillL1(t, b, "k", "v")
+
+	a.Delete(ctx, "k")
+	waitFor(t, "b to drop k", func() bool { return !b.l1.has("k") })
+	var got string
+	if ok, _ := b.Get(ctx, "k", &got); ok {
+		t.Errorf("Get after Delete = %q", got)
+	}
+}
+
+func TestTieredCacheDeleteByPrefixEvictsOtherL1(t *testing.T) {
+	ctx := context.Background()
+	_, a, b := newTestTieredCaches(t)
+	for _, key := range []string{"photo:1", "photo:2", "tag:x"} {
+		a.Set(ctx, key, key, time.Hour)
+		fillL1(t, b, key, key)
+	}
+
+	a.DeleteByPrefix(ctx, "photo:")
+	waitFor(t, "b to drop photo:*", func() bool { return !b.l1.has("photo:1") && !b.l1.has("photo:2") })
+	if !b.l1.has("tag:x") {
+		t.Error("DeleteByPrefix dropped tag:x")
+	}
+}
+
+func TestTieredCacheInvalidateTagsEvictsOtherL1(t *testing.T) {
+	ctx := context.Background()
+	_, a, b := newTestTieredCaches(t)
+	for _, key := range []string{"photo:1", "related:1", "photo:2"} {
+		a.Set(ctx, key, key, time.Hour)
+		fillL1(t, b, key, key)
+	}
+	a.TagKeys(ctx, "photo:1", time.Hour, "photo:1", "related:1")
+
+	if n, err := a.InvalidateTags(ctx, "photo:1"); err != nil || n != 2 {
+		t.Fatalf("InvalidateTags = %d, %v, want 2", n, err)
+	}
+	waitFor(t, "b to drop the group", func() bool { return !b.l1.has("photo:1") && !b.l1.has("related:1") })
+	if !b.l1.has("photo:2") {
+		t.Error("InvalidateTags dropped photo:2")
+	}
+}
+
+func TestTieredCacheIgnoresOwnMessages(t *testing.T) {
+	ctx := context.Background()
+	_, a, b := newTestTieredCaches(t)
+	a.Set(ctx, "mine", "v", time.Hour)
+	// Messages arrive in order: once b's Delete reaches a, so has a's own
+	// Set message.
+	a.Set(ctx, "theirs", "v", time.Hour)
+	b.Delete(ctx, "theirs")
+	waitFor(t, "a to drop theirs", func() bool { return !a.l1.has("theirs") })
+	if !a.l1.has("mine") {
+		t.Error("a dropped its own write on its own message")
+	}
+}
+
+func TestTieredCacheClearsL1OnResubscribe(t *testing.T) {
+	ctx := context.Background()
+	mr, a, _ := newTestTieredCaches(t)
+	a.Set(ctx, "k", "v", time.Hour)
+
+	// Messages sent while the connection is down are lost, so L1 must not
+	// be trusted after reconnecting.
+	mr.Close()
+	if err := mr.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a to clear L1", func() bool { return !a.l1.has("k") })
+}
+
+// TestTieredCacheGetSkipsFillAfterInvalidation covers an invalidation that
+// lands while Get is reading Redis.
+func TestTieredCacheGetSkipsFillAfterInvalidation(t *testing.T) {
+	ctx := context.Background()
+	_, a, _ := newTestTieredCaches(t)
+	a.Set(ctx, "k", "old", time.Hour)
+	a.invalidateL1(func() { _ = a.l1.Delete(ctx, "k") })
+
+	// The Redis read of a Get that started before the invalidation.
+	a.mu.Lock()
+	gen := a.gen
+	a.mu.Unlock()
+	data, _, _, _ := a.l2.getRaw(ctx, "k")
+	a.Delete(ctx, "k")
+	a.mu.Lock()
+	filled := a.gen == gen
+	a.mu.Unlock()
+	if filled || data == nil {
+		t.Error("a Get overlapping a Delete would refill L1 with the old value")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// minCompressSize is the smallest body worth compressing.
+const minCompressSize = 1024
+
+// maxCompressedEntries bounds compressedBodies; feeds and sitemaps change at
+// most once per cache TTL, so a few entries per URL is plenty.
+const maxCompressedEntries = 64
+
+// compressedBodies keeps compressed bodies by ETag so polling readers do not
+// cost a brotli pass per request.
+var compressedBodies = struct {
+	sync.Mutex
+	m map[string][]byte
+}{m: make(map[string][]byte)}
+
+// writeConditional writes body as contentType with an ETag of its content
+// and Last-Modified of modified (omitted when zero). If-None-Match and
+// If-Modified-Since are answered with 304, and the body is sent with gzip or
+// brotli when the client accepts it.
+func writeConditional(w http.ResponseWriter, r *http.Request, contentType string, modified time.Time, body []byte, maxAge int) {
+	etag := fmt.Sprintf("%x", sha1.Sum(body))
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+	h.Add("Vary", "Accept-Encoding")
+
+	if encoding := acceptedEncoding(r); encoding != "" && len(body) >= minCompressSize {
+		// Each encoding is its own representation and needs its own strong ETag.
+		if compressed, err := compressBody(etag+"-"+encoding, encoding, body); err == nil {
+			etag += "-" + encoding
+			h.Set("Content-Encoding", encoding)
+			body = compressed
+		}
+	}
+	h.Set("ETag", `"`+etag+`"`)
+	http.ServeContent(w, r, "", modified, bytes.NewReader(body))
+}
+
+// acceptedEncoding picks br or gzip from Accept-Encoding by q-value,
+// preferring br on a tie. It returns "" for identity.
+func acceptedEncoding(r *http.Request) string {
+	var best string
+	var bestQ float64
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "br" && name != "gzip" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if q > bestQ || (q == bestQ && q > 0 && name == "br") {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+func compressBody(key, encoding string, body []byte) ([]byte, error) {
+	compressedBodies.Lock()
+	cached, ok := compressedBodies.m[key]
+	compressedBodies.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	var buf bytes.Buffer
+	var err error
+	switch encoding {
+	case "br":
+		bw := brotli.NewWriterLevel(&buf, brotli.DefaultCompression)
+		if _, err = bw.Write(body); err == nil {
+			err = bw.Close()
+		}
+	default:
+		gw := gzip.NewWriter(&buf)
+		if _, err = gw.Write(body); err == nil {
+			err = gw.Close()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	compressedBodies.Lock()
+	if len(compressedBodies.m) >= maxCompressedEntries {
+		clear(compressedBodies.m)
+	}
+	compressedBodies.m[key] = buf.Bytes()
+	compressedBodies.Unlock()
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toomore/toomorephotos/cache"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigFile is read when CONFIG_FILE is not set. It is optional; the
+// defaults below are used for anything it leaves out. The one in the repo is
+// photos.toomore.net's.
+const defaultConfigFile = "./config.yaml"
+
+// Config is the per-site configuration, so the same code can run another
+// gallery. See config.yaml.
+type Config struct {
+	Site    SiteConfig    `yaml:"site"`
+	Cache   CacheConfig   `yaml:"cache"`
+	Related RelatedConfig `yaml:"related"`
+	Feed    FeedConfig    `yaml:"feed"`
+}
+
+// SiteConfig is exposed to templates as Site, e.g. {{Site.Title}}.
+type SiteConfig struct {
+	// URL is the public origin without a trailing slash, used for canonical
+	// links, feeds and the sitemap.
+	URL         string `yaml:"url"`
+	Title       string `yaml:"title"`
+	Description string `yaml:"description"`
+	// Image is the og:image of the home page.
+	Image  string       `yaml:"image"`
+	Author AuthorConfig `yaml:"author"`
+	// FlickrPath is the path alias in https://www.flickr.com/photos/{path}/;
+	// defaults to FLICKRUSER.
+	FlickrPath string `yaml:"flickr_path"`
+	// Twitter is the account for twitter:site, without @.
+	Twitter   string          `yaml:"twitter"`
+	Social    []SocialLink    `yaml:"social"`
+	Analytics AnalyticsConfig `yaml:"analytics"`
+}
+
+type AuthorConfig struct {
+	Name string `yaml:"name"`
+	// Nickname is used in "Photo by ..." credits; defaults to Name.
+	Nickname string `yaml:"nickname"`
+	Email    string `yaml:"email"`
+	// URL is the author's home page, also the link of licenses without one;
+	// defaults to the site.
+	URL string `yaml:"url"`
+}
+
+type SocialLink struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+}
+
+// AnalyticsConfig holds site verification and analytics IDs; empty ones are
+// left out of the page.
+type AnalyticsConfig struct {
+	GoogleSiteVerification string `yaml:"google_site_verification"`
+	PocketSiteVerification string `yaml:"pocket_site_verification"`
+	CloudflareToken        string `yaml:"cloudflare_token"`
+	GoogleAnalyticsID      string `yaml:"google_analytics_id"`
+}
+
+// CacheConfig holds cache TTLs as Go durations, e.g. 10m or 720h.
+type CacheConfig struct {
+	Index      time.Duration `yaml:"index"`
+	Photo      time.Duration `yaml:"photo"`
+	PhotoSizes time.Duration `yaml:"photo_sizes"`
+	Related    time.Duration `yaml:"related"`
+	Sitemap    time.Duration `yaml:"sitemap"`
+	Feed       time.Duration `yaml:"feed"`
+	Map        time.Duration `yaml:"map"`
+	// Stale is how long after its TTL a value is still served while it is
+	// refreshed in the background; 0 refetches on the request.
+	Stale time.Duration `yaml:"stale"`
+	// FillLock lets one instance sharing Redis fill a missing key while the
+	// others wait for it.
+	FillLock bool `yaml:"fill_lock"`
+	// MemoryMaxBytes and MemoryMaxEntries bound the in-memory cache used
+	// without REDIS_URL; 0 is unlimited.
+	MemoryMaxBytes   int `yaml:"memory_max_bytes"`
+	MemoryMaxEntries int `yaml:"memory_max_entries"`
+	// L1 keeps an in-memory copy of Redis values on each instance, at most
+	// L1MaxBytes and for at most L1TTL; Redis pub/sub drops stale copies.
+	L1         bool          `yaml:"l1"`
+	L1MaxBytes int           `yaml:"l1_max_bytes"`
+	L1TTL      time.Duration `yaml:"l1_ttl"`
+	// Codec is how values are encoded: json, gob, json+zstd or gob+zstd.
+	// Values written with another codec stay readable.
+	Codec string `yaml:"codec"`
+}
+
+// RelatedConfig limits the related and nearby photos on a photo page.
+type RelatedConfig struct {
+	Max      int `yaml:"max"`
+	SameTag  int `yaml:"same_tag"`
+	OtherTag int `yaml:"other_tag"`
+	Nearby   int `yaml:"nearby"`
+}
+
+type FeedConfig struct {
+	// Size is the number of photos in each RSS/Atom/JSON feed.
+	Size int `yaml:"size"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Site: SiteConfig{
+			URL:   "http://localhost:8080",
+			Title: "Photos",
+		},
+		Cache: CacheConfig{
+			Index:      10 * time.Minute,
+			Photo:      30 * 24 * time.Hour,  // 30 天
+			PhotoSizes: 365 * 24 * time.Hour, // 365 天
+			Related:    1 * time.Hour,
+			Sitemap:    30 * time.Minute,
+			Feed:       30 * time.Minute,
+			Map:        30 * 24 * time.Hour, // 30 天
+			Stale:      24 * time.Hour,
+			FillLock:   true,
+			// 256 MiB
+			MemoryMaxBytes: 256 << 20,
+			// 32 MiB
+			L1MaxBytes: 32 << 20,
+			L1TTL:      time.Minute,
+			Codec:      "json",
+		},
+		Related: RelatedConfig{Max: 12, SameTag: 8, OtherTag: 4, Nearby: 8},
+		Feed:    FeedConfig{Size: 100},
+	}
+}
+
+// loadConfig reads CONFIG_FILE (default ./config.yaml) over the defaults,
+// then applies environment overrides. A missing default file is not an
+// error.
+func loadConfig() (*Config, error) {
+	cfg := defaultConfig()
+	path := os.Getenv("CONFIG_FILE")
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigFile
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("設定檔 %s 格式錯誤: %w", path, err)
+		}
+		log.Printf("Config: 讀取 %s", path)
+	case errors.Is(err, fs.ErrNotExist) && !explicit:
+		log.Printf("Config: %s 不存在，使用預設值", path)
+	default:
+		return nil, fmt.Errorf("無法讀取設定檔 %s: %w", path, err)
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// applyEnv overrides single values from the environment, e.g. SITE_URL or
+// CACHE_TTL_FEED=1h.
+func (c *Config) applyEnv() error {
+	strs := map[string]*string{
+		"SITE_URL":             &c.Site.URL,
+		"SITE_TITLE":           &c.Site.Title,
+		"SITE_DESCRIPTION":     &c.Site.Description,
+		"SITE_IMAGE":           &c.Site.Image,
+		"SITE_AUTHOR_NAME":     &c.Site.Author.Name,
+		"SITE_AUTHOR_NICKNAME": &c.Site.Author.Nickname,
+		"SITE_AUTHOR_EMAIL":    &c.Site.Author.Email,
+		"SITE_AUTHOR_URL":      &c.Site.Author.URL,
+		"SITE_FLICKR_PATH":     &c.Site.FlickrPath,
+		"SITE_TWITTER":         &c.Site.Twitter,
+		"CACHE_CODEC":          &c.Cache.Codec,
+	}
+	for name, p := range strs {
+		if v := os.Getenv(name); v != "" {
+			*p = v
+		}
+	}
+
+	ints := map[string]*int{
+		"FEED_SIZE":         &c.Feed.Size,
+		"RELATED_MAX":       &c.Related.Max,
+		"RELATED_SAME_TAG":  &c.Related.SameTag,
+		"RELATED_OTHER_TAG": &c.Related.OtherTag,
+		"RELATED_NEARBY":    &c.Related.Nearby,
+
+		"CACHE_MEMORY_MAX_BYTES":   &c.Cache.MemoryMaxBytes,
+		"CACHE_MEMORY_MAX_ENTRIES": &c.Cache.MemoryMaxEntries,
+		"CACHE_L1_MAX_BYTES":       &c.Cache.L1MaxBytes,
+	}
+	for name, p := range ints {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s 格式錯誤: %w", name, err)
+			}
+			*p = n
+		}
+	}
+
+	ttls := map[string]*time.Duration{
+		"CACHE_TTL_INDEX":       &c.Cache.Index,
+		"CACHE_TTL_PHOTO":       &c.Cache.Photo,
+		"CACHE_TTL_PHOTO_SIZES": &c.Cache.PhotoSizes,
+		"CACHE_TTL_RELATED":     &c.Cache.Related,
+		"CACHE_TTL_SITEMAP":     &c.Cache.Sitemap,
+		"CACHE_TTL_FEED":        &c.Cache.Feed,
+		"CACHE_TTL_MAP":         &c.Cache.Map,
+		"CACHE_STALE":           &c.Cache.Stale,
+		"CACHE_L1_TTL":          &c.Cache.L1TTL,
+	}
+	for name, p := range ttls {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("%s 格式錯誤: %w", name, err)
+			}
+			*p = d
+		}
+	}
+
+	bools := map[string]*bool{
+		"CACHE_FILL_LOCK": &c.Cache.FillLock,
+		"CACHE_L1":        &c.Cache.L1,
+	}
+	for name, p := range bools {
+		if v := os.Getenv(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("%s 格式錯誤: %w", name, err)
+			}
+			*p = b
+		}
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	c.Site.URL = strings.TrimRight(c.Site.URL, "/")
+	u, err := url.Parse(c.Site.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("site.url 必須是 http(s) 網址: %q", c.Site.URL)
+	}
+	if c.Site.Title == "" {
+		return errors.New("site.title 不可為空")
+	}
+	if c.Site.Author.Nickname == "" {
+		c.Site.Author.Nickname = c.Site.Author.Name
+	}
+	if c.Site.Author.URL == "" {
+		c.Site.Author.URL = c.Site.URL + "/"
+	}
+
+	for name, d := range map[string]time.Duration{
+		"cache.index":       c.Cache.Index,
+		"cache.photo":       c.Cache.Photo,
+		"cache.photo_sizes": c.Cache.PhotoSizes,
+		"cache.related":     c.Cache.Related,
+		"cache.sitemap":     c.Cache.Sitemap,
+		"cache.feed":        c.Cache.Feed,
+		"cache.map":         c.Cache.Map,
+	} {
+		if d <= 0 {
+			return fmt.Errorf("%s 必須大於 0: %s", name, d)
+		}
+	}
+	if c.Cache.Stale < 0 {
+		return fmt.Errorf("cache.stale 不可為負數: %s", c.Cache.Stale)
+	}
+	if c.Cache.MemoryMaxBytes < 0 || c.Cache.MemoryMaxEntries < 0 {
+		return errors.New("cache.memory_max_bytes 與 cache.memory_max_entries 不可為負數")
+	}
+	if _, err := cache.CodecByName(c.Cache.Codec); err != nil {
+		return fmt.Errorf("cache.codec 必須是 json、gob、json+zstd 或 gob+zstd: %q", c.Cache.Codec)
+	}
+	if c.Cache.L1 && (c.Cache.L1MaxBytes <= 0 || c.Cache.L1TTL <= 0) {
+		return errors.New("啟用 cache.l1 時 cache.l1_max_bytes 與 cache.l1_ttl 必須大於 0")
+	}
+
+	if c.Feed.Size < 1 {
+		return fmt.Errorf("feed.size 必須大於 0: %d", c.Feed.Size)
+	}
+	if c.Related.Max < 0 || c.Related.SameTag < 0 || c.Related.OtherTag < 0 || c.Related.Nearby < 0 {
+		return errors.New("related 的數量不可為負數")
+	}
+	return nil
+}
+
+// FlickrURL is the author's Flickr page of photo id.
+func (s *SiteConfig) FlickrURL(id string) string {
+	return fmt.Sprintf("https://www.flickr.com/photos/%s/%s", s.FlickrPath, id)
+}
@@ -0,0 +1,174 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/toomore/lazyflickrgo/jsonstruct"
+)
+
+// Album is a Flickr photoset. Farm, Server and Secret belong to the cover
+// photo PrimaryPhotoID.
+type Album struct {
+	ID             string     `json:"id"`
+	Title          string     `json:"title"`
+	Description    string     `json:"description"`
+	PrimaryPhotoID string     `json:"primary_photo_id"`
+	Farm           int64      `json:"farm"`
+	Server         string     `json:"server"`
+	Secret         string     `json:"secret"`
+	Position       int        `json:"position"`
+	CountPhotos    int        `json:"count_photos"`
+	CreatedAt      *time.Time `json:"created_at"`
+	UpdatedAt      *time.Time `json:"updated_at"`
+}
+
+const albumColumns = `album_id, title, description, primary_photo_id, farm, server, secret,
+	position, count_photos, created_at, updated_at`
+
+func scanAlbum(row pgx.Row) (Album, error) {
+	var a Album
+	err := row.Scan(&a.ID, &a.Title, &a.Description, &a.PrimaryPhotoID, &a.Farm, &a.Server, &a.Secret,
+		&a.Position, &a.CountPhotos, &a.CreatedAt, &a.UpdatedAt)
+	return a, err
+}
+
+// ReplaceAlbums stores albums as the complete album list: positions follow
+// the slice order and albums missing from it are deleted.
+func (d *DB) ReplaceAlbums(ctx context.Context, albums []Album) error {
+	if d == nil || d.pool == nil {
+		return nil
+	}
+	return pgx.BeginFunc(ctx, d.pool, func(tx pgx.Tx) error {
+		ids := make([]string, len(albums))
+		for i, a := range albums {
+			ids[i] = a.ID
+			if _, err := tx.Exec(ctx,
+				`INSERT INTO albums (`+albumColumns+`)
+				 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+				 ON CONFLICT (album_id) DO UPDATE SET
+				   title = EXCLUDED.title,
+				   description = EXCLUDED.description,
+				   primary_photo_id = EXCLUDED.primary_photo_id,
+				   farm = EXCLUDED.farm,
+				   server = EXCLUDED.server,
+				   secret = EXCLUDED.secret,
+				   position = EXCLUDED.position,
+				   count_photos = EXCLUDED.count_photos,
+				   created_at = EXCLUDED.created_at,
+				   updated_at = EXCLUDED.updated_at`,
+				a.ID, a.Title, a.Description, a.PrimaryPhotoID, a.Farm, a.Server, a.Secret,
+				i, a.CountPhotos, a.CreatedAt, a.UpdatedAt,
+			); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(ctx, `DELETE FROM albums WHERE NOT (album_id = ANY($1))`, ids)
+		return err
+	})
+}
+
+// GetStaleAlbumIDs returns albums whose photos changed on Flickr since
+// SetAlbumPhotos last stored them.
+func (d *DB) GetStaleAlbumIDs(ctx context.Context) ([]string, error) {
+	if d == nil || d.pool == nil {
+		return nil, nil
+	}
+	rows, err := d.pool.Query(ctx,
+		`SELECT album_id FROM albums
+		 WHERE photos_updated_at IS NULL OR photos_updated_at IS DISTINCT FROM updated_at
+		 ORDER BY position`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// SetAlbumPhotos replaces the photos of an album, in order, and marks the
+// album up to date.
+func (d *DB) SetAlbumPhotos(ctx context.Context, albumID string, photoIDs []string) error {
+	if d == nil || d.pool == nil {
+		return nil
+	}
+	return pgx.BeginFunc(ctx, d.pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `DELETE FROM album_photos WHERE album_id = $1`, albumID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx,
+			`INSERT INTO album_photos (album_id, photo_id, position)
+			 SELECT $1, id, pos FROM unnest($2::text[]) WITH ORDINALITY AS t(id, pos)
+			 ON CONFLICT DO NOTHING`,
+			albumID, photoIDs,
+		); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `UPDATE albums SET photos_updated_at = updated_at WHERE album_id = $1`, albumID)
+		return err
+	})
+}
+
+// GetAlbums returns all albums with at least one visible photo, in Flickr order.
+func (d *DB) GetAlbums(ctx context.Context) ([]Album, error) {
+	if d == nil || d.pool == nil {
+		return nil, nil
+	}
+	rows, err := d.pool.Query(ctx,
+		`SELECT `+albumColumns+` FROM albums a
+		 WHERE EXISTS (SELECT 1 FROM album_photos ap INNER JOIN photos p ON p.photo_id = ap.photo_id
+		   WHERE ap.album_id = a.album_id AND `+visible+`)
+		 ORDER BY position`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Album
+	for rows.Next() {
+		a, err := scanAlbum(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, a)
+	}
+	return result, rows.Err()
+}
+
+// GetAlbum returns one album. ok is false if it does not exist.
+func (d *DB) GetAlbum(ctx context.Context, albumID string) (Album, bool, error) {
+	if d == nil || d.pool == nil {
+		return Album{}, false, nil
+	}
+	a, err := scanAlbum(d.pool.QueryRow(ctx,
+		`SELECT `+albumColumns+` FROM albums WHERE album_id = $1`, albumID))
+	if err == pgx.ErrNoRows {
+		return Album{}, false, nil
+	}
+	if err != nil {
+		return Album{}, false, err
+	}
+	return a, true, nil
+}
+
+// GetAlbumPhotos returns the visible photos of an album, in album order or,
+// with newestFirst, by date-posted-desc as feeds want.
+func (d *DB) GetAlbumPhotos(ctx context.Context, albumID string, newestFirst bool) ([]jsonstruct.Photo, error) {
+	if d == nil || d.pool == nil {
+		return nil, nil
+	}
+	order := `ORDER BY ap.position`
+	if newestFirst {
+		order = orderByPosted
+	}
+	rows, err := d.pool.Query(ctx,
+		`SELECT `+listColumns+` FROM photos p
+		 INNER JOIN album_photos ap ON ap.photo_id = p.photo_id
+		 WHERE ap.album_id = $1 AND `+visible+` `+order,
+		albumID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanPhotos(rows)
+}
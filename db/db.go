@@ -2,16 +2,12 @@ package db
 
 import (
 	"context"
-	"embed"
 	"fmt"
 	"log"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-//go:embed schema.sql
-var schemaFS embed.FS
-
 // DB wraps PostgreSQL connection pool.
 type DB struct {
 	pool *pgxpool.Pool
@@ -46,21 +42,33 @@ func (d *DB) Close() {
 	}
 }
 
-// InitSchema runs schema.sql to create tables if they don't exist.
-func (d *DB) InitSchema(ctx context.Context) error {
+// TryAdvisoryLock takes the session-level advisory lock key without waiting.
+// The lock is held on a dedicated connection until release is called, and
+// PostgreSQL drops it if the process dies. ok is false if another session
+// holds it.
+func (d *DB) TryAdvisoryLock(ctx context.Context, key int64) (release func(), ok bool, err error) {
 	if d == nil || d.pool == nil {
-		return nil
+		return nil, false, fmt.Errorf("advisory lock: no database")
 	}
-	sql, err := schemaFS.ReadFile("schema.sql")
+	conn, err := d.pool.Acquire(ctx)
 	if err != nil {
-		return fmt.Errorf("read schema: %w", err)
+		return nil, false, err
 	}
-	_, err = d.pool.Exec(ctx, string(sql))
-	if err != nil {
-		return fmt.Errorf("init schema: %w", err)
+	if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&ok); err != nil {
+		conn.Release()
+		return nil, false, err
+	}
+	if !ok {
+		conn.Release()
+		return nil, false, nil
+	}
+	release = func() {
+		if _, err := conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, key); err != nil {
+			log.Printf("DB: advisory unlock %d: %v", key, err)
+		}
+		conn.Release()
 	}
-	log.Println("DB: schema initialized")
-	return nil
+	return release, true, nil
 }
 
 // Pool returns the underlying pool for direct queries (used by photos.go).
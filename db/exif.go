@@ -0,0 +1,173 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/toomore/lazyflickrgo/jsonstruct"
+)
+
+// PhotoExif is the camera metadata of a photo. Zero values mean unknown.
+type PhotoExif struct {
+	Make        string     `json:"make"`
+	Model       string     `json:"model"`
+	Lens        string     `json:"lens"`
+	FocalLength float64    `json:"focal_length"`
+	Aperture    float64    `json:"aperture"`
+	Shutter     string     `json:"shutter"`
+	ISO         int        `json:"iso"`
+	CapturedAt  *time.Time `json:"captured_at"`
+}
+
+// Empty reports whether e carries no metadata at all.
+func (e PhotoExif) Empty() bool {
+	return e.Model == "" && e.Lens == "" && e.FocalLength == 0 && e.Aperture == 0 &&
+		e.Shutter == "" && e.ISO == 0 && e.CapturedAt == nil
+}
+
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func nullNumber[T int | float64](v T) *T {
+	if v == 0 {
+		return nil
+	}
+	return &v
+}
+
+// UpsertPhotoExif stores e for photoID, creating its camera and lens rows.
+// The photo must already exist.
+func (d *DB) UpsertPhotoExif(ctx context.Context, photoID string, e PhotoExif) error {
+	if d == nil || d.pool == nil {
+		return nil
+	}
+	return pgx.BeginFunc(ctx, d.pool, func(tx pgx.Tx) error {
+		var cameraID, lensID *int
+		if e.Model != "" {
+			cameraID = new(int)
+			// DO UPDATE (a no-op) instead of DO NOTHING so RETURNING yields the id.
+			if err := tx.QueryRow(ctx,
+				`INSERT INTO cameras (make, model) VALUES ($1, $2)
+				 ON CONFLICT (make, model) DO UPDATE SET model = EXCLUDED.model
+				 RETURNING id`,
+				e.Make, e.Model,
+			).Scan(cameraID); err != nil {
+				return err
+			}
+		}
+		if e.Lens != "" {
+			lensID = new(int)
+			if err := tx.QueryRow(ctx,
+				`INSERT INTO lenses (name) VALUES ($1)
+				 ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name
+				 RETURNING id`,
+				e.Lens,
+			).Scan(lensID); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(ctx,
+			`INSERT INTO photo_exif (photo_id, camera_id, lens_id, focal_length, aperture, shutter, iso, captured_at, fetched_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW())
+			 ON CONFLICT (photo_id) DO UPDATE SET
+			   camera_id = EXCLUDED.camera_id,
+			   lens_id = EXCLUDED.lens_id,
+			   focal_length = EXCLUDED.focal_length,
+			   aperture = EXCLUDED.aperture,
+			   shutter = EXCLUDED.shutter,
+			   iso = EXCLUDED.iso,
+			   captured_at = EXCLUDED.captured_at,
+			   fetched_at = NOW()`,
+			photoID, cameraID, lensID, nullNumber(e.FocalLength), nullNumber(e.Aperture),
+			nullString(e.Shutter), nullNumber(e.ISO), e.CapturedAt,
+		)
+		return err
+	})
+}
+
+// GetPhotoExif returns the stored EXIF for photoID. ok is false if sync has
+// not stored any.
+func (d *DB) GetPhotoExif(ctx context.Context, photoID string) (e PhotoExif, ok bool, err error) {
+	if d == nil || d.pool == nil {
+		return PhotoExif{}, false, nil
+	}
+	var focal, aperture *float64
+	var shutter *string
+	var iso *int
+	err = d.pool.QueryRow(ctx,
+		`SELECT COALESCE(c.make, ''), COALESCE(c.model, ''), COALESCE(l.name, ''),
+		   e.focal_length::float8, e.aperture::float8, e.shutter, e.iso, e.captured_at
+		 FROM photo_exif e
+		 LEFT JOIN cameras c ON c.id = e.camera_id
+		 LEFT JOIN lenses l ON l.id = e.lens_id
+		 WHERE e.photo_id = $1`,
+		photoID,
+	).Scan(&e.Make, &e.Model, &e.Lens, &focal, &aperture, &shutter, &iso, &e.CapturedAt)
+	if err == pgx.ErrNoRows {
+		return PhotoExif{}, false, nil
+	}
+	if err != nil {
+		return PhotoExif{}, false, err
+	}
+	if focal != nil {
+		e.FocalLength = *focal
+	}
+	if aperture != nil {
+		e.Aperture = *aperture
+	}
+	if shutter != nil {
+		e.Shutter = *shutter
+	}
+	if iso != nil {
+		e.ISO = *iso
+	}
+	return e, true, nil
+}
+
+// GetPhotosByCameraPage returns one page of visible photos taken with a
+// camera model (any make), ordered by date-posted-desc, and the total count.
+func (d *DB) GetPhotosByCameraPage(ctx context.Context, model string, limit, offset int) ([]jsonstruct.Photo, int, error) {
+	return d.photosByExifPage(ctx,
+		`INNER JOIN cameras c ON c.id = e.camera_id WHERE c.model = $1`,
+		model, limit, offset)
+}
+
+// GetPhotosByLensPage returns one page of visible photos taken with a lens,
+// ordered by date-posted-desc, and the total count.
+func (d *DB) GetPhotosByLensPage(ctx context.Context, name string, limit, offset int) ([]jsonstruct.Photo, int, error) {
+	return d.photosByExifPage(ctx,
+		`INNER JOIN lenses l ON l.id = e.lens_id WHERE l.name = $1`,
+		name, limit, offset)
+}
+
+func (d *DB) photosByExifPage(ctx context.Context, where, arg string, limit, offset int) ([]jsonstruct.Photo, int, error) {
+	if d == nil || d.pool == nil {
+		return nil, 0, nil
+	}
+	rows, err := d.pool.Query(ctx,
+		`SELECT `+listColumns+`, COUNT(*) OVER () FROM photos p
+		 INNER JOIN photo_exif e ON e.photo_id = p.photo_id
+		 `+where+` AND `+visible+` `+orderByPosted+`
+		 LIMIT $2 OFFSET $3`,
+		arg, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var result []jsonstruct.Photo
+	var total int
+	for rows.Next() {
+		p, err := scanPhoto(rows, &total)
+		if err != nil {
+			return nil, 0, err
+		}
+		result = append(result, p)
+	}
+	return result, total, rows.Err()
+}
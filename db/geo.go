@@ -0,0 +1,126 @@
+package db
+
+import (
+	"context"
+	"math"
+
+	"github.com/toomore/lazyflickrgo/jsonstruct"
+)
+
+const (
+	earthRadiusKm = 6371.0
+	kmPerDegree   = 111.045
+)
+
+// BBox is a bounding box in degrees. Wrap means the box crosses the
+// antimeridian: it spans MinLon to 180 and -180 to MaxLon.
+type BBox struct {
+	MinLon, MinLat, MaxLon, MaxLat float64
+	Wrap                           bool
+}
+
+// GeoCluster is a grid cell of geotagged photos. Photo is the most recently
+// posted photo in the cell.
+type GeoCluster struct {
+	Latitude  float64
+	Longitude float64
+	Count     int
+	Photo     jsonstruct.Photo
+}
+
+// NearbyPhoto is a photo with its great-circle distance from a point.
+type NearbyPhoto struct {
+	Photo      jsonstruct.Photo
+	DistanceKm float64
+}
+
+// lonFilter restricts p.longitude to box, handling the antimeridian.
+func (b BBox) lonFilter() string {
+	if b.Wrap {
+		return `(p.longitude >= $3 OR p.longitude <= $4)`
+	}
+	return `p.longitude BETWEEN $3 AND $4`
+}
+
+// GetGeoClusters groups visible geotagged photos inside box into square
+// cells of cellDeg degrees, largest cells first, at most limit cells.
+func (d *DB) GetGeoClusters(ctx context.Context, box BBox, cellDeg float64, limit int) ([]GeoCluster, error) {
+	if d == nil || d.pool == nil {
+		return nil, nil
+	}
+	rows, err := d.pool.Query(ctx,
+		`SELECT `+listColumns+`, c.lat, c.lon, c.n FROM (
+		   SELECT p.photo_id,
+		     AVG(p.latitude) OVER w AS lat, AVG(p.longitude) OVER w AS lon, COUNT(*) OVER w AS n,
+		     ROW_NUMBER() OVER (w ORDER BY p.posted_at DESC NULLS LAST) AS rn
+		   FROM photos p
+		   WHERE `+visible+` AND p.latitude BETWEEN $1 AND $2 AND `+box.lonFilter()+`
+		   WINDOW w AS (PARTITION BY floor(p.latitude / $5), floor(p.longitude / $5))
+		 ) c INNER JOIN photos p ON p.photo_id = c.photo_id
+		 WHERE c.rn = 1
+		 ORDER BY c.n DESC LIMIT $6`,
+		box.MinLat, box.MaxLat, box.MinLon, box.MaxLon, cellDeg, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []GeoCluster
+	for rows.Next() {
+		var c GeoCluster
+		var err error
+		if c.Photo, err = scanPhoto(rows, &c.Latitude, &c.Longitude, &c.Count); err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+	return result, rows.Err()
+}
+
+// GetNearbyPhotos returns up to limit visible photos within radiusKm of
+// (lat, lon) by haversine distance, nearest first, excluding excludePhotoID.
+// A bounding box prefilter lets idx_photos_location narrow the scan.
+func (d *DB) GetNearbyPhotos(ctx context.Context, excludePhotoID string, lat, lon, radiusKm float64, limit int) ([]NearbyPhoto, error) {
+	if d == nil || d.pool == nil {
+		return nil, nil
+	}
+	dLat := radiusKm / kmPerDegree
+	lonCond := `TRUE`
+	args := []any{lat, lon, excludePhotoID, radiusKm, limit, lat - dLat, lat + dLat, earthRadiusKm}
+	// Near the poles or the antimeridian the longitude window wraps; skip it.
+	if cos := math.Cos(lat * math.Pi / 180); cos > 0.01 {
+		dLon := radiusKm / (kmPerDegree * cos)
+		if lon-dLon >= -180 && lon+dLon <= 180 {
+			lonCond = `p.longitude BETWEEN $9 AND $10`
+			args = append(args, lon-dLon, lon+dLon)
+		}
+	}
+	rows, err := d.pool.Query(ctx,
+		`SELECT `+listColumns+`, s.distance FROM (
+		   SELECT p.photo_id, $8::float8 * 2 * asin(least(1, sqrt(
+		     power(sin(radians(p.latitude - $1) / 2), 2) +
+		     cos(radians($1)) * cos(radians(p.latitude)) * power(sin(radians(p.longitude - $2) / 2), 2)
+		   ))) AS distance
+		   FROM photos p
+		   WHERE `+visible+` AND p.photo_id <> $3
+		     AND p.latitude BETWEEN $6 AND $7 AND `+lonCond+`
+		 ) s INNER JOIN photos p ON p.photo_id = s.photo_id
+		 WHERE s.distance <= $4
+		 ORDER BY s.distance LIMIT $5`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []NearbyPhoto
+	for rows.Next() {
+		var n NearbyPhoto
+		var err error
+		if n.Photo, err = scanPhoto(rows, &n.DistanceKm); err != nil {
+			return nil, err
+		}
+		result = append(result, n)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,242 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Migrations live in migrations/ as {version}_{name}.up.sql and
+// {version}_{name}.down.sql. Versions are applied in numeric order and must
+// never be renumbered or edited once released; add a new file instead.
+//
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+var migrationFileExpr = regexp.MustCompile(`^([0-9]+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// migrateLockKey is the advisory lock held while migrating, so instances
+// booting at the same time apply each migration exactly once.
+const migrateLockKey int64 = 0x6d696772617465 // "migrate"
+
+// Migration is one embedded schema change.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus reports whether a migration has been applied.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// Migrations returns the embedded migrations sorted by version.
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationsFS, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		m := migrationFileExpr.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("migration %s: bad file name", e.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		sql, err := migrationsFS.ReadFile(path.Join("migrations", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d: conflicting names %q and %q", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(sql)
+		} else {
+			mig.Down = string(sql)
+		}
+	}
+	list := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" {
+			return nil, fmt.Errorf("migration %d: missing up file", mig.Version)
+		}
+		list = append(list, *mig)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list, nil
+}
+
+// withMigrateLock runs fn on a dedicated connection holding migrateLockKey,
+// waiting for other instances to finish first.
+func (d *DB) withMigrateLock(ctx context.Context, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := d.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrateLockKey); err != nil {
+		return fmt.Errorf("migrate lock: %w", err)
+	}
+	defer func() {
+		if _, err := conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, migrateLockKey); err != nil {
+			log.Printf("DB: migrate unlock: %v", err)
+		}
+	}()
+	if _, err := conn.Exec(ctx,
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+		     version    INT PRIMARY KEY,
+		     name       VARCHAR(100) NOT NULL,
+		     applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		 )`,
+	); err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+	return fn(conn)
+}
+
+func appliedMigrations(ctx context.Context, conn *pgxpool.Conn) (map[int]time.Time, error) {
+	rows, err := conn.Query(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// runMigration executes sql and records the change in one transaction.
+func runMigration(ctx context.Context, conn *pgxpool.Conn, sql, record string, args ...any) error {
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, sql); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, record, args...)
+		return err
+	})
+}
+
+// MigrateUp applies all pending migrations and returns how many ran.
+func (d *DB) MigrateUp(ctx context.Context) (int, error) {
+	if d == nil || d.pool == nil {
+		return 0, nil
+	}
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	err = d.withMigrateLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			if err := runMigration(ctx, conn, m.Up,
+				`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`,
+				m.Version, m.Name,
+			); err != nil {
+				return fmt.Errorf("migration %04d_%s up: %w", m.Version, m.Name, err)
+			}
+			log.Printf("DB: migration %04d_%s applied", m.Version, m.Name)
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// MigrateDown rolls back the latest applied migration.
+// ok is false if nothing was applied.
+func (d *DB) MigrateDown(ctx context.Context) (m Migration, ok bool, err error) {
+	if d == nil || d.pool == nil {
+		return Migration{}, false, nil
+	}
+	migrations, err := Migrations()
+	if err != nil {
+		return Migration{}, false, err
+	}
+	err = d.withMigrateLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= 0; i-- {
+			if _, done := applied[migrations[i].Version]; done {
+				m, ok = migrations[i], true
+				break
+			}
+		}
+		if !ok {
+			return nil
+		}
+		if m.Down == "" {
+			return fmt.Errorf("migration %04d_%s has no down file", m.Version, m.Name)
+		}
+		if err := runMigration(ctx, conn, m.Down,
+			`DELETE FROM schema_migrations WHERE version = $1`,
+			m.Version,
+		); err != nil {
+			return fmt.Errorf("migration %04d_%s down: %w", m.Version, m.Name, err)
+		}
+		log.Printf("DB: migration %04d_%s rolled back", m.Version, m.Name)
+		return nil
+	})
+	return m, ok, err
+}
+
+// MigrationStatus lists every embedded migration with its applied time.
+func (d *DB) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	if d == nil || d.pool == nil {
+		return nil, nil
+	}
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	var status []MigrationStatus
+	err = d.withMigrateLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			s := MigrationStatus{Version: m.Version, Name: m.Name}
+			if at, ok := applied[m.Version]; ok {
+				s.AppliedAt = &at
+			}
+			status = append(status, s)
+		}
+		return nil
+	})
+	return status, err
+}
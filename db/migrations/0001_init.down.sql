@@ -0,0 +1,6 @@
+-- 0001: drops everything created by 0001_init.up.sql.
+DROP TABLE IF EXISTS sync_items;
+DROP TABLE IF EXISTS sync_runs;
+DROP TABLE IF EXISTS sync_state;
+DROP TABLE IF EXISTS photo_tags;
+DROP TABLE IF EXISTS photos;
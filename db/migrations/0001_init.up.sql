@@ -0,0 +1,68 @@
+-- 0001: initial schema, formerly db/schema.sql. Statements use IF NOT EXISTS
+-- so databases created by the old InitSchema adopt this migration as-is.
+
+-- photos: store PhotosGetInfo metadata
+CREATE TABLE IF NOT EXISTS photos (
+    photo_id   VARCHAR(20) PRIMARY KEY,
+    info_json  JSONB NOT NULL,
+    width      BIGINT DEFAULT 0,
+    height     BIGINT DEFAULT 0,
+    fetched_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- photo_tags: for tag-based queries (index, related)
+CREATE TABLE IF NOT EXISTS photo_tags (
+    photo_id VARCHAR(20) NOT NULL REFERENCES photos(photo_id) ON DELETE CASCADE,
+    tag      VARCHAR(100) NOT NULL,
+    PRIMARY KEY (photo_id, tag)
+);
+
+CREATE INDEX IF NOT EXISTS idx_photo_tags_tag_photo ON photo_tags(tag, photo_id);
+CREATE INDEX IF NOT EXISTS idx_photo_tags_photo ON photo_tags(photo_id);
+
+-- sync_state: last successful sync time per sync kind
+CREATE TABLE IF NOT EXISTS sync_state (
+    name           VARCHAR(50) PRIMARY KEY,
+    last_synced_at TIMESTAMPTZ NOT NULL
+);
+
+-- Removal state set by sync when a photo disappears from Flickr
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS hidden BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- sync_runs / sync_items: checkpoints so an interrupted sync can resume
+CREATE TABLE IF NOT EXISTS sync_runs (
+    id          BIGSERIAL PRIMARY KEY,
+    kind        VARCHAR(20) NOT NULL,
+    status      VARCHAR(20) NOT NULL DEFAULT 'running',
+    started_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    finished_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS sync_items (
+    run_id     BIGINT NOT NULL REFERENCES sync_runs(id) ON DELETE CASCADE,
+    photo_id   VARCHAR(20) NOT NULL,
+    action     VARCHAR(10) NOT NULL DEFAULT 'upsert',
+    status     VARCHAR(10) NOT NULL DEFAULT 'pending',
+    attempts   INT NOT NULL DEFAULT 0,
+    error      TEXT,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (run_id, photo_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_sync_items_run_status ON sync_items(run_id, status);
+
+-- Sort key for date-posted-desc listings and pagination
+CREATE INDEX IF NOT EXISTS idx_photos_posted ON photos (((info_json->'photo'->'dates'->>'posted')::bigint) DESC NULLS LAST);
+
+-- Full-text search over title (A), tags (B) and description (C).
+-- Generated columns cannot read photo_tags, so tags come from info_json,
+-- which UpsertPhoto keeps identical to photo_tags.
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS search_vector tsvector
+    GENERATED ALWAYS AS (
+        setweight(to_tsvector('simple', coalesce(info_json->'photo'->'title'->>'_content', '')), 'A') ||
+        setweight(to_tsvector('simple', coalesce(jsonb_path_query_array(info_json, '$.photo.tags.tag[*].raw')::text, '')), 'B') ||
+        setweight(to_tsvector('simple', coalesce(info_json->'photo'->'description'->>'_content', '')), 'C')
+    ) STORED;
+
+CREATE INDEX IF NOT EXISTS idx_photos_search ON photos USING GIN (search_vector);
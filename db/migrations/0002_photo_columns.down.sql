@@ -0,0 +1,23 @@
+-- 0002: info_json still holds every value, so dropping the columns loses nothing.
+DROP INDEX IF EXISTS idx_photos_posted_at;
+DROP INDEX IF EXISTS idx_photos_taken_at;
+DROP INDEX IF EXISTS idx_photos_lastupdate;
+DROP INDEX IF EXISTS idx_photos_license;
+DROP INDEX IF EXISTS idx_photos_location;
+
+ALTER TABLE photos
+    DROP COLUMN title,
+    DROP COLUMN description,
+    DROP COLUMN posted_at,
+    DROP COLUMN taken_at,
+    DROP COLUMN lastupdate,
+    DROP COLUMN license,
+    DROP COLUMN farm,
+    DROP COLUMN server,
+    DROP COLUMN secret,
+    DROP COLUMN latitude,
+    DROP COLUMN longitude,
+    DROP COLUMN views,
+    DROP COLUMN ispublic;
+
+CREATE INDEX IF NOT EXISTS idx_photos_posted ON photos (((info_json->'photo'->'dates'->>'posted')::bigint) DESC NULLS LAST);
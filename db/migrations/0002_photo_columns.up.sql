@@ -0,0 +1,53 @@
+-- 0002: first-class columns for the fields list pages, feeds and sitemap read,
+-- so they no longer unmarshal info_json per row. UpsertPhoto fills them;
+-- existing rows are backfilled from info_json below.
+ALTER TABLE photos
+    ADD COLUMN title       TEXT NOT NULL DEFAULT '',
+    ADD COLUMN description TEXT NOT NULL DEFAULT '',
+    ADD COLUMN posted_at   TIMESTAMPTZ,
+    ADD COLUMN taken_at    TIMESTAMP, -- camera local time, Flickr has no zone
+    ADD COLUMN lastupdate  TIMESTAMPTZ,
+    ADD COLUMN license     VARCHAR(10) NOT NULL DEFAULT '',
+    ADD COLUMN farm        INT NOT NULL DEFAULT 0,
+    ADD COLUMN server      VARCHAR(20) NOT NULL DEFAULT '',
+    ADD COLUMN secret      VARCHAR(20) NOT NULL DEFAULT '',
+    ADD COLUMN latitude    DOUBLE PRECISION,
+    ADD COLUMN longitude   DOUBLE PRECISION,
+    ADD COLUMN views       BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN ispublic    BOOLEAN NOT NULL DEFAULT TRUE;
+
+UPDATE photos SET
+    title       = COALESCE(info_json->'photo'->'title'->>'_content', ''),
+    description = COALESCE(info_json->'photo'->'description'->>'_content', ''),
+    posted_at   = CASE WHEN info_json->'photo'->'dates'->>'posted' ~ '^[0-9]+$'
+                       THEN to_timestamp((info_json->'photo'->'dates'->>'posted')::bigint) END,
+    taken_at    = CASE WHEN info_json->'photo'->'dates'->>'taken' ~ '^[1-9][0-9]{3}-(0[1-9]|1[0-2])-(0[1-9]|[12][0-9]|3[01]) [0-2][0-9]:[0-5][0-9]:[0-5][0-9]$'
+                       THEN (info_json->'photo'->'dates'->>'taken')::timestamp END,
+    lastupdate  = CASE WHEN info_json->'photo'->'dates'->>'lastupdate' ~ '^[0-9]+$'
+                       THEN to_timestamp((info_json->'photo'->'dates'->>'lastupdate')::bigint) END,
+    license     = COALESCE(info_json->'photo'->>'license', ''),
+    farm        = COALESCE((info_json->'photo'->>'farm')::int, 0),
+    server      = COALESCE(info_json->'photo'->>'server', ''),
+    secret      = COALESCE(info_json->'photo'->>'secret', ''),
+    views       = CASE WHEN info_json->'photo'->>'views' ~ '^[0-9]+$'
+                       THEN (info_json->'photo'->>'views')::bigint ELSE 0 END;
+
+-- Photos without a location have "0" or no latitude/longitude at all.
+UPDATE photos SET
+    latitude  = (info_json->'photo'->'location'->>'latitude')::double precision,
+    longitude = (info_json->'photo'->'location'->>'longitude')::double precision
+WHERE info_json->'photo'->'location'->>'latitude' ~ '^-?[0-9]+(\.[0-9]+)?$'
+  AND info_json->'photo'->'location'->>'longitude' ~ '^-?[0-9]+(\.[0-9]+)?$'
+  AND ((info_json->'photo'->'location'->>'latitude')::double precision <> 0
+    OR (info_json->'photo'->'location'->>'longitude')::double precision <> 0);
+
+DROP INDEX IF EXISTS idx_photos_posted;
+
+-- Listing order for index, sitemap, feed and tag pages (visible rows only).
+CREATE INDEX idx_photos_posted_at ON photos (posted_at DESC NULLS LAST)
+    WHERE deleted_at IS NULL AND NOT hidden AND ispublic;
+CREATE INDEX idx_photos_taken_at ON photos (taken_at);
+CREATE INDEX idx_photos_lastupdate ON photos (lastupdate);
+CREATE INDEX idx_photos_license ON photos (license);
+CREATE INDEX idx_photos_location ON photos (latitude, longitude)
+    WHERE latitude IS NOT NULL AND longitude IS NOT NULL;
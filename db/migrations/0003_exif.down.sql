@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS photo_exif;
+DROP TABLE IF EXISTS lenses;
+DROP TABLE IF EXISTS cameras;
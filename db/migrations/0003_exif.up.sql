@@ -0,0 +1,30 @@
+-- 0003: EXIF from flickr.photos.getExif, with cameras and lenses normalized
+-- so /camera/{model} and /lens/{name} are indexed lookups.
+CREATE TABLE cameras (
+    id    SERIAL PRIMARY KEY,
+    make  VARCHAR(100) NOT NULL DEFAULT '',
+    model VARCHAR(100) NOT NULL,
+    UNIQUE (make, model)
+);
+
+CREATE INDEX idx_cameras_model ON cameras (model);
+
+CREATE TABLE lenses (
+    id   SERIAL PRIMARY KEY,
+    name VARCHAR(200) NOT NULL UNIQUE
+);
+
+CREATE TABLE photo_exif (
+    photo_id     VARCHAR(20) PRIMARY KEY REFERENCES photos(photo_id) ON DELETE CASCADE,
+    camera_id    INT REFERENCES cameras(id),
+    lens_id      INT REFERENCES lenses(id),
+    focal_length REAL,             -- mm
+    aperture     REAL,             -- f-number
+    shutter      VARCHAR(20),      -- as written by the camera, e.g. 1/250
+    iso          INT,
+    captured_at  TIMESTAMP,        -- DateTimeOriginal, camera local time
+    fetched_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_photo_exif_camera ON photo_exif (camera_id);
+CREATE INDEX idx_photo_exif_lens ON photo_exif (lens_id);
@@ -0,0 +1,32 @@
+-- 0004: Flickr photosets (albums). position is the album order on Flickr;
+-- album_photos.position is the photo order inside the album.
+CREATE TABLE albums (
+    album_id          VARCHAR(30) PRIMARY KEY,
+    title             TEXT NOT NULL DEFAULT '',
+    description       TEXT NOT NULL DEFAULT '',
+    primary_photo_id  VARCHAR(20) NOT NULL DEFAULT '',
+    farm              INT NOT NULL DEFAULT 0,
+    server            VARCHAR(20) NOT NULL DEFAULT '',
+    secret            VARCHAR(20) NOT NULL DEFAULT '',
+    position          INT NOT NULL DEFAULT 0,
+    count_photos      INT NOT NULL DEFAULT 0,
+    created_at        TIMESTAMPTZ,
+    updated_at        TIMESTAMPTZ,
+    -- updated_at of the album when album_photos was last replaced; sync
+    -- refetches photos when it differs from updated_at.
+    photos_updated_at TIMESTAMPTZ
+);
+
+CREATE INDEX idx_albums_position ON albums (position);
+
+-- photo_id has no foreign key: an album may list photos sync has not
+-- stored yet; pages join photos and skip them.
+CREATE TABLE album_photos (
+    album_id VARCHAR(30) NOT NULL REFERENCES albums(album_id) ON DELETE CASCADE,
+    photo_id VARCHAR(20) NOT NULL,
+    position INT NOT NULL,
+    PRIMARY KEY (album_id, photo_id)
+);
+
+CREATE INDEX idx_album_photos_position ON album_photos (album_id, position);
+CREATE INDEX idx_album_photos_photo ON album_photos (photo_id);
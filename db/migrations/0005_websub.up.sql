@@ -0,0 +1,12 @@
+-- 0005: WebSub subscriptions of the built-in hub. A row exists only after
+-- the subscriber confirmed intent; expired rows are skipped and purged.
+CREATE TABLE websub_subscriptions (
+    topic      TEXT NOT NULL,
+    callback   TEXT NOT NULL,
+    secret     TEXT NOT NULL DEFAULT '',
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (topic, callback)
+);
+
+CREATE INDEX idx_websub_subscriptions_expires ON websub_subscriptions (expires_at);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS idx_photo_tags_lower_tag;
@@ -0,0 +1,2 @@
+-- 0006: case-insensitive tag lookup for /t/{tag} and tag feeds (ResolveTag).
+CREATE INDEX idx_photo_tags_lower_tag ON photo_tags (lower(tag));
@@ -4,12 +4,86 @@ import (
 	"context"
 	"encoding/json"
 	"math/rand"
+	"strconv"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/toomore/lazyflickrgo/jsonstruct"
 )
 
-const orderByPosted = `ORDER BY (info_json->'photo'->'dates'->>'posted')::bigint DESC NULLS LAST`
+const orderByPosted = `ORDER BY posted_at DESC NULLS LAST`
+
+// visible filters out rows removed by sync (soft-deleted or hidden).
+// It matches the predicate of idx_photos_posted_at.
+const visible = `deleted_at IS NULL AND NOT hidden AND ispublic`
+
+// listColumns are the columns scanPhoto reads; list queries alias photos as p.
+const listColumns = `p.photo_id, p.title, p.secret, p.server, p.farm, p.ispublic`
+
+// photoFields are the normalized columns UpsertPhoto derives from info_json.
+type photoFields struct {
+	Title       string
+	Description string
+	PostedAt    *time.Time
+	TakenAt     *time.Time
+	LastUpdate  *time.Time
+	License     string
+	Farm        int64
+	Server      string
+	Secret      string
+	Latitude    *float64
+	Longitude   *float64
+	Views       int64
+}
+
+func unixTime(s string) *time.Time {
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil
+	}
+	t := time.Unix(sec, 0)
+	return &t
+}
+
+func newPhotoFields(info jsonstruct.PhotosGetInfo) photoFields {
+	p := info.Photo
+	f := photoFields{
+		Title:       p.Title.Content,
+		Description: p.Description.Content,
+		PostedAt:    unixTime(p.Dates.Posted),
+		LastUpdate:  unixTime(p.Dates.Lastupdate),
+		License:     p.License,
+		Farm:        p.Farm,
+		Server:      p.Server,
+		Secret:      p.Secret,
+	}
+	// taken is the camera's local time without zone; keep it as written.
+	if t, err := time.Parse("2006-01-02 15:04:05", p.Dates.Taken); err == nil && t.Year() > 1 {
+		f.TakenAt = &t
+	}
+	f.Views, _ = strconv.ParseInt(p.Views, 10, 64)
+	lat, errLat := strconv.ParseFloat(p.Location.Latitude, 64)
+	lon, errLon := strconv.ParseFloat(p.Location.Longitude, 64)
+	if errLat == nil && errLon == nil && (lat != 0 || lon != 0) {
+		f.Latitude, f.Longitude = &lat, &lon
+	}
+	return f
+}
+
+// scanPhoto reads listColumns into a jsonstruct.Photo for list display, and
+// any columns selected after them into extra.
+func scanPhoto(row pgx.Row, extra ...any) (jsonstruct.Photo, error) {
+	var p jsonstruct.Photo
+	var public bool
+	dest := append([]any{&p.ID, &p.Title, &p.Secret, &p.Server, &p.Farm, &public}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return jsonstruct.Photo{}, err
+	}
+	if public {
+		p.Ispublic = 1
+	}
+	return p, nil
+}
 
 // GetPhoto returns PhotosGetInfo, width, height for a photo. ok is false if not found.
 func (d *DB) GetPhoto(ctx context.Context, photoID string) (info jsonstruct.PhotosGetInfo, width, height int64, ok bool) {
@@ -18,7 +92,7 @@ func (d *DB) GetPhoto(ctx context.Context, photoID string) (info jsonstruct.Phot
 	}
 	var infoJSON []byte
 	err := d.pool.QueryRow(ctx,
-		`SELECT info_json, width, height FROM photos WHERE photo_id = $1`,
+		`SELECT info_json, width, height FROM photos WHERE photo_id = $1 AND `+visible,
 		photoID,
 	).Scan(&infoJSON, &width, &height)
 	if err == pgx.ErrNoRows {
@@ -42,15 +116,37 @@ func (d *DB) UpsertPhoto(ctx context.Context, photoID string, info jsonstruct.Ph
 	if err != nil {
 		return err
 	}
+	f := newPhotoFields(info)
+	// Only public photos reach UpsertPhoto (sync lists public photos, and
+	// PhotosGetInfo is only cached for them), so ispublic is always TRUE here.
 	_, err = d.pool.Exec(ctx,
-		`INSERT INTO photos (photo_id, info_json, width, height, fetched_at)
-		 VALUES ($1, $2, $3, $4, NOW())
+		`INSERT INTO photos (photo_id, info_json, width, height, fetched_at,
+		   title, description, posted_at, taken_at, lastupdate, license,
+		   farm, server, secret, latitude, longitude, views, ispublic)
+		 VALUES ($1, $2, $3, $4, NOW(), $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, TRUE)
 		 ON CONFLICT (photo_id) DO UPDATE SET
 		   info_json = EXCLUDED.info_json,
 		   width = EXCLUDED.width,
 		   height = EXCLUDED.height,
-		   fetched_at = NOW()`,
+		   fetched_at = NOW(),
+		   title = EXCLUDED.title,
+		   description = EXCLUDED.description,
+		   posted_at = EXCLUDED.posted_at,
+		   taken_at = EXCLUDED.taken_at,
+		   lastupdate = EXCLUDED.lastupdate,
+		   license = EXCLUDED.license,
+		   farm = EXCLUDED.farm,
+		   server = EXCLUDED.server,
+		   secret = EXCLUDED.secret,
+		   latitude = EXCLUDED.latitude,
+		   longitude = EXCLUDED.longitude,
+		   views = EXCLUDED.views,
+		   ispublic = EXCLUDED.ispublic,
+		   deleted_at = NULL,
+		   hidden = FALSE`,
 		photoID, infoJSON, width, height,
+		f.Title, f.Description, f.PostedAt, f.TakenAt, f.LastUpdate, f.License,
+		f.Farm, f.Server, f.Secret, f.Latitude, f.Longitude, f.Views,
 	)
 	if err != nil {
 		return err
@@ -75,18 +171,18 @@ func (d *DB) UpsertPhoto(ctx context.Context, photoID string, info jsonstruct.Ph
 	return nil
 }
 
-// photoInfoToPhoto converts PhotosGetInfo.Photo to jsonstruct.Photo for list display.
-func photoInfoToPhoto(info *jsonstruct.PhotosGetInfo) jsonstruct.Photo {
-	p := info.Photo
-	return jsonstruct.Photo{
-		ID:       p.ID,
-		Owner:    p.Owner.Nsid,
-		Title:    p.Title.Content,
-		Secret:   p.Secret,
-		Server:   p.Server,
-		Farm:     p.Farm,
-		Ispublic: 1, // PhotosGetInfo may not have this; assume public
+// scanPhotos reads all rows with scanPhoto and closes rows.
+func scanPhotos(rows pgx.Rows) ([]jsonstruct.Photo, error) {
+	defer rows.Close()
+	var result []jsonstruct.Photo
+	for rows.Next() {
+		p, err := scanPhoto(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, p)
 	}
+	return result, rows.Err()
 }
 
 // GetPhotosByTag returns photos with the given tag, ordered by date-posted-desc.
@@ -95,28 +191,15 @@ func (d *DB) GetPhotosByTag(ctx context.Context, tag string) ([]jsonstruct.Photo
 		return nil, nil
 	}
 	rows, err := d.pool.Query(ctx,
-		`SELECT p.info_json FROM photos p
+		`SELECT `+listColumns+` FROM photos p
 		 INNER JOIN photo_tags pt ON p.photo_id = pt.photo_id
-		 WHERE pt.tag = $1 `+orderByPosted,
+		 WHERE pt.tag = $1 AND `+visible+` `+orderByPosted,
 		tag,
 	)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	var result []jsonstruct.Photo
-	for rows.Next() {
-		var infoJSON []byte
-		if err := rows.Scan(&infoJSON); err != nil {
-			return nil, err
-		}
-		var info jsonstruct.PhotosGetInfo
-		if err := json.Unmarshal(infoJSON, &info); err != nil {
-			continue
-		}
-		result = append(result, photoInfoToPhoto(&info))
-	}
-	return result, nil
+	return scanPhotos(rows)
 }
 
 // GetAllPhotos returns all photos ordered by date-posted-desc.
@@ -125,34 +208,63 @@ func (d *DB) GetAllPhotos(ctx context.Context) ([]jsonstruct.Photo, error) {
 		return nil, nil
 	}
 	rows, err := d.pool.Query(ctx,
-		`SELECT info_json FROM photos `+orderByPosted,
+		`SELECT `+listColumns+` FROM photos p WHERE `+visible+` `+orderByPosted,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanPhotos(rows)
+}
+
+// SitemapPhoto is a visible photo with what the sitemap lists about it.
+type SitemapPhoto struct {
+	ID         string     `json:"id"`
+	Title      string     `json:"title"`
+	Farm       int64      `json:"farm"`
+	Server     string     `json:"server"`
+	Secret     string     `json:"secret"`
+	License    string     `json:"license"`
+	LastUpdate *time.Time `json:"lastupdate"`
+}
+
+// GetSitemapPhotos returns all visible photos, ordered by date-posted-desc.
+func (d *DB) GetSitemapPhotos(ctx context.Context) ([]SitemapPhoto, error) {
+	if d == nil || d.pool == nil {
+		return nil, nil
+	}
+	rows, err := d.pool.Query(ctx,
+		`SELECT p.photo_id, p.title, p.farm, p.server, p.secret, p.license,
+		   COALESCE(p.lastupdate, p.posted_at)
+		 FROM photos p WHERE `+visible+` `+orderByPosted,
 	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var result []jsonstruct.Photo
+	var result []SitemapPhoto
 	for rows.Next() {
-		var infoJSON []byte
-		if err := rows.Scan(&infoJSON); err != nil {
+		var p SitemapPhoto
+		if err := rows.Scan(&p.ID, &p.Title, &p.Farm, &p.Server, &p.Secret, &p.License, &p.LastUpdate); err != nil {
 			return nil, err
 		}
-		var info jsonstruct.PhotosGetInfo
-		if err := json.Unmarshal(infoJSON, &info); err != nil {
-			continue
-		}
-		result = append(result, photoInfoToPhoto(&info))
+		result = append(result, p)
 	}
-	return result, nil
+	return result, rows.Err()
+}
+
+// RelatedLimits bounds GetRelatedPhotos: at most SameTag photos sharing a
+// tag, OtherTag photos of another tag, and Max in total.
+type RelatedLimits struct {
+	Max      int
+	SameTag  int
+	OtherTag int
 }
 
 // GetRelatedPhotos returns related photos: same tags first, then other tags, shuffled.
-func (d *DB) GetRelatedPhotos(ctx context.Context, excludePhotoID string, tagRaws []string, allTags []string, limit int) ([]jsonstruct.Photo, error) {
+func (d *DB) GetRelatedPhotos(ctx context.Context, excludePhotoID string, tagRaws []string, allTags []string, limits RelatedLimits) ([]jsonstruct.Photo, error) {
 	if d == nil || d.pool == nil || len(tagRaws) == 0 {
 		return nil, nil
 	}
-	const sameTagLimit = 8
-	const otherTagLimit = 4
 
 	// 1. Same-tag results
 	tagSet := make(map[string]bool)
@@ -182,8 +294,8 @@ func (d *DB) GetRelatedPhotos(ctx context.Context, excludePhotoID string, tagRaw
 	}
 	sameTag = deduped
 	rand.Shuffle(len(sameTag), func(i, j int) { sameTag[i], sameTag[j] = sameTag[j], sameTag[i] })
-	if len(sameTag) > sameTagLimit {
-		sameTag = sameTag[:sameTagLimit]
+	if len(sameTag) > limits.SameTag {
+		sameTag = sameTag[:limits.SameTag]
 	}
 
 	// 2. Other tags
@@ -194,7 +306,7 @@ func (d *DB) GetRelatedPhotos(ctx context.Context, excludePhotoID string, tagRaw
 		}
 	}
 	var otherTag []jsonstruct.Photo
-	if len(otherTags) > 0 {
+	if len(otherTags) > 0 && limits.OtherTag > 0 {
 		var h uint32
 		for _, c := range excludePhotoID {
 			h = h*31 + uint32(c)
@@ -206,7 +318,7 @@ func (d *DB) GetRelatedPhotos(ctx context.Context, excludePhotoID string, tagRaw
 				if p.ID != excludePhotoID && p.Ispublic != 0 && !seen[p.ID] {
 					otherTag = append(otherTag, p)
 					seen[p.ID] = true
-					if len(otherTag) >= otherTagLimit {
+					if len(otherTag) >= limits.OtherTag {
 						break
 					}
 				}
@@ -217,8 +329,8 @@ func (d *DB) GetRelatedPhotos(ctx context.Context, excludePhotoID string, tagRaw
 	// 3. Merge and shuffle
 	merged := append(sameTag, otherTag...)
 	rand.Shuffle(len(merged), func(i, j int) { merged[i], merged[j] = merged[j], merged[i] })
-	if len(merged) > limit {
-		merged = merged[:limit]
+	if len(merged) > limits.Max {
+		merged = merged[:limits.Max]
 	}
 	return merged, nil
 }
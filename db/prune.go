@@ -0,0 +1,89 @@
+package db
+
+import (
+	"context"
+	"fmt"
+)
+
+// RemoveMode selects how RemovePhotos takes photos off the site.
+type RemoveMode string
+
+const (
+	// RemoveSoft sets deleted_at; the row stays for audit and is restored
+	// by the next UpsertPhoto.
+	RemoveSoft RemoveMode = "soft"
+	// RemoveHide sets hidden, e.g. for photos made private on Flickr.
+	RemoveHide RemoveMode = "hide"
+	// RemoveHard deletes the row and its tags.
+	RemoveHard RemoveMode = "hard"
+)
+
+// ListPhotoIDs returns the IDs of all visible photos.
+func (d *DB) ListPhotoIDs(ctx context.Context) ([]string, error) {
+	if d == nil || d.pool == nil {
+		return nil, nil
+	}
+	rows, err := d.pool.Query(ctx, `SELECT photo_id FROM photos WHERE `+visible)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetPhotoTags returns the tags of the given photos, deduplicated.
+func (d *DB) GetPhotoTags(ctx context.Context, photoIDs []string) ([]string, error) {
+	if d == nil || d.pool == nil || len(photoIDs) == 0 {
+		return nil, nil
+	}
+	rows, err := d.pool.Query(ctx,
+		`SELECT DISTINCT tag FROM photo_tags WHERE photo_id = ANY($1)`,
+		photoIDs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// RemovePhotos soft-deletes, hides or hard-deletes photoIDs and returns the
+// number of rows affected.
+func (d *DB) RemovePhotos(ctx context.Context, photoIDs []string, mode RemoveMode) (int64, error) {
+	if d == nil || d.pool == nil || len(photoIDs) == 0 {
+		return 0, nil
+	}
+	var sql string
+	switch mode {
+	case RemoveSoft:
+		sql = `UPDATE photos SET deleted_at = NOW() WHERE photo_id = ANY($1) AND deleted_at IS NULL`
+	case RemoveHide:
+		sql = `UPDATE photos SET hidden = TRUE WHERE photo_id = ANY($1) AND NOT hidden`
+	case RemoveHard:
+		// photo_tags rows go with ON DELETE CASCADE.
+		sql = `DELETE FROM photos WHERE photo_id = ANY($1)`
+	default:
+		return 0, fmt.Errorf("unknown remove mode %q", mode)
+	}
+	tag, err := d.pool.Exec(ctx, sql, photoIDs)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"context"
+	"strings"
+
+	"github.com/toomore/lazyflickrgo/jsonstruct"
+)
+
+// Markers around matched words in SearchResult highlights. They are control
+// characters so callers can HTML-escape the text first and then replace them.
+const (
+	HighlightStart = "\x02"
+	HighlightStop  = "\x03"
+)
+
+// SearchResult is one full-text search hit.
+type SearchResult struct {
+	Photo jsonstruct.Photo `json:"photo"`
+	Rank  float64          `json:"rank"`
+	// Title and Snippet carry HighlightStart/HighlightStop markers.
+	Title   string `json:"title"`
+	Snippet string `json:"snippet"`
+}
+
+// likeEscaper escapes LIKE wildcards so user input matches literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SearchPhotos runs a websearch-style query over title, description and tags,
+// ranked by ts_rank with a bonus for an exact tag match, and returns one page
+// of hits and the total hit count.
+//
+// The 'simple' configuration does not segment CJK text, so a title substring
+// match is also accepted.
+func (d *DB) SearchPhotos(ctx context.Context, query string, limit, offset int) ([]SearchResult, int, error) {
+	if d == nil || d.pool == nil {
+		return nil, 0, nil
+	}
+	headline := `'StartSel=` + HighlightStart + `, StopSel=` + HighlightStop
+	rows, err := d.pool.Query(ctx,
+		`WITH q AS (SELECT websearch_to_tsquery('simple', $1) AS query)
+		 SELECT `+listColumns+`, r.rank,
+		   ts_headline('simple', p.title, q.query,
+		     `+headline+`, HighlightAll=true'),
+		   ts_headline('simple', p.description, q.query,
+		     `+headline+`, MaxWords=30, MinWords=10'),
+		   COUNT(*) OVER ()
+		 FROM photos p, q,
+		   LATERAL (SELECT ts_rank(p.search_vector, q.query) +
+		     CASE WHEN EXISTS (SELECT 1 FROM photo_tags pt WHERE pt.photo_id = p.photo_id AND lower(pt.tag) = lower($1))
+		       THEN 1 ELSE 0 END AS rank) r
+		 WHERE `+visible+` AND (
+		   p.search_vector @@ q.query
+		   OR p.title ILIKE '%' || $2::text || '%'
+		   OR EXISTS (SELECT 1 FROM photo_tags pt WHERE pt.photo_id = p.photo_id AND lower(pt.tag) = lower($1)))
+		 ORDER BY r.rank DESC, p.posted_at DESC NULLS LAST
+		 LIMIT $3 OFFSET $4`,
+		query, likeEscaper.Replace(query), limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var result []SearchResult
+	var total int
+	for rows.Next() {
+		var hit SearchResult
+		var err error
+		if hit.Photo, err = scanPhoto(rows, &hit.Rank, &hit.Title, &hit.Snippet, &total); err != nil {
+			return nil, 0, err
+		}
+		result = append(result, hit)
+	}
+	return result, total, rows.Err()
+}
@@ -0,0 +1,219 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// GetLastSync returns the last successful sync time recorded under name.
+// ok is false if no sync has been recorded yet.
+func (d *DB) GetLastSync(ctx context.Context, name string) (t time.Time, ok bool, err error) {
+	if d == nil || d.pool == nil {
+		return time.Time{}, false, nil
+	}
+	err = d.pool.QueryRow(ctx,
+		`SELECT last_synced_at FROM sync_state WHERE name = $1`,
+		name,
+	).Scan(&t)
+	if err == pgx.ErrNoRows {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return t, true, nil
+}
+
+// SetLastSync records t as the last successful sync time under name.
+func (d *DB) SetLastSync(ctx context.Context, name string, t time.Time) error {
+	if d == nil || d.pool == nil {
+		return nil
+	}
+	_, err := d.pool.Exec(ctx,
+		`INSERT INTO sync_state (name, last_synced_at) VALUES ($1, $2)
+		 ON CONFLICT (name) DO UPDATE SET last_synced_at = EXCLUDED.last_synced_at`,
+		name, t,
+	)
+	return err
+}
+
+// GetLastUpdates returns the stored Flickr lastupdate (unix seconds) for each
+// of photoIDs that exists in the DB.
+func (d *DB) GetLastUpdates(ctx context.Context, photoIDs []string) (map[string]int64, error) {
+	result := make(map[string]int64)
+	if d == nil || d.pool == nil || len(photoIDs) == 0 {
+		return result, nil
+	}
+	rows, err := d.pool.Query(ctx,
+		`SELECT photo_id, COALESCE(EXTRACT(EPOCH FROM lastupdate)::bigint, 0)
+		 FROM photos WHERE photo_id = ANY($1)`,
+		photoIDs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var last int64
+		if err := rows.Scan(&id, &last); err != nil {
+			return nil, err
+		}
+		result[id] = last
+	}
+	return result, rows.Err()
+}
+
+// Sync run and item states.
+const (
+	SyncRunning = "running"
+	SyncDone    = "done"
+	SyncFailed  = "failed"
+
+	SyncItemPending = "pending"
+	SyncItemDone    = "done"
+	SyncItemFailed  = "failed"
+	SyncItemSkipped = "skipped"
+
+	SyncActionUpsert = "upsert"
+	SyncActionRemove = "remove"
+)
+
+// SyncRun is one row of sync_runs.
+type SyncRun struct {
+	ID         int64      `json:"id"`
+	Kind       string     `json:"kind"`
+	Status     string     `json:"status"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// GetLatestSyncRun returns the most recent run. ok is false if there is none.
+func (d *DB) GetLatestSyncRun(ctx context.Context) (run SyncRun, ok bool, err error) {
+	if d == nil || d.pool == nil {
+		return SyncRun{}, false, nil
+	}
+	err = d.pool.QueryRow(ctx,
+		`SELECT id, kind, status, started_at, finished_at FROM sync_runs
+		 ORDER BY id DESC LIMIT 1`,
+	).Scan(&run.ID, &run.Kind, &run.Status, &run.StartedAt, &run.FinishedAt)
+	if err == pgx.ErrNoRows {
+		return SyncRun{}, false, nil
+	}
+	if err != nil {
+		return SyncRun{}, false, err
+	}
+	return run, true, nil
+}
+
+// GetUnfinishedSyncRun returns the latest run still marked running, i.e. one
+// that was interrupted. ok is false if there is none.
+func (d *DB) GetUnfinishedSyncRun(ctx context.Context) (run SyncRun, ok bool, err error) {
+	if d == nil || d.pool == nil {
+		return SyncRun{}, false, nil
+	}
+	err = d.pool.QueryRow(ctx,
+		`SELECT id, kind, status, started_at, finished_at FROM sync_runs
+		 WHERE status = $1 ORDER BY id DESC LIMIT 1`,
+		SyncRunning,
+	).Scan(&run.ID, &run.Kind, &run.Status, &run.StartedAt, &run.FinishedAt)
+	if err == pgx.ErrNoRows {
+		return SyncRun{}, false, nil
+	}
+	if err != nil {
+		return SyncRun{}, false, err
+	}
+	return run, true, nil
+}
+
+// CreateSyncRun records a new run with its upsert and remove items.
+func (d *DB) CreateSyncRun(ctx context.Context, kind string, upsertIDs, removeIDs []string) (SyncRun, error) {
+	run := SyncRun{Kind: kind, Status: SyncRunning}
+	if d == nil || d.pool == nil {
+		return run, nil
+	}
+	tx, err := d.pool.Begin(ctx)
+	if err != nil {
+		return run, err
+	}
+	defer tx.Rollback(ctx)
+	if err := tx.QueryRow(ctx,
+		`INSERT INTO sync_runs (kind) VALUES ($1) RETURNING id, started_at`,
+		kind,
+	).Scan(&run.ID, &run.StartedAt); err != nil {
+		return run, err
+	}
+	for action, ids := range map[string][]string{SyncActionUpsert: upsertIDs, SyncActionRemove: removeIDs} {
+		if len(ids) == 0 {
+			continue
+		}
+		if _, err := tx.Exec(ctx,
+			`INSERT INTO sync_items (run_id, photo_id, action)
+			 SELECT $1, id, $3 FROM unnest($2::text[]) AS id
+			 ON CONFLICT DO NOTHING`,
+			run.ID, ids, action,
+		); err != nil {
+			return run, err
+		}
+	}
+	return run, tx.Commit(ctx)
+}
+
+// SyncItem is one row of sync_items.
+type SyncItem struct {
+	PhotoID  string
+	Attempts int
+}
+
+// GetOpenSyncItems returns the items of runID with action that are not done.
+func (d *DB) GetOpenSyncItems(ctx context.Context, runID int64, action string) ([]SyncItem, error) {
+	if d == nil || d.pool == nil {
+		return nil, nil
+	}
+	rows, err := d.pool.Query(ctx,
+		`SELECT photo_id, attempts FROM sync_items
+		 WHERE run_id = $1 AND action = $2 AND status IN ($3, $4)
+		 ORDER BY photo_id`,
+		runID, action, SyncItemPending, SyncItemFailed,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SyncItem
+	for rows.Next() {
+		var it SyncItem
+		if err := rows.Scan(&it.PhotoID, &it.Attempts); err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+// MarkSyncItems sets status, attempts and error for photoIDs of runID.
+func (d *DB) MarkSyncItems(ctx context.Context, runID int64, photoIDs []string, status string, attempts int, errMsg string) error {
+	if d == nil || d.pool == nil || len(photoIDs) == 0 {
+		return nil
+	}
+	_, err := d.pool.Exec(ctx,
+		`UPDATE sync_items SET status = $3, attempts = attempts + $4, error = NULLIF($5, ''), updated_at = NOW()
+		 WHERE run_id = $1 AND photo_id = ANY($2)`,
+		runID, photoIDs, status, attempts, errMsg,
+	)
+	return err
+}
+
+// FinishSyncRun sets the final status of runID.
+func (d *DB) FinishSyncRun(ctx context.Context, runID int64, status string) error {
+	if d == nil || d.pool == nil {
+		return nil
+	}
+	_, err := d.pool.Exec(ctx,
+		`UPDATE sync_runs SET status = $2, finished_at = NOW() WHERE id = $1`,
+		runID, status,
+	)
+	return err
+}
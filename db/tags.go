@@ -0,0 +1,99 @@
+package db
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/toomore/lazyflickrgo/jsonstruct"
+)
+
+// TagCount is a tag with the number of visible photos carrying it.
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// GetTagCounts returns every tag in photo_tags with its photo count,
+// most used first.
+func (d *DB) GetTagCounts(ctx context.Context) ([]TagCount, error) {
+	if d == nil || d.pool == nil {
+		return nil, nil
+	}
+	rows, err := d.pool.Query(ctx,
+		`SELECT pt.tag, COUNT(*) FROM photo_tags pt
+		 INNER JOIN photos p ON p.photo_id = pt.photo_id
+		 WHERE `+visible+`
+		 GROUP BY pt.tag ORDER BY COUNT(*) DESC, pt.tag`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []TagCount
+	for rows.Next() {
+		var tc TagCount
+		if err := rows.Scan(&tc.Tag, &tc.Count); err != nil {
+			return nil, err
+		}
+		result = append(result, tc)
+	}
+	return result, rows.Err()
+}
+
+// ResolveTag returns the spelling of tag stored in photo_tags, matched
+// case-insensitively; an exact match wins, then the most used spelling. ok
+// is false when no visible photo has the tag.
+func (d *DB) ResolveTag(ctx context.Context, tag string) (stored string, ok bool, err error) {
+	if d == nil || d.pool == nil {
+		return "", false, nil
+	}
+	err = d.pool.QueryRow(ctx,
+		`SELECT pt.tag FROM photo_tags pt
+		 INNER JOIN photos p ON p.photo_id = pt.photo_id
+		 WHERE lower(pt.tag) = lower($1) AND `+visible+`
+		 GROUP BY pt.tag ORDER BY pt.tag = $1 DESC, COUNT(*) DESC, pt.tag
+		 LIMIT 1`,
+		tag,
+	).Scan(&stored)
+	if err == pgx.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return stored, true, nil
+}
+
+// CountPhotosByTag returns the number of visible photos with tag.
+func (d *DB) CountPhotosByTag(ctx context.Context, tag string) (int, error) {
+	if d == nil || d.pool == nil {
+		return 0, nil
+	}
+	var n int
+	err := d.pool.QueryRow(ctx,
+		`SELECT COUNT(*) FROM photos p
+		 INNER JOIN photo_tags pt ON p.photo_id = pt.photo_id
+		 WHERE pt.tag = $1 AND `+visible,
+		tag,
+	).Scan(&n)
+	return n, err
+}
+
+// GetPhotosByTagPage returns limit photos with tag after skipping offset,
+// ordered by date-posted-desc.
+func (d *DB) GetPhotosByTagPage(ctx context.Context, tag string, limit, offset int) ([]jsonstruct.Photo, error) {
+	if d == nil || d.pool == nil {
+		return nil, nil
+	}
+	rows, err := d.pool.Query(ctx,
+		`SELECT `+listColumns+` FROM photos p
+		 INNER JOIN photo_tags pt ON p.photo_id = pt.photo_id
+		 WHERE pt.tag = $1 AND `+visible+` `+orderByPosted+`
+		 LIMIT $2 OFFSET $3`,
+		tag, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanPhotos(rows)
+}
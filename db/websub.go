@@ -0,0 +1,73 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// WebSubSubscription is a verified subscription to a feed topic.
+type WebSubSubscription struct {
+	Topic     string
+	Callback  string
+	Secret    string
+	ExpiresAt time.Time
+}
+
+// UpsertWebSubSubscription stores s, renewing its lease and secret if the
+// callback already subscribed to the topic.
+func (d *DB) UpsertWebSubSubscription(ctx context.Context, s WebSubSubscription) error {
+	if d == nil || d.pool == nil {
+		return nil
+	}
+	_, err := d.pool.Exec(ctx,
+		`INSERT INTO websub_subscriptions (topic, callback, secret, expires_at)
+		 VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (topic, callback) DO UPDATE SET
+		   secret = EXCLUDED.secret,
+		   expires_at = EXCLUDED.expires_at`,
+		s.Topic, s.Callback, s.Secret, s.ExpiresAt,
+	)
+	return err
+}
+
+// DeleteWebSubSubscription removes the subscription of callback to topic.
+func (d *DB) DeleteWebSubSubscription(ctx context.Context, topic, callback string) error {
+	if d == nil || d.pool == nil {
+		return nil
+	}
+	_, err := d.pool.Exec(ctx,
+		`DELETE FROM websub_subscriptions WHERE topic = $1 AND callback = $2`,
+		topic, callback,
+	)
+	return err
+}
+
+// GetWebSubSubscriptions returns the unexpired subscriptions to topic.
+func (d *DB) GetWebSubSubscriptions(ctx context.Context, topic string) ([]WebSubSubscription, error) {
+	if d == nil || d.pool == nil {
+		return nil, nil
+	}
+	rows, err := d.pool.Query(ctx,
+		`SELECT topic, callback, secret, expires_at FROM websub_subscriptions
+		 WHERE topic = $1 AND expires_at > NOW()`,
+		topic,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[WebSubSubscription])
+}
+
+// DeleteExpiredWebSubSubscriptions purges subscriptions whose lease ended.
+func (d *DB) DeleteExpiredWebSubSubscriptions(ctx context.Context) (int64, error) {
+	if d == nil || d.pool == nil {
+		return 0, nil
+	}
+	tag, err := d.pool.Exec(ctx, `DELETE FROM websub_subscriptions WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
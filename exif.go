@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toomore/lazyflickrgo/jsonstruct"
+	"github.com/toomore/toomorephotos/cache"
+	"github.com/toomore/toomorephotos/db"
+)
+
+const gearPageSize = tagPageSize
+
+// exifResponse is flickr.photos.getExif. Only raw values are read: clean
+// values are localized display strings and often missing.
+type exifResponse struct {
+	Photo struct {
+		ID     string `json:"id"`
+		Camera string `json:"camera"`
+		Exif   []struct {
+			Tag string `json:"tag"`
+			Raw struct {
+				Content string `json:"_content"`
+			} `json:"raw"`
+		} `json:"exif"`
+	} `json:"photo"`
+	Stat    string `json:"stat"`
+	Code    int64  `json:"code"`
+	Message string `json:"message"`
+}
+
+// parseExif picks the fields we store. Lens makers disagree on the tag, so
+// LensModel wins over Lens and LensInfo.
+func parseExif(resp exifResponse) db.PhotoExif {
+	raw := make(map[string]string, len(resp.Photo.Exif))
+	for _, t := range resp.Photo.Exif {
+		if _, seen := raw[t.Tag]; !seen && strings.TrimSpace(t.Raw.Content) != "" {
+			raw[t.Tag] = strings.TrimSpace(t.Raw.Content)
+		}
+	}
+	var e db.PhotoExif
+	e.Make = raw["Make"]
+	e.Model = raw["Model"]
+	if e.Model == "" {
+		e.Model = resp.Photo.Camera
+	}
+	for _, tag := range []string{"LensModel", "Lens", "LensInfo"} {
+		if v := raw[tag]; v != "" {
+			e.Lens = v
+			break
+		}
+	}
+	e.FocalLength, _ = strconv.ParseFloat(strings.TrimSuffix(raw["FocalLength"], " mm"), 64)
+	e.Aperture, _ = strconv.ParseFloat(raw["FNumber"], 64)
+	e.Shutter = raw["ExposureTime"]
+	e.ISO, _ = strconv.Atoi(raw["ISO"])
+	if t, err := time.Parse("2006:01:02 15:04:05", raw["DateTimeOriginal"]); err == nil {
+		e.CapturedAt = &t
+	}
+	return e
+}
+
+// fetchExif calls flickr.photos.getExif. ok is false when the owner hides
+// EXIF (Flickr code 2) or the photo has none.
+func fetchExif(ctx context.Context, app *App, photoID string) (e db.PhotoExif, ok bool, err error) {
+	var resp exifResponse
+	args := map[string]string{"method": "flickr.photos.getExif", "photo_id": photoID}
+	if err := flickrGet(ctx, app, args, &resp); err != nil {
+		return db.PhotoExif{}, false, err
+	}
+	if resp.Stat != "ok" {
+		if resp.Code == 2 {
+			return db.PhotoExif{}, false, nil
+		}
+		return db.PhotoExif{}, false, &flickrError{Stat: resp.Stat, Code: resp.Code, Message: resp.Message}
+	}
+	e = parseExif(resp)
+	return e, !e.Empty(), nil
+}
+
+// getCachedPhotoExif returns EXIF from cache, DB, or Flickr. A photo without
+// EXIF is cached as empty so Flickr is not asked again until the TTL expires.
+func (a *App) getCachedPhotoExif(photoID string) (db.PhotoExif, bool) {
+	ctx := context.Background()
+	key := "exif:" + photoID
+	result, err := cache.Fetch(ctx, a.ReadThrough, key, a.cacheOpts(a.PhotoCacheTTL, photoCacheGroup(photoID)), func(ctx context.Context) (db.PhotoExif, error) {
+		if a.DB != nil {
+			if e, ok, err := a.DB.GetPhotoExif(ctx, photoID); err == nil && ok {
+				return e, nil
+			}
+		}
+		e, ok, err := fetchExif(ctx, a, photoID)
+		if err != nil {
+			return db.PhotoExif{}, err
+		}
+		if ok && a.DB != nil {
+			_ = a.DB.UpsertPhotoExif(ctx, photoID, e)
+		}
+		return e, nil
+	})
+	if err != nil {
+		log.Printf("exif %s: %v", photoID, err)
+		return db.PhotoExif{}, false
+	}
+	return result, !result.Empty()
+}
+
+// getCachedGearPage returns one page of photos by camera model or lens name.
+// kind is "camera" or "lens"; both need DATABASE_URL.
+func (a *App) getCachedGearPage(kind, name string, page int) tagPage {
+	ctx := context.Background()
+	key := fmt.Sprintf("%s:%s:%d", kind, name, page)
+	result, err := cache.Fetch(ctx, a.ReadThrough, key, a.cacheOpts(a.IndexCacheTTL), func(ctx context.Context) (tagPage, error) {
+		get := a.DB.GetPhotosByCameraPage
+		if kind == "lens" {
+			get = a.DB.GetPhotosByLensPage
+		}
+		photos, total, err := get(ctx, name, gearPageSize, (page-1)*gearPageSize)
+		if err != nil {
+			return tagPage{}, err
+		}
+		return tagPage{Photos: photos, Total: total}, nil
+	})
+	if err != nil {
+		log.Printf("%s %q: %v", kind, name, err)
+		return tagPage{}
+	}
+	return result
+}
+
+// camera serves /camera/{model}?page=N.
+func (a *App) camera(w http.ResponseWriter, r *http.Request) {
+	a.gear(w, r, "camera", "相機")
+}
+
+// lens serves /lens/{name}?page=N.
+func (a *App) lens(w http.ResponseWriter, r *http.Request) {
+	a.gear(w, r, "lens", "鏡頭")
+}
+
+func (a *App) gear(w http.ResponseWriter, r *http.Request, kind, label string) {
+	logs(r, "")
+	prefix := "/" + kind + "/"
+	// Lens names contain "/" (f/2.8), which links escape as %2F.
+	name, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), prefix))
+	if err != nil || name == "" || a.DB == nil {
+		a.notFound(w, r)
+		return
+	}
+	page, ok := parsePage(r)
+	if !ok {
+		a.notFound(w, r)
+		return
+	}
+	result := a.getCachedGearPage(kind, name, page)
+	p := newPager(page, gearPageSize, result.Total)
+	if result.Total == 0 || page > p.Pages {
+		a.notFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "max-age=120")
+	data := struct {
+		Label string
+		Name  string
+		Path  string
+		R     []jsonstruct.Photo
+		Pager pager
+	}{label, name, prefix + url.PathEscape(name), result.Photos, p}
+	if err := a.TplGear.Execute(w, data); err != nil {
+		log.Printf("template execute error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"encoding/xml"
 	"fmt"
+	"html"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
@@ -12,24 +15,63 @@ import (
 
 	"github.com/gorilla/feeds"
 	"github.com/toomore/lazyflickrgo/jsonstruct"
+	"github.com/toomore/toomorephotos/cache"
 )
 
 const feedConcurrency = 10
 
-func (a *App) createFeeds(data []jsonstruct.Photo) *feeds.Feed {
-	feed := &feeds.Feed{
-		Title:       "Toomore Photos",
-		Link:        &feeds.Link{Href: "https://photos.toomore.net/"},
-		Description: "From here to see what I see.",
-		Author:      &feeds.Author{Name: "Toomore Chiang", Email: "toomore0929@gmail.com"},
+// photoFeed is a feed plus the photo behind each item, which Media RSS and
+// JSON Feed need. Photos[i] belongs to Items[i].
+type photoFeed struct {
+	feeds.Feed
+	Photos []feedPhoto `json:"photos"`
+	// Modified is the newest posted or lastupdate time of the items.
+	Modified time.Time `json:"modified"`
+}
+
+// feedPhoto is the Large image of an item with its real size.
+type feedPhoto struct {
+	Image       string   `json:"image"`
+	Width       int64    `json:"width"`
+	Height      int64    `json:"height"`
+	Thumbnail   string   `json:"thumbnail"`
+	Tags        []string `json:"tags"`
+	LicenseName string   `json:"license_name"`
+	LicenseURL  string   `json:"license_url"`
+}
+
+// photo returns the photo of item i, or nil for feeds cached before Photos
+// existed.
+func (f *photoFeed) photo(i int) *feedPhoto {
+	if i < len(f.Photos) {
+		return &f.Photos[i]
+	}
+	return nil
+}
+
+func (a *App) createFeeds(data []jsonstruct.Photo) *photoFeed {
+	site := a.Config.Site
+	itemAuthor := site.Author.Name
+	if site.Author.Email != "" {
+		itemAuthor = fmt.Sprintf("%s (%s)", site.Author.Email, site.Author.Name)
 	}
+	feed := &photoFeed{Feed: feeds.Feed{
+		Title:       site.Title,
+		Link:        &feeds.Link{Href: site.URL + "/"},
+		Description: site.Description,
+		Author:      &feeds.Author{Name: site.Author.Name, Email: site.Author.Email},
+	}}
 
-	n := min(100, len(data))
+	n := min(a.Config.Feed.Size, len(data))
 	if n == 0 {
 		return feed
 	}
 
+	type sized struct {
+		width, height int64
+	}
 	results := make([]jsonstruct.PhotosGetInfo, n)
+	sizes := make([]sized, n)
 	sem := make(chan struct{}, feedConcurrency)
 	var wg sync.WaitGroup
 
@@ -40,6 +82,7 @@ func (a *App) createFeeds(data []jsonstruct.Photo) *feeds.Feed {
 			sem <- struct{}{}
 			defer func() { <-sem }()
 			results[i] = a.getCachedPhotosGetInfo(id)
+			sizes[i].width, sizes[i].height, _ = a.getCachedPhotosGetSizes(id)
 		}(i, v.ID)
 	}
 	wg.Wait()
@@ -49,62 +92,290 @@ func (a *App) createFeeds(data []jsonstruct.Photo) *feeds.Feed {
 		times, _ := strconv.Atoi(photoinfo.Photo.Dates.Posted)
 		updated := time.Unix(int64(times), 0)
 
-		if i == 0 {
+		if updated.After(feed.Updated) {
 			feed.Updated = updated
 		}
+		lastupdate, _ := strconv.ParseInt(photoinfo.Photo.Dates.Lastupdate, 10, 64)
+		for _, t := range []time.Time{updated, time.Unix(lastupdate, 0)} {
+			if t.After(feed.Modified) {
+				feed.Modified = t
+			}
+		}
 
-		desc := fmt.Sprintf(`<a href="https://photos.toomore.net/p/%s"><img src="https://photos.toomore.net/f/%d/%s/%s/%s.jpg"></a>%s<br>Photo by <a href="https://toomore.net/">Toomore</a><br><img width=1 height=3 src="https://photos.toomore.net/fr?r=%s">`, photoinfo.Photo.ID, photoinfo.Photo.Farm, photoinfo.Photo.Server, photoinfo.Photo.Secret, photoinfo.Photo.ID, strings.Replace(photoinfo.Photo.Description.Content, "\n", "<br>", -1), photoinfo.Photo.ID)
+		desc := fmt.Sprintf(`<a href="%[1]s/p/%[2]s"><img src="%[1]s/f/%[3]d/%[4]s/%[5]s/%[2]s.jpg"></a>%[6]s<br>Photo by <a href="%[7]s">%[8]s</a><br><img width=1 height=3 src="%[1]s/fr?r=%[2]s">`, site.URL, photoinfo.Photo.ID, photoinfo.Photo.Farm, photoinfo.Photo.Server, photoinfo.Photo.Secret, strings.Replace(photoinfo.Photo.Description.Content, "\n", "<br>", -1), site.Author.URL, html.EscapeString(site.Author.Nickname))
 
 		feed.Items = append(feed.Items, &feeds.Item{
-			Id:          fmt.Sprintf("https://photos.toomore.net/p/%s", v.ID),
+			Id:          fmt.Sprintf("%s/p/%s", site.URL, v.ID),
 			Title:       fmt.Sprintf("%s (%s)", v.Title, v.ID),
-			Link:        &feeds.Link{Href: fmt.Sprintf("https://photos.toomore.net/p/%s", v.ID)},
+			Link:        &feeds.Link{Href: fmt.Sprintf("%s/p/%s", site.URL, v.ID)},
 			Description: desc,
 			Updated:     updated,
-			Author:      &feeds.Author{Name: "toomore0929@gmail.com (Toomore Chiang)"},
+			Author:      &feeds.Author{Name: itemAuthor},
 		})
+
+		images := a.apiImagesFor(v.Farm, v.Server, v.Secret, v.ID)
+		photo := feedPhoto{
+			Image:     images.Large,
+			Width:     sizes[i].width,
+			Height:    sizes[i].height,
+			Thumbnail: images.Thumbnail,
+		}
+		for _, t := range photoinfo.Photo.Tags.Tag {
+			photo.Tags = append(photo.Tags, t.Raw)
+		}
+		if l, ok := a.Licenses[photoinfo.Photo.License]; ok {
+			photo.LicenseName, photo.LicenseURL = l.Name, l.URL
+		}
+		feed.Photos = append(feed.Photos, photo)
 	}
 	return feed
 }
 
-func (a *App) getCachedFeed() *feeds.Feed {
+func (a *App) getCachedFeed() *photoFeed {
 	ctx := context.Background()
 	key := "feed"
-	var feed feeds.Feed
-	if ok, _ := a.Cache.Get(ctx, key, &feed); ok {
-		return &feed
+	f, _ := cache.Fetch(ctx, a.ReadThrough, key, a.cacheOpts(a.FeedCacheTTL), func(ctx context.Context) (*photoFeed, error) {
+		return a.createFeeds(a.getCachedAllPhotos()), nil
+	})
+	return f
+}
+
+// getCachedTagFeed builds the feed of one tag. It returns nil when the tag
+// has no photos, or with DB when no photo in DB has it.
+func (a *App) getCachedTagFeed(tag string) *photoFeed {
+	ctx := context.Background()
+	key := "feed:tag:" + normalizeTag(tag)
+	f, _ := cache.Fetch(ctx, a.ReadThrough, key, a.cacheOpts(a.FeedCacheTTL, tagCacheGroup(tag)), func(ctx context.Context) (*photoFeed, error) {
+		tag, ok, err := a.resolveTag(ctx, tag)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			// Cached too, so unknown tags do not reach DB every time.
+			return &photoFeed{}, nil
+		}
+		f := a.createFeeds(a.getCachedFromSearch(tag))
+		f.Title = fmt.Sprintf("#%s - %s", tag, a.Config.Site.Title)
+		f.Link = &feeds.Link{Href: fmt.Sprintf("%s/t/%s", a.Config.Site.URL, url.PathEscape(tag))}
+		f.Description = fmt.Sprintf("Photos tagged #%s by %s.", tag, a.Config.Site.Author.Nickname)
+		return f, nil
+	})
+	if f == nil || len(f.Items) == 0 {
+		return nil
 	}
-	result := a.getCachedAllPhotos()
-	f := a.createFeeds(result)
-	_ = a.Cache.Set(ctx, key, f, a.FeedCacheTTL)
 	return f
 }
 
+// rss serves /rss and, with ?tag=, the feed of one tag.
 func (a *App) rss(w http.ResponseWriter, r *http.Request) {
-	feed := a.getCachedFeed()
-	rssFeed := feeds.Rss{Feed: feed}
+	a.serveFeed(w, r, "rss")
+}
+
+// atom serves /atom and, with ?tag=, the feed of one tag.
+func (a *App) atom(w http.ResponseWriter, r *http.Request) {
+	a.serveFeed(w, r, "atom")
+}
+
+// jsonFeed serves /feed.json and, with ?tag=, the feed of one tag.
+func (a *App) jsonFeed(w http.ResponseWriter, r *http.Request) {
+	a.serveFeed(w, r, "json")
+}
+
+func (a *App) serveFeed(w http.ResponseWriter, r *http.Request, format string) {
+	self := a.Config.Site.URL + r.URL.Path
+	tag := r.URL.Query().Get("tag")
+	if tag == "" {
+		a.writeFeed(w, r, a.getCachedFeed(), format, self)
+		return
+	}
+	a.writeTagFeed(w, r, tag, format)
+}
+
+// writeTagFeed writes the feed of tag. /rss?tag= and /t/{tag}/rss are the
+// same feed; the latter is its self URL and WebSub topic.
+func (a *App) writeTagFeed(w http.ResponseWriter, r *http.Request, tag, format string) {
+	feed := a.getCachedTagFeed(tag)
+	if feed == nil {
+		a.notFound(w, r)
+		return
+	}
+	w.Header().Set("X-Tags", tag)
+	a.writeFeed(w, r, feed, format, a.tagFeedURL(tag, format))
+}
+
+// writeFeed writes feed as "rss", "atom" or "json". self is the feed's own
+// URL, written as the rel="self" link or feed_url, next to the WebSub hubs.
+func (a *App) writeFeed(w http.ResponseWriter, r *http.Request, feed *photoFeed, format, self string) {
+	a.setFeedLinks(w, self)
+	switch format {
+	case "atom":
+		a.writeAtom(w, r, feed, self)
+	case "json":
+		a.writeJSONFeed(w, r, feed, self)
+	default:
+		a.writeRSS(w, r, feed, self)
+	}
+}
+
+// feedMaxAge is the Cache-Control max-age of feeds in seconds. Readers that
+// poll more often get 304 via ETag and Last-Modified.
+const feedMaxAge = 600
+
+// modifiedAt is the Last-Modified of the feed. Feeds cached before Modified
+// existed fall back to the newest posted time.
+func (f *photoFeed) modifiedAt() time.Time {
+	if f.Modified.IsZero() {
+		return f.Updated
+	}
+	return f.Modified
+}
+
+// rssSelfFeed adds the atom:link rel="self" that RSS readers and validators
+// expect, and Media RSS on items; gorilla/feeds writes neither.
+type rssSelfFeed struct {
+	XMLName          xml.Name `xml:"rss"`
+	Version          string   `xml:"version,attr"`
+	ContentNamespace string   `xml:"xmlns:content,attr"`
+	AtomNamespace    string   `xml:"xmlns:atom,attr"`
+	MediaNamespace   string   `xml:"xmlns:media,attr"`
+	Channel          *rssSelfChannel
+}
+
+// rssSelfChannel.Items shadows RssFeed.Items.
+type rssSelfChannel struct {
+	XMLName xml.Name `xml:"channel"`
+	*feeds.RssFeed
+	Links []rssAtomLink
+	Items []*rssMediaItem `xml:"item"`
+}
+
+// rssMediaItem is an item with its Media RSS elements
+// (https://www.rssboard.org/media-rss).
+type rssMediaItem struct {
+	XMLName xml.Name `xml:"item"`
+	*feeds.RssItem
+	Content   *mediaContent
+	Thumbnail *mediaThumbnail
+	Credit    *mediaCredit
+	License   *mediaLicense
+}
+
+type mediaContent struct {
+	XMLName xml.Name `xml:"media:content"`
+	URL     string   `xml:"url,attr"`
+	Type    string   `xml:"type,attr"`
+	Medium  string   `xml:"medium,attr"`
+	Width   int64    `xml:"width,attr,omitempty"`
+	Height  int64    `xml:"height,attr,omitempty"`
+}
+
+type mediaThumbnail struct {
+	XMLName xml.Name `xml:"media:thumbnail"`
+	URL     string   `xml:"url,attr"`
+	Width   int      `xml:"width,attr"`
+	Height  int      `xml:"height,attr"`
+}
+
+type mediaCredit struct {
+	XMLName xml.Name `xml:"media:credit"`
+	Role    string   `xml:"role,attr"`
+	Scheme  string   `xml:"scheme,attr"`
+	Name    string   `xml:",chardata"`
+}
+
+type mediaLicense struct {
+	XMLName xml.Name `xml:"media:license"`
+	Type    string   `xml:"type,attr,omitempty"`
+	Href    string   `xml:"href,attr,omitempty"`
+	Name    string   `xml:",chardata"`
+}
+
+// thumbnailSize is the edge of the square "q" size.
+const thumbnailSize = 150
+
+func newRSSMediaItem(item *feeds.RssItem, photo *feedPhoto, credit string) *rssMediaItem {
+	m := &rssMediaItem{RssItem: item}
+	if photo == nil {
+		return m
+	}
+	m.Content = &mediaContent{URL: photo.Image, Type: "image/jpeg", Medium: "image", Width: photo.Width, Height: photo.Height}
+	m.Thumbnail = &mediaThumbnail{URL: photo.Thumbnail, Width: thumbnailSize, Height: thumbnailSize}
+	m.Credit = &mediaCredit{Role: "photographer", Scheme: "urn:ebu", Name: credit}
+	if photo.LicenseName != "" {
+		m.License = &mediaLicense{Name: photo.LicenseName, Href: photo.LicenseURL}
+		if photo.LicenseURL != "" {
+			m.License.Type = "text/html"
+		}
+	}
+	return m
+}
+
+type rssAtomLink struct {
+	XMLName xml.Name `xml:"atom:link"`
+	Href    string   `xml:"href,attr"`
+	Rel     string   `xml:"rel,attr"`
+	Type    string   `xml:"type,attr,omitempty"`
+}
+
+func (f *rssSelfFeed) FeedXml() interface{} { return f }
+
+// atomSelfFeed writes the alternate, rel="self" and rel="hub" links. Links
+// shadows the single AtomFeed.Link.
+type atomSelfFeed struct {
+	XMLName xml.Name `xml:"feed"`
+	*feeds.AtomFeed
+	Links []feeds.AtomLink `xml:"link"`
+}
+
+func (f *atomSelfFeed) FeedXml() interface{} { return f }
+
+func (a *App) writeRSS(w http.ResponseWriter, r *http.Request, feed *photoFeed, self string) {
+	rssFeed := feeds.Rss{Feed: &feed.Feed}
 	rssfeed := rssFeed.RssFeed()
 	rssfeed.Language = "zh"
 
-	rss, err := feeds.ToXML(rssfeed)
+	channel := &rssSelfChannel{
+		RssFeed: rssfeed,
+		Links:   []rssAtomLink{{Href: self, Rel: "self", Type: "application/rss+xml"}},
+	}
+	for _, hub := range a.hubURLs() {
+		channel.Links = append(channel.Links, rssAtomLink{Href: hub, Rel: "hub"})
+	}
+	for i, item := range rssfeed.Items {
+		channel.Items = append(channel.Items, newRSSMediaItem(item, feed.photo(i), feed.Author.Name))
+	}
+
+	rss, err := feeds.ToXML(&rssSelfFeed{
+		Version:          "2.0",
+		ContentNamespace: "http://purl.org/rss/1.0/modules/content/",
+		AtomNamespace:    "http://www.w3.org/2005/Atom",
+		MediaNamespace:   "http://search.yahoo.com/mrss/",
+		Channel:          channel,
+	})
 	if err != nil {
 		log.Printf("feeds.ToXML error: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	w.Write([]byte(rss))
+	writeConditional(w, r, "application/rss+xml; charset=utf-8", feed.modifiedAt(), []byte(rss), feedMaxAge)
 }
 
-func (a *App) atom(w http.ResponseWriter, r *http.Request) {
-	feed := a.getCachedFeed()
-	atomFeed := feeds.Atom{Feed: feed}
+func (a *App) writeAtom(w http.ResponseWriter, r *http.Request, feed *photoFeed, self string) {
+	atomFeed := feeds.Atom{Feed: &feed.Feed}
 	atomfeed := atomFeed.AtomFeed()
 
-	atom, err := feeds.ToXML(atomfeed)
+	links := []feeds.AtomLink{
+		{Href: atomfeed.Link.Href, Rel: "alternate", Type: "text/html"},
+		{Href: self, Rel: "self", Type: "application/atom+xml"},
+	}
+	for _, hub := range a.hubURLs() {
+		links = append(links, feeds.AtomLink{Href: hub, Rel: "hub"})
+	}
+	atom, err := feeds.ToXML(&atomSelfFeed{AtomFeed: atomfeed, Links: links})
 	if err != nil {
 		log.Printf("feeds.ToXML error: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	w.Write([]byte(atom))
+	writeConditional(w, r, "application/atom+xml; charset=utf-8", feed.modifiedAt(), []byte(atom), feedMaxAge)
 }
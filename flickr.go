@@ -3,12 +3,15 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"math/rand"
 	"os"
 	"strconv"
 	"strings"
 
 	"github.com/toomore/lazyflickrgo/jsonstruct"
+	"github.com/toomore/toomorephotos/cache"
+	"github.com/toomore/toomorephotos/db"
 )
 
 func getTags(path string) ([]string, error) {
@@ -29,64 +32,57 @@ func getTags(path string) ([]string, error) {
 	return result, nil
 }
 
-func (a *App) fromSearch(tags string) []jsonstruct.Photo {
-	args := map[string]string{
-		"tags":      tags,
-		"tag_mode":  "all",
-		"sort":      "date-posted-desc",
-		"user_id":   a.UserID,
-	}
-
-	var result []jsonstruct.Photo
-	for _, val := range a.Flickr.PhotosSearch(args) {
-		result = append(result, val.Photos.Photo...)
-	}
-	return result
+func (a *App) fromSearch(ctx context.Context, tags string) ([]jsonstruct.Photo, error) {
+	return flickrSearch(ctx, a, map[string]string{
+		"tags":     tags,
+		"tag_mode": "all",
+		"sort":     "date-posted-desc",
+		"user_id":  a.UserID,
+	})
 }
 
 func (a *App) getCachedFromSearch(tag string) []jsonstruct.Photo {
 	ctx := context.Background()
 	key := "index:" + tag
-	var result []jsonstruct.Photo
-	if ok, _ := a.Cache.Get(ctx, key, &result); ok {
-		return result
-	}
-	if a.DB != nil {
-		if photos, err := a.DB.GetPhotosByTag(ctx, tag); err == nil && len(photos) > 0 {
-			_ = a.Cache.Set(ctx, key, photos, a.IndexCacheTTL)
-			return photos
+	result, _ := cache.Fetch(ctx, a.ReadThrough, key, a.cacheOpts(a.IndexCacheTTL, tagCacheGroup(tag)), func(ctx context.Context) ([]jsonstruct.Photo, error) {
+		if a.DB != nil {
+			if photos, err := a.DB.GetPhotosByTag(ctx, tag); err == nil && len(photos) > 0 {
+				return photos, nil
+			}
 		}
-	}
-	result = a.fromSearch(tag)
-	_ = a.Cache.Set(ctx, key, result, a.IndexCacheTTL)
+		return a.fromSearch(ctx, tag)
+	})
 	return result
 }
 
 func (a *App) getCachedPhotosGetInfo(photoID string) jsonstruct.PhotosGetInfo {
 	ctx := context.Background()
 	key := "photo:" + photoID
-	var info jsonstruct.PhotosGetInfo
-	if ok, _ := a.Cache.Get(ctx, key, &info); ok {
-		return info
-	}
-	if a.DB != nil {
-		if dbInfo, _, _, ok := a.DB.GetPhoto(ctx, photoID); ok && dbInfo.Common.Stat == "ok" {
-			_ = a.Cache.Set(ctx, key, dbInfo, a.PhotoCacheTTL)
-			return dbInfo
+	info, _ := cache.Fetch(ctx, a.ReadThrough, key, a.cacheOpts(a.PhotoCacheTTL, photoCacheGroup(photoID)), func(ctx context.Context) (jsonstruct.PhotosGetInfo, error) {
+		if a.DB != nil {
+			if dbInfo, _, _, ok := a.DB.GetPhoto(ctx, photoID); ok && dbInfo.Common.Stat == "ok" {
+				return dbInfo, nil
+			}
 		}
-	}
-	info = a.Flickr.PhotosGetInfo(photoID)
-	_ = a.Cache.Set(ctx, key, info, a.PhotoCacheTTL)
-	if a.DB != nil && info.Common.Stat == "ok" {
-		if w, h, ok := a.getCachedPhotosGetSizes(photoID); ok {
-			_ = a.DB.UpsertPhoto(ctx, photoID, info, w, h)
-		} else {
-			_ = a.DB.UpsertPhoto(ctx, photoID, info, 0, 0)
+		var info jsonstruct.PhotosGetInfo
+		if err := flickrGet(ctx, a, map[string]string{"method": "flickr.photos.getInfo", "photo_id": photoID}, &info); err != nil {
+			return info, err
 		}
-	}
+		if a.DB != nil && info.Common.Stat == "ok" {
+			if w, h, ok := a.getCachedPhotosGetSizes(photoID); ok {
+				_ = a.DB.UpsertPhoto(ctx, photoID, info, w, h)
+			} else {
+				_ = a.DB.UpsertPhoto(ctx, photoID, info, 0, 0)
+			}
+		}
+		return info, nil
+	})
 	return info
 }
 
+// errNoPhotoSize keeps a photo without a usable size out of the cache.
+var errNoPhotoSize = errors.New("no photo size")
+
 type photoSizesVal struct {
 	Width  int64 `json:"width"`
 	Height int64 `json:"height"`
@@ -97,17 +93,31 @@ type photoSizesVal struct {
 func (a *App) getCachedPhotosGetSizes(photoID string) (width, height int64, ok bool) {
 	ctx := context.Background()
 	key := "photosizes:" + photoID
-	var v photoSizesVal
-	if found, _ := a.Cache.Get(ctx, key, &v); found && v.Width > 0 && v.Height > 0 {
-		return v.Width, v.Height, true
-	}
-	if a.DB != nil {
-		if _, w, h, found := a.DB.GetPhoto(ctx, photoID); found && w > 0 && h > 0 {
-			_ = a.Cache.Set(ctx, key, photoSizesVal{Width: w, Height: h}, a.PhotoSizesCacheTTL)
-			return w, h, true
+	v, err := cache.Fetch(ctx, a.ReadThrough, key, a.cacheOpts(a.PhotoSizesCacheTTL, photoCacheGroup(photoID)), func(ctx context.Context) (photoSizesVal, error) {
+		if a.DB != nil {
+			if _, w, h, found := a.DB.GetPhoto(ctx, photoID); found && w > 0 && h > 0 {
+				return photoSizesVal{Width: w, Height: h}, nil
+			}
+		}
+		var sizes jsonstruct.PhotoSizes
+		if err := flickrGet(ctx, a, map[string]string{"method": "flickr.photos.getSizes", "photo_id": photoID}, &sizes); err != nil {
+			return photoSizesVal{}, err
 		}
+		if w, h, ok := pickPhotoSize(sizes); ok {
+			return photoSizesVal{Width: w, Height: h}, nil
+		}
+		// Not cached, so the next request asks Flickr again.
+		return photoSizesVal{}, errNoPhotoSize
+	})
+	if err != nil || v.Width <= 0 || v.Height <= 0 {
+		return 0, 0, false
 	}
-	sizes := a.Flickr.PhotosGetSizes(photoID)
+	return v.Width, v.Height, true
+}
+
+// pickPhotoSize returns the Large (1024) size, falling back to other common
+// labels and then to the first size with valid dimensions.
+func pickPhotoSize(sizes jsonstruct.PhotoSizes) (width, height int64, ok bool) {
 	preferredLabels := []string{"Large", "Large 1024", "Large 1600", "Medium 800", "Medium 640"}
 	for _, label := range preferredLabels {
 		for _, s := range sizes.Sizes.Size {
@@ -115,7 +125,6 @@ func (a *App) getCachedPhotosGetSizes(photoID string) (width, height int64, ok b
 				w, errW := strconv.ParseInt(string(s.Width), 10, 64)
 				h, errH := strconv.ParseInt(string(s.Height), 10, 64)
 				if errW == nil && errH == nil && w > 0 && h > 0 {
-					_ = a.Cache.Set(ctx, key, photoSizesVal{Width: w, Height: h}, a.PhotoSizesCacheTTL)
 					return w, h, true
 				}
 				break
@@ -127,20 +136,17 @@ func (a *App) getCachedPhotosGetSizes(photoID string) (width, height int64, ok b
 		w, errW := strconv.ParseInt(string(s.Width), 10, 64)
 		h, errH := strconv.ParseInt(string(s.Height), 10, 64)
 		if errW == nil && errH == nil && w > 0 && h > 0 {
-			_ = a.Cache.Set(ctx, key, photoSizesVal{Width: w, Height: h}, a.PhotoSizesCacheTTL)
 			return w, h, true
 		}
 	}
 	return 0, 0, false
 }
 
-func (a *App) getRelatedPhotos(photoID string, tagRaws []string) []jsonstruct.Photo {
+func (a *App) getRelatedPhotos(ctx context.Context, photoID string, tagRaws []string) ([]jsonstruct.Photo, error) {
 	if len(tagRaws) == 0 {
-		return nil
+		return nil, nil
 	}
-	const maxRelated = 12
-	const sameTagLimit = 8
-	const otherTagLimit = 4
+	limits := a.Config.Related
 
 	// 1. Same-tag results
 	args := map[string]string{
@@ -149,17 +155,19 @@ func (a *App) getRelatedPhotos(photoID string, tagRaws []string) []jsonstruct.Ph
 		"sort":     "date-posted-desc",
 		"user_id":  a.UserID,
 	}
+	photos, err := flickrSearch(ctx, a, args)
+	if err != nil {
+		return nil, err
+	}
 	var sameTag []jsonstruct.Photo
-	for _, page := range a.Flickr.PhotosSearch(args) {
-		for _, p := range page.Photos.Photo {
-			if p.ID != photoID && p.Ispublic != 0 {
-				sameTag = append(sameTag, p)
-			}
+	for _, p := range photos {
+		if p.ID != photoID && p.Ispublic != 0 {
+			sameTag = append(sameTag, p)
 		}
 	}
 	rand.Shuffle(len(sameTag), func(i, j int) { sameTag[i], sameTag[j] = sameTag[j], sameTag[i] })
-	if len(sameTag) > sameTagLimit {
-		sameTag = sameTag[:sameTagLimit]
+	if len(sameTag) > limits.SameTag {
+		sameTag = sameTag[:limits.SameTag]
 	}
 
 	// 2. Other tags (from a.Tags, excluding current photo's tags)
@@ -175,7 +183,7 @@ func (a *App) getRelatedPhotos(photoID string, tagRaws []string) []jsonstruct.Ph
 	}
 
 	var otherTag []jsonstruct.Photo
-	if len(otherTags) > 0 {
+	if len(otherTags) > 0 && limits.OtherTag > 0 {
 		var h uint32
 		for _, c := range photoID {
 			h = h*31 + uint32(c)
@@ -191,15 +199,16 @@ func (a *App) getRelatedPhotos(photoID string, tagRaws []string) []jsonstruct.Ph
 		for _, p := range sameTag {
 			seen[p.ID] = true
 		}
-	pageLoop:
-		for _, page := range a.Flickr.PhotosSearch(otherArgs) {
-			for _, p := range page.Photos.Photo {
-				if p.ID != photoID && p.Ispublic != 0 && !seen[p.ID] {
-					otherTag = append(otherTag, p)
-					seen[p.ID] = true
-					if len(otherTag) >= otherTagLimit {
-						break pageLoop
-					}
+		photos, err := flickrSearch(ctx, a, otherArgs)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range photos {
+			if p.ID != photoID && p.Ispublic != 0 && !seen[p.ID] {
+				otherTag = append(otherTag, p)
+				seen[p.ID] = true
+				if len(otherTag) >= limits.OtherTag {
+					break
 				}
 			}
 		}
@@ -208,55 +217,47 @@ func (a *App) getRelatedPhotos(photoID string, tagRaws []string) []jsonstruct.Ph
 	// 3. Merge and shuffle
 	merged := append(sameTag, otherTag...)
 	rand.Shuffle(len(merged), func(i, j int) { merged[i], merged[j] = merged[j], merged[i] })
-	if len(merged) > maxRelated {
-		merged = merged[:maxRelated]
+	if len(merged) > limits.Max {
+		merged = merged[:limits.Max]
 	}
-	return merged
+	return merged, nil
 }
 
 func (a *App) getCachedRelatedPhotos(photoID string, tagRaws []string) []jsonstruct.Photo {
 	ctx := context.Background()
 	key := "related:" + photoID
-	var result []jsonstruct.Photo
-	if ok, _ := a.Cache.Get(ctx, key, &result); ok {
-		return result
-	}
-	if a.DB != nil && len(tagRaws) > 0 {
-		if photos, err := a.DB.GetRelatedPhotos(ctx, photoID, tagRaws, a.Tags, 12); err == nil && len(photos) > 0 {
-			_ = a.Cache.Set(ctx, key, photos, a.RelatedPhotosCacheTTL)
-			return photos
+	result, _ := cache.Fetch(ctx, a.ReadThrough, key, a.cacheOpts(a.RelatedPhotosCacheTTL, photoCacheGroup(photoID)), func(ctx context.Context) ([]jsonstruct.Photo, error) {
+		if a.DB != nil && len(tagRaws) > 0 {
+			if photos, err := a.DB.GetRelatedPhotos(ctx, photoID, tagRaws, a.Tags, db.RelatedLimits{
+				Max:      a.Config.Related.Max,
+				SameTag:  a.Config.Related.SameTag,
+				OtherTag: a.Config.Related.OtherTag,
+			}); err == nil && len(photos) > 0 {
+				return photos, nil
+			}
 		}
-	}
-	result = a.getRelatedPhotos(photoID, tagRaws)
-	_ = a.Cache.Set(ctx, key, result, a.RelatedPhotosCacheTTL)
+		return a.getRelatedPhotos(ctx, photoID, tagRaws)
+	})
 	return result
 }
 
-func (a *App) allPhotos(result *[]jsonstruct.Photo) {
-	args := map[string]string{
-		"sort":     "date-posted-desc",
-		"user_id":  a.UserID,
-	}
-
-	for _, val := range a.Flickr.PhotosSearch(args) {
-		*result = append(*result, val.Photos.Photo...)
-	}
+func (a *App) allPhotos(ctx context.Context) ([]jsonstruct.Photo, error) {
+	return flickrSearch(ctx, a, map[string]string{
+		"sort":    "date-posted-desc",
+		"user_id": a.UserID,
+	})
 }
 
 func (a *App) getCachedAllPhotos() []jsonstruct.Photo {
 	ctx := context.Background()
 	key := "sitemap"
-	var result []jsonstruct.Photo
-	if ok, _ := a.Cache.Get(ctx, key, &result); ok {
-		return result
-	}
-	if a.DB != nil {
-		if photos, err := a.DB.GetAllPhotos(ctx); err == nil && len(photos) > 0 {
-			_ = a.Cache.Set(ctx, key, photos, a.SitemapCacheTTL)
-			return photos
+	result, _ := cache.Fetch(ctx, a.ReadThrough, key, a.cacheOpts(a.SitemapCacheTTL), func(ctx context.Context) ([]jsonstruct.Photo, error) {
+		if a.DB != nil {
+			if photos, err := a.DB.GetAllPhotos(ctx); err == nil && len(photos) > 0 {
+				return photos, nil
+			}
 		}
-	}
-	a.allPhotos(&result)
-	_ = a.Cache.Set(ctx, key, result, a.SitemapCacheTTL)
+		return a.allPhotos(ctx)
+	})
 	return result
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/toomore/lazyflickrgo/jsonstruct"
+	"github.com/toomore/lazyflickrgo/utils"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	flickrAPITimeout = 30 * time.Second
+	// flickrMaxResponse bounds one decoded response; a 500-photo page with
+	// extras is well under 1 MiB.
+	flickrMaxResponse = 16 << 20
+	// flickrSearchConcurrency is how many search pages are fetched at once.
+	flickrSearchConcurrency = 4
+)
+
+// flickrAPI signs and sends Flickr REST calls the way lazyflickrgo's
+// HTTPGet does, with its own http.Client: HTTPGet exits the process on
+// transport errors and caches every response, failed ones included, for 24h.
+// Every call after startup goes through flickrAPI, so a network failure
+// cannot take the web server or its sync scheduler down.
+type flickrAPI struct {
+	Client    *http.Client
+	URL       string
+	apiKey    string
+	secretKey string
+	// authToken (FLICKRUSERTOKEN) is signed into every call, so methods
+	// that honour it see what the account owner sees.
+	authToken string
+}
+
+func newFlickrAPI(apiKey, secretKey, authToken string) *flickrAPI {
+	return &flickrAPI{
+		Client:    &http.Client{Timeout: flickrAPITimeout},
+		URL:       utils.APIURL,
+		apiKey:    apiKey,
+		secretKey: secretKey,
+		authToken: authToken,
+	}
+}
+
+// Get calls a Flickr method and decodes the JSON response into dest. An
+// auth_token in args overrides the configured one.
+// Transport errors and non-200 responses are returned; a stat other than ok
+// is left to the caller.
+func (f *flickrAPI) Get(ctx context.Context, args map[string]string, dest interface{}) error {
+	signed := make(map[string]string, len(args)+5)
+	if f.authToken != "" {
+		signed["auth_token"] = f.authToken
+	}
+	for key, val := range args {
+		signed[key] = val
+	}
+	signed["api_key"] = f.apiKey
+	signed["format"] = "json"
+	signed["nojsoncallback"] = "1"
+	delete(signed, "api_sig")
+	signed["api_sig"] = utils.Sign(signed, f.secretKey)
+	query := url.Values{}
+	for key, val := range signed {
+		query.Set(key, val)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.URL+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		// The URL carries api_key and api_sig; keep them out of logs.
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			return uerr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, flickrMaxResponse))
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, flickrMaxResponse)).Decode(dest)
+}
+
+// flickrGet calls a Flickr method through app.FlickrAPI and decodes the
+// response into dest.
+func flickrGet(ctx context.Context, app *App, args map[string]string, dest interface{}) error {
+	if err := app.FlickrAPI.Get(ctx, args, dest); err != nil {
+		return fmt.Errorf("%s: %w", args["method"], err)
+	}
+	return nil
+}
+
+// flickrSearch returns every page of flickr.photos.search for args, like
+// lazyflickrgo's PhotosSearch, or the first error.
+func flickrSearch(ctx context.Context, app *App, args map[string]string) ([]jsonstruct.Photo, error) {
+	get := func(ctx context.Context, page int) (jsonstruct.PhotosSearch, error) {
+		pageArgs := maps.Clone(args)
+		pageArgs["method"] = "flickr.photos.search"
+		pageArgs["per_page"] = "500"
+		pageArgs["page"] = strconv.Itoa(page)
+		var data jsonstruct.PhotosSearch
+		if err := flickrGet(ctx, app, pageArgs, &data); err != nil {
+			return data, err
+		}
+		if data.Common.Stat != "ok" {
+			return data, &flickrError{Stat: data.Common.Stat, Code: data.Common.Code, Message: data.Common.Message}
+		}
+		return data, nil
+	}
+	first, err := get(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	pages := make([][]jsonstruct.Photo, max(first.Photos.Pages, 1))
+	pages[0] = first.Photos.Photo
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(flickrSearchConcurrency)
+	for i := 1; i < len(pages); i++ {
+		g.Go(func() error {
+			data, err := get(gctx, i+1)
+			pages[i] = data.Photos.Photo
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	var result []jsonstruct.Photo
+	for _, photos := range pages {
+		result = append(result, photos...)
+	}
+	return result, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/toomore/toomorephotos/cache"
+	"github.com/toomore/toomorephotos/db"
+)
+
+const (
+	geoGridCells   = 16  // target cells across the longer side of a bbox
+	geoMaxClusters = 500 // per /api/v1/geo response
+	geoMaxZoomK    = 20  // smallest cell is 360/2^20 degrees (~40 m)
+	nearbyRadiusKm = 10.0
+)
+
+// parseBBox parses "minLon,minLat,maxLon,maxLat". minLon > maxLon is a box
+// crossing the antimeridian.
+func parseBBox(s string) (db.BBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return db.BBox{}, errors.New("bbox must be minLon,minLat,maxLon,maxLat")
+	}
+	var v [4]float64
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return db.BBox{}, fmt.Errorf("bbox: invalid number %q", p)
+		}
+		v[i] = f
+	}
+	box := db.BBox{MinLon: v[0], MinLat: v[1], MaxLon: v[2], MaxLat: v[3], Wrap: v[0] > v[2]}
+	if math.Abs(box.MinLon) > 180 || math.Abs(box.MaxLon) > 180 {
+		return db.BBox{}, errors.New("bbox: longitude out of range")
+	}
+	if box.MinLat < -90 || box.MaxLat > 90 || box.MinLat >= box.MaxLat {
+		return db.BBox{}, errors.New("bbox: latitude out of range")
+	}
+	return box, nil
+}
+
+// geoGrid picks a power-of-two cell size for box and snaps box outwards to
+// whole cells, so panning the map reuses the same clusters and cache keys.
+// A wrapping box whose snapped ends meet or overlap covers every longitude.
+func geoGrid(box db.BBox) (db.BBox, float64) {
+	width := box.MaxLon - box.MinLon
+	if box.Wrap {
+		width += 360
+	}
+	span := math.Max(width, box.MaxLat-box.MinLat)
+	cell := 360.0
+	for k := 0; k < geoMaxZoomK && cell/2 >= span/geoGridCells; k++ {
+		cell /= 2
+	}
+	snap := db.BBox{
+		MinLon: math.Max(-180, math.Floor(box.MinLon/cell)*cell),
+		MinLat: math.Max(-90, math.Floor(box.MinLat/cell)*cell),
+		MaxLon: math.Min(180, math.Ceil(box.MaxLon/cell)*cell),
+		MaxLat: math.Min(90, math.Ceil(box.MaxLat/cell)*cell),
+		Wrap:   box.Wrap,
+	}
+	if snap.Wrap && snap.MinLon <= snap.MaxLon {
+		snap.MinLon, snap.MaxLon, snap.Wrap = -180, 180, false
+	}
+	return snap, cell
+}
+
+// getCachedGeoClusters returns clusters for box. It needs DATABASE_URL:
+// Flickr search results carry no coordinates to cluster on.
+func (a *App) getCachedGeoClusters(box db.BBox) (db.BBox, []db.GeoCluster, error) {
+	ctx := context.Background()
+	box, cell := geoGrid(box)
+	key := fmt.Sprintf("geo:%g:%g,%g,%g,%g", cell, box.MinLon, box.MinLat, box.MaxLon, box.MaxLat)
+	result, err := cache.Fetch(ctx, a.ReadThrough, key, a.cacheOpts(a.IndexCacheTTL), func(ctx context.Context) ([]db.GeoCluster, error) {
+		if a.DB == nil {
+			return nil, errors.New("geo needs DATABASE_URL")
+		}
+		return a.DB.GetGeoClusters(ctx, box, cell, geoMaxClusters)
+	})
+	if err != nil {
+		return box, nil, err
+	}
+	return box, result, nil
+}
+
+// fromGeoSearch finds photos near (lat, lon) through Flickr's radial search.
+func (a *App) fromGeoSearch(ctx context.Context, photoID string, lat, lon float64) ([]db.NearbyPhoto, error) {
+	photos, err := flickrSearch(ctx, a, map[string]string{
+		"lat":          strconv.FormatFloat(lat, 'f', 6, 64),
+		"lon":          strconv.FormatFloat(lon, 'f', 6, 64),
+		"radius":       strconv.FormatFloat(nearbyRadiusKm, 'f', -1, 64),
+		"radius_units": "km",
+		"has_geo":      "1",
+		"user_id":      a.UserID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result []db.NearbyPhoto
+	for _, p := range photos {
+		if p.ID != photoID && p.Ispublic != 0 && len(result) < a.Config.Related.Nearby {
+			result = append(result, db.NearbyPhoto{Photo: p})
+		}
+	}
+	return result, nil
+}
+
+// getCachedNearbyPhotos returns photos within nearbyRadiusKm of the photo,
+// from DB when available, else from Flickr.
+func (a *App) getCachedNearbyPhotos(photoID string, lat, lon float64) []db.NearbyPhoto {
+	ctx := context.Background()
+	key := "nearby:" + photoID
+	result, _ := cache.Fetch(ctx, a.ReadThrough, key, a.cacheOpts(a.RelatedPhotosCacheTTL, photoCacheGroup(photoID)), func(ctx context.Context) ([]db.NearbyPhoto, error) {
+		if a.DB != nil {
+			photos, err := a.DB.GetNearbyPhotos(ctx, photoID, lat, lon, nearbyRadiusKm, a.Config.Related.Nearby)
+			if err == nil {
+				return photos, nil
+			}
+			log.Printf("nearby %s: %v", photoID, err)
+		}
+		return a.fromGeoSearch(ctx, photoID, lat, lon)
+	})
+	return result
+}
+
+// photoLocation parses Flickr's string coordinates. ok is false for photos
+// without a location, which Flickr reports as empty or 0,0.
+func photoLocation(latitude, longitude string) (lat, lon float64, ok bool) {
+	lat, errLat := strconv.ParseFloat(latitude, 64)
+	lon, errLon := strconv.ParseFloat(longitude, 64)
+	if errLat != nil || errLon != nil || (lat == 0 && lon == 0) {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
+
+type apiGeoCluster struct {
+	Latitude  float64         `json:"latitude"`
+	Longitude float64         `json:"longitude"`
+	Count     int             `json:"count"`
+	Photo     apiPhotoSummary `json:"photo"`
+}
+
+type apiGeo struct {
+	BBox     [4]float64      `json:"bbox"`
+	Clusters []apiGeoCluster `json:"clusters"`
+}
+
+func (a *App) apiGeo(w http.ResponseWriter, r *http.Request) {
+	box, err := parseBBox(r.URL.Query().Get("bbox"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	box, clusters, err := a.getCachedGeoClusters(box)
+	if err != nil {
+		log.Printf("geo %v: %v", box, err)
+		writeAPIError(w, http.StatusServiceUnavailable, "geo search unavailable")
+		return
+	}
+	result := apiGeo{
+		BBox:     [4]float64{box.MinLon, box.MinLat, box.MaxLon, box.MaxLat},
+		Clusters: make([]apiGeoCluster, 0, len(clusters)),
+	}
+	for _, c := range clusters {
+		result.Clusters = append(result.Clusters, apiGeoCluster{
+			Latitude:  c.Latitude,
+			Longitude: c.Longitude,
+			Count:     c.Count,
+			Photo:     a.newAPIPhotoSummary(c.Photo),
+		})
+	}
+	writeAPIJSON(w, r, result, 600)
+}
+
+// mapPage renders /map, which browses photos through /api/v1/geo.
+func (a *App) mapPage(w http.ResponseWriter, r *http.Request) {
+	logs(r, "")
+	if a.DB == nil {
+		a.notFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "max-age=3600")
+	data := struct {
+		TileURL         string
+		TileAttribution string
+	}{a.MapTileURL, a.MapTileAttribution}
+	if err := a.TplMap.Execute(w, data); err != nil {
+		log.Printf("template execute error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/toomore/toomorephotos/db"
+)
+
+func TestParseBBox(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    db.BBox
+		wantErr bool
+	}{
+		{in: "121.4,24.9,121.7,25.2", want: db.BBox{MinLon: 121.4, MinLat: 24.9, MaxLon: 121.7, MaxLat: 25.2}},
+		{in: " -180 , -90 , 180 , 90 ", want: db.BBox{MinLon: -180, MinLat: -90, MaxLon: 180, MaxLat: 90}},
+		{in: "170,-10,-170,10", want: db.BBox{MinLon: 170, MinLat: -10, MaxLon: -170, MaxLat: 10, Wrap: true}},
+		{in: "121,25,122", wantErr: true},
+		{in: "121,25,122,26,1", wantErr: true},
+		{in: "a,25,122,26", wantErr: true},
+		{in: "NaN,25,122,26", wantErr: true},
+		{in: "121,25,Inf,26", wantErr: true},
+		{in: "181,25,122,26", wantErr: true},
+		{in: "121,-91,122,26", wantErr: true},
+		{in: "121,26,122,25", wantErr: true},
+		{in: "121,25,122,25", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseBBox(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseBBox(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseBBox(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestGeoGrid(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       db.BBox
+		want     db.BBox
+		wantCell float64
+	}{
+		{
+			name:     "city",
+			in:       db.BBox{MinLon: 121.4, MinLat: 24.9, MaxLon: 121.7, MaxLat: 25.2},
+			want:     db.BBox{MinLon: 121.39892578125, MinLat: 24.89501953125, MaxLon: 121.70654296875, MaxLat: 25.20263671875},
+			wantCell: 360.0 / (1 << 14),
+		},
+		{
+			name:     "world",
+			in:       db.BBox{MinLon: -180, MinLat: -90, MaxLon: 180, MaxLat: 90},
+			want:     db.BBox{MinLon: -180, MinLat: -90, MaxLon: 180, MaxLat: 90},
+			wantCell: 22.5,
+		},
+		{
+			name:     "across the antimeridian",
+			in:       db.BBox{MinLon: 170, MinLat: -10, MaxLon: -170, MaxLat: 10, Wrap: true},
+			want:     db.BBox{MinLon: 168.75, MinLat: -11.25, MaxLon: -168.75, MaxLat: 11.25, Wrap: true},
+			wantCell: 1.40625,
+		},
+		{
+			// Snapping to 0..22.5 must not turn almost the whole world
+			// into a narrow strip.
+			name:     "wrapping ends meet after snapping",
+			in:       db.BBox{MinLon: 10, MinLat: -80, MaxLon: 5, MaxLat: 80, Wrap: true},
+			want:     db.BBox{MinLon: -180, MinLat: -90, MaxLon: 180, MaxLat: 90},
+			wantCell: 22.5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, cell := geoGrid(tt.in)
+			if got != tt.want || cell != tt.wantCell {
+				t.Errorf("geoGrid = %+v, %g; want %+v, %g", got, cell, tt.want, tt.wantCell)
+			}
+		})
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"crypto/md5"
 	"fmt"
-	"hash"
 	"io"
 	"log"
 	"math"
@@ -13,6 +12,7 @@ import (
 	"time"
 
 	"github.com/toomore/lazyflickrgo/jsonstruct"
+	"github.com/toomore/toomorephotos/db"
 )
 
 func logs(r *http.Request, note string) {
@@ -76,13 +76,19 @@ func (a *App) index(w http.ResponseWriter, r *http.Request) {
 				featuredWidth, featuredHeight = w, h
 			}
 		}
+		more := len(result) > tagPageSize
+		if more {
+			result = result[:tagPageSize]
+		}
 		data := struct {
+			Tag            string
 			R              []jsonstruct.Photo
 			L              []jsonstruct.Photo
+			More           bool
 			Featured       *jsonstruct.Photo
 			FeaturedWidth  int64
 			FeaturedHeight int64
-		}{result, result[:min], featured, featuredWidth, featuredHeight}
+		}{a.Tags[modValue], result, result[:min], more, featured, featuredWidth, featuredHeight}
 		if err := a.TplIndex.Execute(w, data); err != nil {
 			log.Printf("template execute error: %v", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -103,68 +109,71 @@ func (a *App) photo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	photoinfo := a.getCachedPhotosGetInfo(photono)
-
-	var etaghex hash.Hash
-	var etagStr string
-	if photoinfo.Common.Stat == "ok" {
-		etaghex = md5.New()
-		io.WriteString(etaghex, photoinfo.Photo.Title.Content)
-		io.WriteString(etaghex, photoinfo.Photo.Description.Content)
-		etagStr = fmt.Sprintf("W/\"%x\"", etaghex.Sum(nil))
-	} else {
+	if photoinfo.Common.Stat != "ok" || photoinfo.Photo.Owner.Nsid != a.UserID {
 		a.notFound(w, r)
 		return
 	}
 
-	if photoinfo.Photo.Owner.Nsid != a.UserID {
-		a.notFound(w, r)
-		return
+	width, height := int64(0), int64(0)
+	if w, h, ok := a.getCachedPhotosGetSizes(photono); ok {
+		width, height = w, h
+	}
+	paddingBottomPercent := 75.0 // 4:3 fallback
+	if width > 0 && height > 0 {
+		paddingBottomPercent = float64(height) / float64(width) * 100
+	}
+	var tagRaws []string
+	for _, t := range photoinfo.Photo.Tags.Tag {
+		tagRaws = append(tagRaws, t.Raw)
+	}
+	relatedPhotos := a.getCachedRelatedPhotos(photono, tagRaws)
+	var exif *db.PhotoExif
+	if e, ok := a.getCachedPhotoExif(photono); ok {
+		exif = &e
+	}
+	var nearbyPhotos []db.NearbyPhoto
+	if lat, lon, ok := photoLocation(photoinfo.Photo.Location.Latitude, photoinfo.Photo.Location.Longitude); ok {
+		nearbyPhotos = a.getCachedNearbyPhotos(photono, lat, lon)
 	}
 
-	if r.Header.Get("If-None-Match") == etagStr {
-		logs(r, "[304]")
-		w.WriteHeader(http.StatusNotModified)
-	} else {
-		w.Header().Set("ETag", etagStr)
-		width, height := int64(0), int64(0)
-		if w, h, ok := a.getCachedPhotosGetSizes(photono); ok {
-			width, height = w, h
-		}
-		paddingBottomPercent := 75.0 // 4:3 fallback
-		if width > 0 && height > 0 {
-			paddingBottomPercent = float64(height) / float64(width) * 100
-		}
-		var tagRaws []string
-		for _, t := range photoinfo.Photo.Tags.Tag {
-			tagRaws = append(tagRaws, t.Raw)
-		}
-		relatedPhotos := a.getCachedRelatedPhotos(photono, tagRaws)
-		data := struct {
-			Photo                 interface{}
-			Width                 int64
-			Height                int64
-			PaddingBottomPercent  float64
-			RelatedPhotos         []jsonstruct.Photo
-			MapboxToken           string
-		}{photoinfo.Photo, width, height, paddingBottomPercent, relatedPhotos, a.MapboxToken}
-		if err := a.TplPhoto.Execute(w, data); err != nil {
-			log.Printf("template execute error: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	// The weak ETag covers everything the page renders besides the
+	// templates, which change only with a deploy.
+	etaghex := md5.New()
+	io.WriteString(etaghex, photoinfo.Photo.Title.Content)
+	io.WriteString(etaghex, photoinfo.Photo.Description.Content)
+	io.WriteString(etaghex, photoinfo.Photo.Dates.Lastupdate)
+	fmt.Fprintf(etaghex, "|%dx%d|%t", width, height, a.MapProvider != nil)
+	if exif != nil {
+		fmt.Fprintf(etaghex, "|%s|%s|%s|%g|%g|%s|%d", exif.Make, exif.Model, exif.Lens, exif.FocalLength, exif.Aperture, exif.Shutter, exif.ISO)
+		if exif.CapturedAt != nil {
+			io.WriteString(etaghex, exif.CapturedAt.UTC().Format(time.RFC3339))
 		}
 	}
-}
+	for _, p := range relatedPhotos {
+		io.WriteString(etaghex, "|r"+p.ID)
+	}
+	for _, p := range nearbyPhotos {
+		io.WriteString(etaghex, "|n"+p.Photo.ID)
+	}
+	etagStr := fmt.Sprintf("W/\"%x\"", etaghex.Sum(nil))
 
-func (a *App) sitemap(w http.ResponseWriter, r *http.Request) {
-	result := a.getCachedAllPhotos()
-	tags := make([]int, len(a.Tags))
-	for i := range a.Tags {
-		tags[i] = i
+	if r.Header.Get("If-None-Match") == etagStr {
+		logs(r, "[304]")
+		w.WriteHeader(http.StatusNotModified)
+		return
 	}
+	w.Header().Set("ETag", etagStr)
 	data := struct {
-		R []jsonstruct.Photo
-		T []int
-	}{result, tags}
-	if err := a.TplSitemap.Execute(w, data); err != nil {
+		Photo                interface{}
+		Width                int64
+		Height               int64
+		PaddingBottomPercent float64
+		RelatedPhotos        []jsonstruct.Photo
+		NearbyPhotos         []db.NearbyPhoto
+		Exif                 *db.PhotoExif
+		ShowMap              bool
+	}{photoinfo.Photo, width, height, paddingBottomPercent, relatedPhotos, nearbyPhotos, exif, a.MapProvider != nil}
+	if err := a.TplPhoto.Execute(w, data); err != nil {
 		log.Printf("template execute error: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 	}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	defaultImageUpstream = "https://live.staticflickr.com"
+	imageCacheControl    = "public, max-age=31536000, immutable"
+)
+
+// imagePathExpr matches /f/{size}/{farm}/{server}/{secret}/{id}.jpg.
+// size is optional: feed.go links /f/{farm}/... for Flickr's default size.
+var imagePathExpr = regexp.MustCompile(`^/f/(?:([a-z]|[3-6]k)/)?([0-9]+)/([0-9]+)/([0-9a-f]+)/([0-9]+)\.jpg$`)
+
+var imageClient = &http.Client{Timeout: 30 * time.Second}
+
+type imageRef struct {
+	Size   string
+	Farm   string
+	Server string
+	Secret string
+	ID     string
+}
+
+func parseImagePath(path string) (imageRef, bool) {
+	m := imagePathExpr.FindStringSubmatch(path)
+	if m == nil {
+		return imageRef{}, false
+	}
+	return imageRef{Size: m[1], Farm: m[2], Server: m[3], Secret: m[4], ID: m[5]}, true
+}
+
+// key is the cache key; Flickr never changes the bytes behind a secret.
+func (ref imageRef) key() string {
+	return fmt.Sprintf("%s/%s/%s/%s/%s", ref.Size, ref.Farm, ref.Server, ref.Secret, ref.ID)
+}
+
+// upstreamURL builds the static image URL. {farm} in upstream is replaced
+// with the farm number, e.g. https://farm{farm}.staticflickr.com.
+func (ref imageRef) upstreamURL(upstream string) string {
+	base := strings.TrimRight(strings.Replace(upstream, "{farm}", ref.Farm, -1), "/")
+	suffix := ""
+	if ref.Size != "" {
+		suffix = "_" + ref.Size
+	}
+	return fmt.Sprintf("%s/%s/%s_%s%s.jpg", base, ref.Server, ref.ID, ref.Secret, suffix)
+}
+
+// image serves /f/ paths from the disk cache, fetching from upstream on miss.
+func (a *App) image(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ref, ok := parseImagePath(r.URL.Path)
+	if !ok {
+		a.notFound(w, r)
+		return
+	}
+	key := ref.key()
+
+	f, obj, hit := a.ImageCache.Open(key)
+	if !hit {
+		logs(r, "[image miss]")
+		status, err, _ := a.imageFetches.Do(key, func() (interface{}, error) {
+			return a.fetchImage(ref)
+		})
+		if err != nil {
+			log.Printf("image fetch %s: %v", ref.upstreamURL(a.ImageUpstream), err)
+			if status == http.StatusNotFound {
+				a.notFound(w, r)
+			} else {
+				http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			}
+			return
+		}
+		if f, obj, hit = a.ImageCache.Open(key); !hit {
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", imageCacheControl)
+	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", obj.Name[:32]))
+	http.ServeContent(w, r, "", obj.ModTime, f)
+}
+
+// fetchImage downloads ref from upstream into the disk cache.
+// status is the upstream HTTP status when the request got a response.
+func (a *App) fetchImage(ref imageRef) (int, error) {
+	resp, err := imageClient.Get(ref.upstreamURL(a.ImageUpstream))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, fmt.Errorf("upstream status %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "image/") {
+		return resp.StatusCode, fmt.Errorf("upstream content-type %q", ct)
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if _, err := a.ImageCache.Put(ref.key(), resp.Body, modTime); err != nil {
+		return resp.StatusCode, err
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/toomore/toomorephotos/cache"
+)
+
+func TestParseImagePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want imageRef
+		ok   bool
+	}{
+		{"/f/b/66/65535/abcdef12/53000000001.jpg", imageRef{Size: "b", Farm: "66", Server: "65535", Secret: "abcdef12", ID: "53000000001"}, true},
+		{"/f/3k/66/65535/abcdef12/53000000001.jpg", imageRef{Size: "3k", Farm: "66", Server: "65535", Secret: "abcdef12", ID: "53000000001"}, true},
+		{"/f/66/65535/abcdef12/53000000001.jpg", imageRef{Farm: "66", Server: "65535", Secret: "abcdef12", ID: "53000000001"}, true},
+		{"/f/7k/66/65535/abcdef12/53000000001.jpg", imageRef{}, false},
+		{"/f/B/66/65535/abcdef12/53000000001.jpg", imageRef{}, false},
+		{"/f/b/66/65535/ABCDEF12/53000000001.jpg", imageRef{}, false},
+		{"/f/b/66/65535/abcdef12/53000000001.png", imageRef{}, false},
+		{"/f/b/66/65535/../53000000001.jpg", imageRef{}, false},
+		{"/f/b/66/65535/abcdef12/53000000001.jpg/x", imageRef{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseImagePath(tt.path)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("parseImagePath(%q) = %+v, %v, want %+v, %v", tt.path, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestImageRefUpstreamURL(t *testing.T) {
+	ref := imageRef{Size: "b", Farm: "66", Server: "65535", Secret: "abcdef12", ID: "53000000001"}
+	if got, want := ref.upstreamURL("https://farm{farm}.staticflickr.com/"), "https://farm66.staticflickr.com/65535/53000000001_abcdef12_b.jpg"; got != want {
+		t.Errorf("upstreamURL = %q, want %q", got, want)
+	}
+	ref.Size = ""
+	if got, want := ref.upstreamURL(defaultImageUpstream), "https://live.staticflickr.com/65535/53000000001_abcdef12.jpg"; got != want {
+		t.Errorf("upstreamURL = %q, want %q", got, want)
+	}
+}
+
+const testImagePath = "/f/b/66/65535/abcdef12/53000000001.jpg"
+
+var testImageModified = time.Date(2026, 10, 1, 8, 30, 0, 0, time.UTC)
+
+// newTestImageApp serves images from upstream into a fresh disk cache.
+func newTestImageApp(t *testing.T, upstream http.HandlerFunc) (*App, *atomic.Int32) {
+	t.Helper()
+	hits := new(atomic.Int32)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		upstream(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	dc, err := cache.NewDiskCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &App{ImageCache: dc, ImageUpstream: srv.URL}, hits
+}
+
+func serveTestJPEG(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/65535/53000000001_abcdef12_b.jpg" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Last-Modified", testImageModified.Format(http.TimeFormat))
+	w.Write([]byte("jpeg"))
+}
+
+func getImage(a *App, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, testImagePath, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	a.image(w, req)
+	return w
+}
+
+func TestImageProxy(t *testing.T) {
+	a, hits := newTestImageApp(t, serveTestJPEG)
+
+	w := getImage(a, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "jpeg" {
+		t.Fatalf("GET = %d %q", w.Code, w.Body.String())
+	}
+	etag := `"` + a.ImageCache.Name("b/66/65535/abcdef12/53000000001")[:32] + `"`
+	for name, want := range map[string]string{
+		"Content-Type":  "image/jpeg",
+		"Cache-Control": "public, max-age=31536000, immutable",
+		"ETag":          etag,
+		"Last-Modified": testImageModified.Format(http.TimeFormat),
+	} {
+		if got := w.Header().Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	for _, h := range []http.Header{
+		{"If-None-Match": {etag}},
+		{"If-Modified-Since": {testImageModified.Format(http.TimeFormat)}},
+	} {
+		if w := getImage(a, h); w.Code != http.StatusNotModified {
+			t.Errorf("GET with %v = %d, want 304", h, w.Code)
+		}
+	}
+	if w := getImage(a, http.Header{"If-None-Match": {`"other"`}}); w.Code != http.StatusOK {
+		t.Errorf("GET with another ETag = %d, want 200", w.Code)
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("upstream hit %d times, want 1", got)
+	}
+}
+
+func TestImageProxyUpstreamErrors(t *testing.T) {
+	tests := []struct {
+		upstream http.HandlerFunc
+		want     int
+	}{
+		{http.NotFound, http.StatusNotFound},
+		{func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) }, http.StatusBadGateway},
+		{func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html>"))
+		}, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		a, _ := newTestImageApp(t, tt.upstream)
+		if w := getImage(a, nil); w.Code != tt.want {
+			t.Errorf("GET = %d, want %d", w.Code, tt.want)
+		}
+		if n, _ := a.ImageCache.Size(); n != 0 {
+			t.Errorf("failed fetch cached %d bytes", n)
+		}
+	}
+}
+
+func TestImageProxyCoalescesMisses(t *testing.T) {
+	release := make(chan struct{})
+	a, hits := newTestImageApp(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		serveTestJPEG(w, r)
+	})
+
+	const n = 10
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for range n {
+		go func() {
+			defer wg.Done()
+			if w := getImage(a, nil); w.Code != http.StatusOK || w.Body.String() != "jpeg" {
+				t.Errorf("GET = %d %q", w.Code, w.Body.String())
+			}
+		}()
+	}
+	// Let every request miss and join the fetch before it completes.
+	for hits.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if got := hits.Load(); got != 1 {
+		t.Errorf("upstream hit %d times, want 1", got)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// JSON Feed 1.1, https://www.jsonfeed.org/version/1.1/
+type jsonFeedDoc struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	HomePageURL string           `json:"home_page_url"`
+	FeedURL     string           `json:"feed_url"`
+	Description string           `json:"description,omitempty"`
+	Language    string           `json:"language"`
+	Authors     []jsonFeedAuthor `json:"authors"`
+	Hubs        []jsonFeedHub    `json:"hubs,omitempty"`
+	Items       []jsonFeedItem   `json:"items"`
+}
+
+type jsonFeedHub struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+	URL  string `json:"url,omitempty"`
+}
+
+type jsonFeedItem struct {
+	ID            string   `json:"id"`
+	URL           string   `json:"url"`
+	Title         string   `json:"title"`
+	ContentHTML   string   `json:"content_html"`
+	Image         string   `json:"image,omitempty"`
+	DatePublished string   `json:"date_published"`
+	Tags          []string `json:"tags,omitempty"`
+}
+
+func newJSONFeed(feed *photoFeed, self, authorURL string, hubs []string) jsonFeedDoc {
+	doc := jsonFeedDoc{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       feed.Title,
+		FeedURL:     self,
+		Description: feed.Description,
+		Language:    "zh",
+		Authors:     []jsonFeedAuthor{{Name: feed.Author.Name, URL: authorURL}},
+		Items:       make([]jsonFeedItem, 0, len(feed.Items)),
+	}
+	if feed.Link != nil {
+		doc.HomePageURL = feed.Link.Href
+	}
+	for _, hub := range hubs {
+		doc.Hubs = append(doc.Hubs, jsonFeedHub{Type: "WebSub", URL: hub})
+	}
+	for i, item := range feed.Items {
+		v := jsonFeedItem{
+			ID:            item.Id,
+			URL:           item.Link.Href,
+			Title:         item.Title,
+			ContentHTML:   item.Description,
+			DatePublished: item.Updated.UTC().Format(time.RFC3339),
+		}
+		if photo := feed.photo(i); photo != nil {
+			v.Image = photo.Image
+			v.Tags = photo.Tags
+		}
+		doc.Items = append(doc.Items, v)
+	}
+	return doc
+}
+
+func (a *App) writeJSONFeed(w http.ResponseWriter, r *http.Request, feed *photoFeed, self string) {
+	body, err := json.Marshal(newJSONFeed(feed, self, a.Config.Site.Author.URL, a.hubURLs()))
+	if err != nil {
+		log.Printf("json feed error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeConditional(w, r, "application/feed+json; charset=utf-8", feed.modifiedAt(), body, feedMaxAge)
+}
@@ -1,18 +1,39 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var (
-	httpPort = flag.String("p", ":8080", "HTTP port")
-	doSync   = flag.Bool("sync", false, "執行 sync：從 Flickr 取得照片 metadata 寫入 DB 後退出")
+	httpPort    = flag.String("p", ":8080", "HTTP port")
+	doSync      = flag.Bool("sync", false, "執行 sync：從 Flickr 取得照片 metadata 寫入 DB 後退出（預設只同步上次 sync 後更新的照片）")
+	syncFull    = flag.Bool("sync-full", false, "搭配 -sync：完整同步所有照片")
+	syncSince   = flag.String("sync-since", "", "搭配 -sync：只同步此時間後更新的照片 (RFC3339、YYYY-MM-DD 或 duration 如 72h)")
+	syncPrune   = flag.String("sync-prune", "dry-run", "搭配 -sync：處理已刪除或非公開的照片 off|dry-run|soft|hide|hard")
+	syncRestart = flag.Bool("sync-restart", false, "搭配 -sync：放棄中斷的 sync，重新開始")
+	syncWorkerN = flag.Int("sync-workers", syncWorkers, "搭配 -sync：同時抓取的 worker 數")
+	syncRate    = flag.Float64("sync-rate", syncRatePerSec, "搭配 -sync：每秒 Flickr API 呼叫上限（所有 worker 共用）")
+	syncEvery   = flag.Duration("sync-interval", 0, "web server 內每隔此時間自動 sync（例如 1h），0 表示停用；多個 instance 以 lock 確保只有一個執行")
+	migrateCmd  = flag.String("migrate", "", "執行 DB migration 後退出：up 套用全部、down 回復最後一個、status 列出狀態")
+	purgeCache  = flag.String("purge", "", "清除快取後退出，以逗號分隔：photo:{id}、tag:{tag}、sitemap、feed、prefix:{p}")
 )
 
 func main() {
 	flag.Parse()
+	if *migrateCmd != "" {
+		if err := runMigrate(context.Background(), *migrateCmd); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	app, err := NewApp()
 	if err != nil {
 		log.Fatal(err)
@@ -23,26 +44,82 @@ func main() {
 		}
 	}()
 
+	if *purgeCache != "" {
+		if err := app.runPurge(context.Background(), *purgeCache); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	prune, err := parsePruneMode(*syncPrune)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := syncOptions{
+		Full:    *syncFull,
+		Prune:   prune,
+		Workers: *syncWorkerN,
+		Rate:    *syncRate,
+	}
+
 	if *doSync {
-		if err := runSync(app); err != nil {
+		if opts.Since, err = parseSyncSince(*syncSince, time.Now()); err != nil {
+			log.Fatal(err)
+		}
+		opts.Restart = *syncRestart
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if app.DB == nil {
+			log.Fatal("sync 需要 DATABASE_URL，請設定環境變數")
+		}
+		if err := app.lockedSync(ctx, opts); err != nil {
 			log.Fatal(err)
 		}
 		return
 	}
 
+	if *syncEvery > 0 {
+		if app.DB == nil {
+			log.Fatal("-sync-interval 需要 DATABASE_URL，請設定環境變數")
+		}
+		app.Scheduler = newSyncScheduler(app, *syncEvery, opts)
+		app.Scheduler.Start(context.Background())
+	}
+
 	http.HandleFunc("/", app.index)
 	http.HandleFunc("/p/", app.photo)
-	http.HandleFunc("/sitemap/", app.sitemap)
+	http.HandleFunc("/t/", app.tag)
+	http.HandleFunc("/tags", app.tags)
+	http.HandleFunc("/a/", app.album)
+	http.HandleFunc("/map", app.mapPage)
+	http.HandleFunc("/camera/", app.camera)
+	http.HandleFunc("/lens/", app.lens)
+	http.HandleFunc("/search", app.search)
+	http.HandleFunc("/search.json", app.searchJSON)
+	http.Handle("/api/v1/", app.apiHandler())
+	http.HandleFunc("/f/", app.image)
+	http.HandleFunc("/maps/", app.maps)
+	http.HandleFunc("/sitemap.xml", app.sitemapXML)
+	http.HandleFunc("/sitemap/", app.sitemapShardHandler)
 	http.HandleFunc("/rss", app.rss)
 	http.HandleFunc("/atom", app.atom)
+	http.HandleFunc("/feed.json", app.jsonFeed)
 	http.HandleFunc("/fr", app.notFound)
 	http.HandleFunc("/health", app.health)
+	http.HandleFunc("/cache/status", app.cacheStatusHandler)
+	if app.WebSubBuiltinHub {
+		http.HandleFunc(webSubPath, app.webSubHub)
+	}
+	if app.AdminToken != "" {
+		http.HandleFunc(adminPurgePath, app.adminPurge)
+		http.HandleFunc("/sync/status", app.syncStatusHandler)
+	}
 
 	app.serveSingle("/favicon.ico", "favicon.ico")
 	app.serveSingle("/jquery.unveil.min.js", "jquery.unveil.min.js")
 	app.serveSingle("/base_min.css", "base_min.css")
 	app.serveSingle("/base_photo_min.css", "base_photo_min.css")
-	app.serveSingle("/robots.txt", "robots.txt")
+	http.HandleFunc("/robots.txt", app.robots)
 
 	log.Println("HTTP Port:", *httpPort)
 	log.Println(http.ListenAndServe(*httpPort, nil))
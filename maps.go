@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toomore/toomorephotos/cache"
+)
+
+const (
+	maxMapSize     = 1280
+	maxMapZoom     = 22
+	maxMercatorLat = 85.0511
+)
+
+// mapPathExpr matches /maps/{lon},{lat},{zoom},{bearing}/{width}x{height}.
+var mapPathExpr = regexp.MustCompile(`^/maps/(-?[0-9.]+),(-?[0-9.]+),([0-9]+),([0-9]+)/([0-9]+)x([0-9]+)$`)
+
+var errMapNotFound = errors.New("map not found")
+
+// mapNotFoundTTL is how long a map the provider does not have is
+// remembered, so repeated requests for it do not spend the provider quota.
+const mapNotFoundTTL = time.Hour
+
+// MapRequest is a validated static map request.
+type MapRequest struct {
+	Lon, Lat      float64
+	Zoom, Bearing int
+	Width, Height int
+}
+
+func (m MapRequest) String() string {
+	return fmt.Sprintf("%s,%s,%d,%d/%dx%d",
+		strconv.FormatFloat(m.Lon, 'f', 6, 64), strconv.FormatFloat(m.Lat, 'f', 6, 64),
+		m.Zoom, m.Bearing, m.Width, m.Height)
+}
+
+// MapImage is a rendered static map as stored in the cache.
+type MapImage struct {
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"`
+	// NotFound marks the negative entry of a map the provider does not have.
+	NotFound bool `json:"not_found,omitempty"`
+}
+
+// MapProvider renders static map images.
+// Implementations must not leak credentials in returned errors.
+type MapProvider interface {
+	Name() string
+	StaticMap(ctx context.Context, req MapRequest) (MapImage, error)
+}
+
+func parseMapPath(path string) (MapRequest, error) {
+	m := mapPathExpr.FindStringSubmatch(path)
+	if m == nil {
+		return MapRequest{}, errors.New("malformed map path")
+	}
+	var req MapRequest
+	var err error
+	if req.Lon, err = strconv.ParseFloat(m[1], 64); err != nil || req.Lon < -180 || req.Lon > 180 {
+		return MapRequest{}, errors.New("longitude out of range")
+	}
+	if req.Lat, err = strconv.ParseFloat(m[2], 64); err != nil || req.Lat < -maxMercatorLat || req.Lat > maxMercatorLat {
+		return MapRequest{}, errors.New("latitude out of range")
+	}
+	if req.Zoom, err = strconv.Atoi(m[3]); err != nil || req.Zoom > maxMapZoom {
+		return MapRequest{}, errors.New("zoom out of range")
+	}
+	if req.Bearing, err = strconv.Atoi(m[4]); err != nil || req.Bearing >= 360 {
+		return MapRequest{}, errors.New("bearing out of range")
+	}
+	req.Width, err = strconv.Atoi(m[5])
+	if err != nil || req.Width < 1 || req.Width > maxMapSize {
+		return MapRequest{}, errors.New("width out of range")
+	}
+	req.Height, err = strconv.Atoi(m[6])
+	if err != nil || req.Height < 1 || req.Height > maxMapSize {
+		return MapRequest{}, errors.New("height out of range")
+	}
+	return req, nil
+}
+
+// MapboxProvider fetches images from the Mapbox Static Images API.
+type MapboxProvider struct {
+	BaseURL string // default https://api.mapbox.com
+	Style   string // default mapbox/streets-v12
+	Token   string
+	Client  *http.Client
+}
+
+// NewMapboxProvider returns a MapboxProvider with default endpoint and style.
+func NewMapboxProvider(token string) *MapboxProvider {
+	return &MapboxProvider{
+		BaseURL: "https://api.mapbox.com",
+		Style:   "mapbox/streets-v12",
+		Token:   token,
+		Client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *MapboxProvider) Name() string { return "mapbox" }
+
+func (p *MapboxProvider) StaticMap(ctx context.Context, req MapRequest) (MapImage, error) {
+	u := fmt.Sprintf("%s/styles/v1/%s/static/%s?access_token=%s",
+		strings.TrimRight(p.BaseURL, "/"), p.Style, req.String(), url.QueryEscape(p.Token))
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return MapImage{}, errors.New("mapbox: build request failed")
+	}
+	resp, err := p.Client.Do(hreq)
+	if err != nil {
+		// url.Error carries the full URL including access_token.
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return MapImage{}, fmt.Errorf("mapbox: %v", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusUnprocessableEntity:
+		io.Copy(io.Discard, resp.Body)
+		return MapImage{}, errMapNotFound
+	case resp.StatusCode != http.StatusOK:
+		io.Copy(io.Discard, resp.Body)
+		return MapImage{}, fmt.Errorf("mapbox: status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 5<<20))
+	if err != nil {
+		return MapImage{}, fmt.Errorf("mapbox: read body: %v", err)
+	}
+	ct := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(ct, "image/") {
+		return MapImage{}, fmt.Errorf("mapbox: unexpected content-type %q", ct)
+	}
+	return MapImage{ContentType: ct, Data: data}, nil
+}
+
+// getCachedMap returns the map of req. errMapNotFound is cached for
+// mapNotFoundTTL under its own key.
+func (a *App) getCachedMap(ctx context.Context, req MapRequest) (MapImage, error) {
+	key := "map:" + a.MapProvider.Name() + ":" + req.String()
+	notFoundKey := key + ":404"
+	var miss MapImage
+	if ok, err := a.Cache.Get(ctx, notFoundKey, &miss); err == nil && ok && miss.NotFound {
+		return MapImage{}, errMapNotFound
+	}
+	img, err := cache.Fetch(ctx, a.ReadThrough, key, a.cacheOpts(a.MapCacheTTL), func(ctx context.Context) (MapImage, error) {
+		return a.MapProvider.StaticMap(ctx, req)
+	})
+	if errors.Is(err, errMapNotFound) {
+		if err := a.Cache.Set(ctx, notFoundKey, MapImage{NotFound: true}, mapNotFoundTTL); err != nil {
+			log.Printf("map %s: %v", req, err)
+		}
+	}
+	if err != nil {
+		return MapImage{}, err
+	}
+	return img, nil
+}
+
+// maps serves static map images for photo locations.
+func (a *App) maps(w http.ResponseWriter, r *http.Request) {
+	if a.MapProvider == nil {
+		a.notFound(w, r)
+		return
+	}
+	req, err := parseMapPath(r.URL.Path)
+	if err != nil {
+		logs(r, "[map] "+err.Error())
+		http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	etagStr := fmt.Sprintf("\"%s-%s\"", a.MapProvider.Name(), strings.NewReplacer(",", "-", "/", "-").Replace(req.String()))
+	if r.Header.Get("If-None-Match") == etagStr {
+		logs(r, "[304]")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	img, err := a.getCachedMap(r.Context(), req)
+	if errors.Is(err, errMapNotFound) {
+		a.notFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("map %s: %v", req, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", img.ContentType)
+	w.Header().Set("ETag", etagStr)
+	w.Header().Set("Cache-Control", "public, max-age=2592000")
+	w.Write(img.Data)
+}
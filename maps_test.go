@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/toomore/toomorephotos/cache"
+)
+
+const testMapboxToken = "pk.secret-test-token"
+
+var testMapRequest = MapRequest{Lon: 121.5, Lat: 25.04, Zoom: 14, Width: 600, Height: 300}
+
+func newTestMapbox(t *testing.T, h http.HandlerFunc) *MapboxProvider {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	p := NewMapboxProvider(testMapboxToken)
+	p.BaseURL = srv.URL
+	return p
+}
+
+func TestMapboxStaticMap(t *testing.T) {
+	png := []byte("\x89PNG fake")
+	p := newTestMapbox(t, func(w http.ResponseWriter, r *http.Request) {
+		want := "/styles/v1/mapbox/streets-v12/static/121.500000,25.040000,14,0/600x300"
+		if r.URL.Path != want {
+			t.Errorf("path = %s, want %s", r.URL.Path, want)
+		}
+		if got := r.URL.Query().Get("access_token"); got != testMapboxToken {
+			t.Errorf("access_token = %q", got)
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	})
+
+	img, err := p.StaticMap(context.Background(), testMapRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.ContentType != "image/png" || !bytes.Equal(img.Data, png) {
+		t.Errorf("got %q %q", img.ContentType, img.Data)
+	}
+}
+
+func TestMapboxStaticMapErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		notFound    bool
+	}{
+		{"not found", http.StatusNotFound, "application/json", true},
+		{"unprocessable", http.StatusUnprocessableEntity, "application/json", true},
+		{"unauthorized", http.StatusUnauthorized, "application/json", false},
+		{"server error", http.StatusInternalServerError, "text/plain", false},
+		{"not an image", http.StatusOK, "text/html", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestMapbox(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(tt.status)
+				// Mapbox echoes the request in some error bodies.
+				w.Write([]byte(r.URL.String()))
+			})
+			_, err := p.StaticMap(context.Background(), testMapRequest)
+			if err == nil {
+				t.Fatal("want error")
+			}
+			if got := errors.Is(err, errMapNotFound); got != tt.notFound {
+				t.Errorf("errMapNotFound = %v, want %v (%v)", got, tt.notFound, err)
+			}
+			if strings.Contains(err.Error(), testMapboxToken) {
+				t.Errorf("error leaks token: %v", err)
+			}
+		})
+	}
+}
+
+func TestMapboxStaticMapTransportErrorHidesToken(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	p := NewMapboxProvider(testMapboxToken)
+	p.BaseURL = srv.URL
+	srv.Close()
+
+	_, err := p.StaticMap(context.Background(), testMapRequest)
+	if err == nil {
+		t.Fatal("want error")
+	}
+	if strings.Contains(err.Error(), testMapboxToken) || strings.Contains(err.Error(), "access_token") {
+		t.Errorf("error leaks token: %v", err)
+	}
+}
+
+func TestParseMapPath(t *testing.T) {
+	req, err := parseMapPath("/maps/121.5,25.04,14,0/600x300")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req != testMapRequest {
+		t.Errorf("got %+v, want %+v", req, testMapRequest)
+	}
+	for _, path := range []string{
+		"/maps/181,25,14,0/600x300",
+		"/maps/121,86,14,0/600x300",
+		"/maps/121,25,23,0/600x300",
+		"/maps/121,25,14,360/600x300",
+		"/maps/121,25,14,0/0x300",
+		"/maps/121,25,14,0/600x1281",
+		"/maps/121,25/600x300",
+	} {
+		if _, err := parseMapPath(path); err == nil {
+			t.Errorf("%s: want error", path)
+		}
+	}
+}
+
+// countingMapProvider answers every request with err and counts the calls.
+type countingMapProvider struct {
+	calls atomic.Int32
+	err   error
+}
+
+func (p *countingMapProvider) Name() string { return "test" }
+
+func (p *countingMapProvider) StaticMap(ctx context.Context, req MapRequest) (MapImage, error) {
+	p.calls.Add(1)
+	return MapImage{}, p.err
+}
+
+func TestGetCachedMapCachesNotFound(t *testing.T) {
+	errServer := errors.New("mapbox: status 500")
+	tests := []struct {
+		name      string
+		err       error
+		want      error
+		wantCalls int32
+	}{
+		{"not found", fmt.Errorf("mapbox: %w", errMapNotFound), errMapNotFound, 1},
+		{"server error", errServer, errServer, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := cache.NewMemoryCache(0, 0, nil)
+			defer c.Close()
+			provider := &countingMapProvider{err: tt.err}
+			app := &App{Config: &Config{}, Cache: c, ReadThrough: cache.NewReadThrough(c, false), MapProvider: provider, MapCacheTTL: time.Hour}
+
+			for range 3 {
+				_, err := app.getCachedMap(context.Background(), testMapRequest)
+				if !errors.Is(err, tt.want) {
+					t.Errorf("err = %v, want %v", err, tt.want)
+				}
+			}
+			if got := provider.calls.Load(); got != tt.wantCalls {
+				t.Errorf("provider called %d times, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/toomore/toomorephotos/db"
+)
+
+// runMigrate handles -migrate up|down|status. It only needs DATABASE_URL,
+// so it runs before NewApp and does not apply migrations implicitly.
+func runMigrate(ctx context.Context, cmd string) error {
+	switch cmd {
+	case "up", "down", "status":
+	default:
+		return fmt.Errorf("-migrate 只接受 up|down|status: %q", cmd)
+	}
+	url := os.Getenv("DATABASE_URL")
+	if url == "" {
+		return errors.New("-migrate 需要 DATABASE_URL，請設定環境變數")
+	}
+	database, err := db.Open(ctx, url)
+	if err != nil {
+		return fmt.Errorf("DATABASE_URL 連線失敗: %w", err)
+	}
+	defer database.Close()
+
+	switch cmd {
+	case "up":
+		n, err := database.MigrateUp(ctx)
+		if err != nil {
+			return err
+		}
+		log.Printf("migrate up: 套用 %d 個 migration", n)
+	case "down":
+		m, ok, err := database.MigrateDown(ctx)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			log.Println("migrate down: 沒有已套用的 migration")
+			return nil
+		}
+		log.Printf("migrate down: 已回復 %04d_%s", m.Version, m.Name)
+	case "status":
+		status, err := database.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%-30s %s\n", s.Version, s.Name, applied)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/toomore/toomorephotos/cache"
+)
+
+// adminPurgePath is the purge endpoint, enabled by ADMIN_TOKEN.
+const adminPurgePath = "/admin/purge"
+
+// photoCacheGroup and tagCacheGroup name the cache invalidation groups of a
+// photo page and a tag page.
+func photoCacheGroup(photoID string) string { return "photo:" + photoID }
+func tagCacheGroup(tag string) string       { return "tag:" + normalizeTag(tag) }
+
+// cacheOpts is the cache.Fetch options of a value fresh for ttl and served
+// stale for cache.stale after. groups let purging a photo or tag skip
+// knowing every key built from it.
+func (a *App) cacheOpts(ttl time.Duration, groups ...string) cache.FetchOptions {
+	return cache.FetchOptions{SoftTTL: ttl, HardTTL: ttl + a.Config.Cache.Stale, Groups: groups}
+}
+
+// purgeTarget is what one purge target clears.
+type purgeTarget struct {
+	name     string
+	keys     []string
+	groups   []string
+	prefixes []string
+}
+
+// parsePurgeTarget parses one of:
+//
+//	photo:{id}    photo info, sizes, EXIF, related and nearby photos
+//	tag:{tag}     tag pages, the tag's search result and feed
+//	sitemap       sitemap, its photo list and the marshalled XML
+//	feed          all RSS/Atom/JSON feeds
+//	prefix:{p}    every key starting with p
+func parsePurgeTarget(target string) (purgeTarget, error) {
+	kind, arg, _ := strings.Cut(target, ":")
+	var keys, groups, prefixes []string
+	switch kind {
+	case "photo":
+		if arg == "" || strings.Trim(arg, "0123456789") != "" {
+			return purgeTarget{}, fmt.Errorf("照片 ID 格式錯誤: %q", arg)
+		}
+		groups = []string{photoCacheGroup(arg)}
+		// Entries cached before groups existed are only reachable by key.
+		keys = []string{"photo:" + arg, "photosizes:" + arg, "exif:" + arg, "related:" + arg, "nearby:" + arg}
+	case "tag":
+		if arg == "" {
+			return purgeTarget{}, errors.New("缺少標籤名稱")
+		}
+		groups = []string{tagCacheGroup(arg)}
+		keys = []string{"index:" + arg, "feed:tag:" + arg, "feed:tag:" + normalizeTag(arg)}
+	case "sitemap":
+		groups = []string{sitemapCacheGroup}
+		keys = []string{"sitemap", "sitemap:photos"}
+	case "feed":
+		keys = []string{"feed"}
+		prefixes = []string{"feed:tag:", "album-feed:"}
+	case "prefix":
+		if arg == "" {
+			return purgeTarget{}, errors.New("prefix 不可為空")
+		}
+		prefixes = []string{arg}
+	default:
+		return purgeTarget{}, fmt.Errorf("未知的 purge 目標 %q（photo:{id}、tag:{tag}、sitemap、feed、prefix:{p}）", target)
+	}
+
+	return purgeTarget{name: target, keys: keys, groups: groups, prefixes: prefixes}, nil
+}
+
+// purge clears the cache of t.
+func (a *App) purge(ctx context.Context, t purgeTarget) error {
+	n := 0
+	if len(t.groups) > 0 {
+		deleted, err := a.Cache.InvalidateTags(ctx, t.groups...)
+		n += deleted
+		if err != nil {
+			return err
+		}
+	}
+	for _, prefix := range t.prefixes {
+		deleted, err := a.Cache.DeleteByPrefix(ctx, prefix)
+		n += deleted
+		if err != nil {
+			return err
+		}
+	}
+	if err := a.Cache.Delete(ctx, t.keys...); err != nil {
+		return err
+	}
+	log.Printf("Purge: %s（群組/前綴 %d 筆，另刪除 %d 個 key）", t.name, n, len(t.keys))
+	return nil
+}
+
+// runPurge handles -purge with comma-separated targets.
+func (a *App) runPurge(ctx context.Context, targets string) error {
+	if _, ok := a.Cache.(*cache.MemoryCache); ok {
+		log.Println("Purge: 使用記憶體快取，只會清除本 process 的快取；請改用 " + adminPurgePath)
+	}
+	var parsed []purgeTarget
+	for _, target := range strings.Split(targets, ",") {
+		if target = strings.TrimSpace(target); target == "" {
+			continue
+		}
+		t, err := parsePurgeTarget(target)
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, t)
+	}
+	for _, t := range parsed {
+		if err := a.purge(ctx, t); err != nil {
+			return fmt.Errorf("purge %s: %w", t.name, err)
+		}
+	}
+	return nil
+}
+
+// adminAuthorized checks "Authorization: Bearer {ADMIN_TOKEN}" and answers
+// 401 when it does not match.
+func (a *App) adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || a.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.AdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// adminPurge handles POST /admin/purge?target=... (repeatable) with
+// "Authorization: Bearer {ADMIN_TOKEN}".
+func (a *App) adminPurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.adminAuthorized(w, r) {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	targets := r.Form["target"]
+	if len(targets) == 0 {
+		http.Error(w, "missing target", http.StatusBadRequest)
+		return
+	}
+	parsed := make([]purgeTarget, len(targets))
+	for i, target := range targets {
+		t, err := parsePurgeTarget(target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		parsed[i] = t
+	}
+	for _, t := range parsed {
+		if err := a.purge(r.Context(), t); err != nil {
+			log.Printf("Purge: %s: %v", t.name, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(struct {
+		Purged []string `json:"purged"`
+	}{targets})
+}
+
+// cacheStatus is the JSON of /cache/status.
+type cacheStatus struct {
+	Backend string `json:"backend"`
+	// Memory is set for the in-memory cache and the L1 of a tiered cache.
+	Memory *cache.Stats `json:"memory,omitempty"`
+}
+
+// cacheStatusHandler reports the cache backend and, for the in-memory cache
+// or L1, hit/miss/eviction counters and size.
+func (a *App) cacheStatusHandler(w http.ResponseWriter, r *http.Request) {
+	var status cacheStatus
+	switch c := a.Cache.(type) {
+	case *cache.MemoryCache:
+		stats := c.Stats()
+		status = cacheStatus{Backend: "memory", Memory: &stats}
+	case *cache.TieredCache:
+		stats := c.Stats()
+		status = cacheStatus{Backend: "redis+l1", Memory: &stats}
+	case *cache.RedisCache:
+		status.Backend = "redis"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("cache status encode error: %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/toomore/toomorephotos/db"
+)
+
+const (
+	// syncLockKey is the PostgreSQL advisory lock key for sync ("toomore").
+	syncLockKey = 0x746f6f6d6f7265
+	// syncStartJitter staggers the first run of instances started together.
+	syncStartJitter = time.Minute
+)
+
+var errSyncLocked = errors.New("另一個 instance 正在執行 sync")
+
+// trySyncLock takes the cross-instance sync lock, a PostgreSQL advisory
+// lock. Unlike a TTL lock it cannot expire under a long run, and PostgreSQL
+// drops it when the holder dies.
+func (a *App) trySyncLock(ctx context.Context) (release func(), err error) {
+	release, ok, err := a.DB.TryAdvisoryLock(ctx, syncLockKey)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errSyncLocked
+	}
+	return release, nil
+}
+
+// lockedSync runs runSync while holding the sync lock.
+func (a *App) lockedSync(ctx context.Context, opts syncOptions) error {
+	release, err := a.trySyncLock(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return runSync(ctx, a, opts)
+}
+
+// syncStatus is the scheduler state reported by /sync/status.
+type syncStatus struct {
+	Enabled    bool        `json:"enabled"`
+	Interval   string      `json:"interval,omitempty"`
+	Running    bool        `json:"running"`
+	LastStart  *time.Time  `json:"last_start,omitempty"`
+	LastFinish *time.Time  `json:"last_finish,omitempty"`
+	LastResult string      `json:"last_result,omitempty"` // ok, error, locked, skipped
+	LastError  string      `json:"last_error,omitempty"`
+	NextRun    *time.Time  `json:"next_run,omitempty"`
+	LastRun    *db.SyncRun `json:"last_run,omitempty"`
+}
+
+// syncScheduler runs sync every interval inside the web server process.
+// Every instance may run one; the sync lock lets only one of them sync.
+type syncScheduler struct {
+	app      *App
+	interval time.Duration
+	opts     syncOptions
+
+	mu     sync.Mutex
+	status syncStatus
+}
+
+func newSyncScheduler(app *App, interval time.Duration, opts syncOptions) *syncScheduler {
+	return &syncScheduler{
+		app:      app,
+		interval: interval,
+		opts:     opts,
+		status:   syncStatus{Enabled: true, Interval: interval.String()},
+	}
+}
+
+// Start runs the scheduler until ctx is done.
+func (s *syncScheduler) Start(ctx context.Context) {
+	log.Printf("Sync scheduler: 每 %s 執行一次", s.interval)
+	go func() {
+		wait := time.Duration(rand.Int64N(int64(syncStartJitter)))
+		for {
+			next := time.Now().Add(wait)
+			s.mu.Lock()
+			s.status.NextRun = &next
+			s.mu.Unlock()
+
+			t := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case <-t.C:
+			}
+			s.runOnce(ctx)
+			wait = s.interval
+		}
+	}()
+}
+
+func (s *syncScheduler) runOnce(ctx context.Context) {
+	start := time.Now()
+	s.mu.Lock()
+	s.status.Running = true
+	s.status.LastStart = &start
+	s.mu.Unlock()
+
+	result, errMsg := "ok", ""
+	err := s.run(ctx)
+	switch {
+	case err == errSyncLocked:
+		result = "locked"
+	case err == errSyncRecent:
+		result = "skipped"
+	case err != nil:
+		result, errMsg = "error", err.Error()
+		log.Printf("Sync scheduler: %v", err)
+	}
+
+	finish := time.Now()
+	s.mu.Lock()
+	s.status.Running = false
+	s.status.LastFinish = &finish
+	s.status.LastResult = result
+	s.status.LastError = errMsg
+	s.mu.Unlock()
+}
+
+var errSyncRecent = errors.New("sync 最近已完成")
+
+func (s *syncScheduler) run(ctx context.Context) error {
+	release, err := s.app.trySyncLock(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	// Another instance may have finished a run just before we got the lock.
+	if last, ok, err := s.app.DB.GetLastSync(ctx, syncStateName); err == nil && ok && time.Since(last) < s.interval/2 {
+		return errSyncRecent
+	}
+	return runSync(ctx, s.app, s.opts)
+}
+
+// Status returns a snapshot of the scheduler state.
+func (s *syncScheduler) Status() syncStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// syncStatusHandler serves the scheduler state and the latest sync run as
+// JSON to requests with "Authorization: Bearer {ADMIN_TOKEN}".
+func (a *App) syncStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.adminAuthorized(w, r) {
+		return
+	}
+	var status syncStatus
+	if a.Scheduler != nil {
+		status = a.Scheduler.Status()
+	}
+	if a.DB != nil {
+		if run, ok, err := a.DB.GetLatestSyncRun(r.Context()); err == nil && ok {
+			status.LastRun = &run
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("sync status encode error: %v", err)
+	}
+}
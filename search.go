@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/toomore/toomorephotos/cache"
+	"github.com/toomore/toomorephotos/db"
+)
+
+const (
+	searchPageSize = 60
+	maxSearchQuery = 100 // runes
+)
+
+// searchResult is one page of hits and the total hit count.
+type searchResult struct {
+	Hits  []db.SearchResult
+	Total int
+}
+
+// fromTextSearch searches titles, descriptions and tags through Flickr.
+func (a *App) fromTextSearch(ctx context.Context, query string) ([]db.SearchResult, error) {
+	photos, err := flickrSearch(ctx, a, map[string]string{
+		"text":    query,
+		"sort":    "relevance",
+		"user_id": a.UserID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result []db.SearchResult
+	for _, p := range photos {
+		if p.Ispublic != 0 {
+			result = append(result, db.SearchResult{Photo: p, Title: p.Title})
+		}
+	}
+	return result, nil
+}
+
+// getCachedSearch runs full-text search in DB, or Flickr's text search when
+// DATABASE_URL is not set or the DB query fails.
+func (a *App) getCachedSearch(query string, page int) searchResult {
+	ctx := context.Background()
+	key := fmt.Sprintf("search:%d:%s", page, query)
+	result, _ := cache.Fetch(ctx, a.ReadThrough, key, a.cacheOpts(a.IndexCacheTTL), func(ctx context.Context) (searchResult, error) {
+		if a.DB != nil {
+			hits, total, err := a.DB.SearchPhotos(ctx, query, searchPageSize, (page-1)*searchPageSize)
+			if err == nil {
+				return searchResult{Hits: hits, Total: total}, nil
+			}
+			log.Printf("search %q: %v", query, err)
+		}
+		all, err := a.fromTextSearch(ctx, query)
+		if err != nil {
+			return searchResult{}, err
+		}
+		var result searchResult
+		result.Total = len(all)
+		if start := (page - 1) * searchPageSize; start < len(all) {
+			result.Hits = all[start:min(start+searchPageSize, len(all))]
+		}
+		return result, nil
+	})
+	return result
+}
+
+// highlight HTML-escapes s and turns db highlight markers into <mark>.
+func highlight(s string) template.HTML {
+	s = html.EscapeString(s)
+	s = strings.NewReplacer(db.HighlightStart, "<mark>", db.HighlightStop, "</mark>").Replace(s)
+	return template.HTML(s)
+}
+
+// searchQuery reads ?q=, trimmed and cut to maxSearchQuery runes.
+func searchQuery(r *http.Request) string {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if utf8.RuneCountInString(q) > maxSearchQuery {
+		q = string([]rune(q)[:maxSearchQuery])
+	}
+	return q
+}
+
+type searchHit struct {
+	ID        string        `json:"id"`
+	Title     string        `json:"title"`
+	TitleHTML template.HTML `json:"title_html"`
+	Snippet   template.HTML `json:"snippet_html"`
+	URL       string        `json:"url"`
+	Thumbnail string        `json:"thumbnail"`
+	Farm      int64         `json:"-"`
+	Server    string        `json:"-"`
+	Secret    string        `json:"-"`
+}
+
+type searchPage struct {
+	Query   string      `json:"query"`
+	Page    int         `json:"page"`
+	Pages   int         `json:"pages"`
+	Total   int         `json:"total"`
+	Results []searchHit `json:"results"`
+	Pager   pager       `json:"-"`
+}
+
+func (a *App) buildSearchPage(query string, page int) searchPage {
+	data := searchPage{Query: query, Page: page, Results: []searchHit{}}
+	if query == "" {
+		return data
+	}
+	result := a.getCachedSearch(query, page)
+	data.Pager = newPager(page, searchPageSize, result.Total)
+	data.Pages, data.Total = data.Pager.Pages, result.Total
+	for _, h := range result.Hits {
+		p := h.Photo
+		data.Results = append(data.Results, searchHit{
+			ID:        p.ID,
+			Title:     p.Title,
+			TitleHTML: highlight(h.Title),
+			Snippet:   highlight(h.Snippet),
+			URL:       fmt.Sprintf("%s/p/%s", a.Config.Site.URL, p.ID),
+			Thumbnail: fmt.Sprintf("%s/f/q/%d/%s/%s/%s.jpg", a.Config.Site.URL, p.Farm, p.Server, p.Secret, p.ID),
+			Farm:      p.Farm,
+			Server:    p.Server,
+			Secret:    p.Secret,
+		})
+	}
+	return data
+}
+
+// search serves the /search?q= results page.
+func (a *App) search(w http.ResponseWriter, r *http.Request) {
+	logs(r, "")
+	page, ok := parsePage(r)
+	if !ok {
+		a.notFound(w, r)
+		return
+	}
+	data := a.buildSearchPage(searchQuery(r), page)
+	w.Header().Set("Cache-Control", "max-age=120")
+	if err := a.TplSearch.Execute(w, data); err != nil {
+		log.Printf("template execute error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// searchJSON serves /search.json?q=, the same results as JSON.
+func (a *App) searchJSON(w http.ResponseWriter, r *http.Request) {
+	logs(r, "")
+	page, ok := parsePage(r)
+	if !ok {
+		http.Error(w, "Bad Request: invalid page", http.StatusBadRequest)
+		return
+	}
+	data := a.buildSearchPage(searchQuery(r), page)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "max-age=120")
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Printf("search json encode error: %v", err)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toomore/toomorephotos/cache"
+	"github.com/toomore/toomorephotos/db"
+)
+
+// Limits of one sitemap file, https://www.sitemaps.org/protocol.html.
+const (
+	sitemapMaxURLs  = 50000
+	sitemapMaxBytes = 50 << 20
+)
+
+const sitemapMaxAge = 3600
+
+// sitemapCacheGroup holds the marshalled sitemap files, sitemap:xml:{n}.
+const sitemapCacheGroup = "sitemap"
+
+const (
+	sitemapHeader = xml.Header + `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9" xmlns:image="http://www.google.com/schemas/sitemap-image/1.1">` + "\n"
+	sitemapFooter = "</urlset>\n"
+)
+
+type sitemapURL struct {
+	XMLName xml.Name       `xml:"url"`
+	Loc     string         `xml:"loc"`
+	LastMod string         `xml:"lastmod,omitempty"`
+	Images  []sitemapImage `xml:"image:image"`
+	updated time.Time
+}
+
+// sitemapImage is the Google image sitemap extension.
+type sitemapImage struct {
+	Loc     string `xml:"image:loc"`
+	Title   string `xml:"image:title,omitempty"`
+	License string `xml:"image:license,omitempty"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name          `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 sitemapindex"`
+	Sitemaps []sitemapIndexRef `xml:"sitemap"`
+}
+
+type sitemapIndexRef struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// sitemapShard is one sitemap file: encoded <url> entries within the
+// sitemaps.org limits.
+type sitemapShard struct {
+	entries  [][]byte
+	size     int
+	modified time.Time
+}
+
+func (s *sitemapShard) body() []byte {
+	var buf bytes.Buffer
+	buf.Grow(s.size)
+	buf.WriteString(sitemapHeader)
+	for _, e := range s.entries {
+		buf.Write(e)
+		buf.WriteByte('\n')
+	}
+	buf.WriteString(sitemapFooter)
+	return buf.Bytes()
+}
+
+func sitemapTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// splitSitemap encodes urls into as few shards as the limits allow.
+func splitSitemap(urls []sitemapURL) ([]*sitemapShard, error) {
+	overhead := len(sitemapHeader) + len(sitemapFooter)
+	shard := &sitemapShard{size: overhead}
+	shards := []*sitemapShard{shard}
+	for _, u := range urls {
+		u.LastMod = sitemapTime(u.updated)
+		entry, err := xml.Marshal(u)
+		if err != nil {
+			return nil, err
+		}
+		if len(shard.entries) == sitemapMaxURLs || shard.size+len(entry)+1 > sitemapMaxBytes {
+			shard = &sitemapShard{size: overhead}
+			shards = append(shards, shard)
+		}
+		shard.entries = append(shard.entries, entry)
+		shard.size += len(entry) + 1
+		if u.updated.After(shard.modified) {
+			shard.modified = u.updated
+		}
+	}
+	return shards, nil
+}
+
+// sitemapPhotosResponse is flickr.photos.search with license and
+// last_update extras, which the lazyflickrgo Photo struct does not carry.
+type sitemapPhotosResponse struct {
+	Photos struct {
+		Pages json.Number `json:"pages"`
+		Photo []struct {
+			ID         string      `json:"id"`
+			Title      string      `json:"title"`
+			Secret     string      `json:"secret"`
+			Server     string      `json:"server"`
+			Farm       json.Number `json:"farm"`
+			License    string      `json:"license"`
+			LastUpdate string      `json:"lastupdate"`
+		} `json:"photo"`
+	} `json:"photos"`
+	Stat    string `json:"stat"`
+	Code    int64  `json:"code"`
+	Message string `json:"message"`
+}
+
+// fetchSitemapPhotos lists all public photos of UserID through Flickr.
+func fetchSitemapPhotos(ctx context.Context, app *App) ([]db.SitemapPhoto, error) {
+	var photos []db.SitemapPhoto
+	for page := 1; ; page++ {
+		var resp sitemapPhotosResponse
+		args := map[string]string{
+			"method":   "flickr.photos.search",
+			"user_id":  app.UserID,
+			"sort":     "date-posted-desc",
+			"extras":   "license,last_update",
+			"per_page": "500",
+			"page":     strconv.Itoa(page),
+		}
+		if err := flickrGet(ctx, app, args, &resp); err != nil {
+			return nil, err
+		}
+		if resp.Stat != "ok" {
+			return nil, &flickrError{Stat: resp.Stat, Code: resp.Code, Message: resp.Message}
+		}
+		for _, p := range resp.Photos.Photo {
+			farm, _ := p.Farm.Int64()
+			photos = append(photos, db.SitemapPhoto{
+				ID:         p.ID,
+				Title:      p.Title,
+				Farm:       farm,
+				Server:     p.Server,
+				Secret:     p.Secret,
+				License:    p.License,
+				LastUpdate: unixPtr(p.LastUpdate),
+			})
+		}
+		if pages, _ := resp.Photos.Pages.Int64(); int64(page) >= pages {
+			return photos, nil
+		}
+	}
+}
+
+// getCachedSitemapPhotos returns all photos with lastupdate and license,
+// from DB when available, otherwise from Flickr.
+func (a *App) getCachedSitemapPhotos() []db.SitemapPhoto {
+	ctx := context.Background()
+	key := "sitemap:photos"
+	result, err := cache.Fetch(ctx, a.ReadThrough, key, a.cacheOpts(a.SitemapCacheTTL), func(ctx context.Context) ([]db.SitemapPhoto, error) {
+		if a.DB != nil {
+			if photos, err := a.DB.GetSitemapPhotos(ctx); err == nil && len(photos) > 0 {
+				return photos, nil
+			}
+		}
+		return fetchSitemapPhotos(ctx, a)
+	})
+	if err != nil {
+		log.Printf("sitemap photos: %v", err)
+		return nil
+	}
+	return result
+}
+
+// sitemapURLs lists the home page, tag index, tags, albums and photos.
+func (a *App) sitemapURLs() []sitemapURL {
+	photos := a.getCachedSitemapPhotos()
+	tags := a.getCachedTagCounts()
+	albums := a.getCachedAlbums()
+
+	var newest time.Time
+	for _, p := range photos {
+		if p.LastUpdate != nil && p.LastUpdate.After(newest) {
+			newest = *p.LastUpdate
+		}
+	}
+	urls := make([]sitemapURL, 0, 2+len(tags)+len(albums)+len(photos))
+	urls = append(urls,
+		sitemapURL{Loc: a.Config.Site.URL + "/", updated: newest},
+		sitemapURL{Loc: a.Config.Site.URL + "/tags", updated: newest},
+	)
+	for _, t := range tags {
+		urls = append(urls, sitemapURL{Loc: a.Config.Site.URL + "/t/" + url.PathEscape(t.Tag)})
+	}
+	for _, album := range albums {
+		u := sitemapURL{Loc: a.Config.Site.URL + "/a/" + album.ID}
+		if album.UpdatedAt != nil {
+			u.updated = *album.UpdatedAt
+		}
+		urls = append(urls, u)
+	}
+	for _, p := range photos {
+		u := sitemapURL{Loc: a.Config.Site.URL + "/p/" + p.ID}
+		if p.LastUpdate != nil {
+			u.updated = *p.LastUpdate
+		}
+		image := sitemapImage{
+			Loc:   a.apiImagesFor(p.Farm, p.Server, p.Secret, p.ID).Large,
+			Title: p.Title,
+		}
+		if l, ok := a.Licenses[p.License]; ok {
+			image.License = l.URL
+		}
+		u.Images = []sitemapImage{image}
+		urls = append(urls, u)
+	}
+	return urls
+}
+
+// sitemapFile is one served sitemap document. A nil Body is a shard past
+// the last one.
+type sitemapFile struct {
+	Body     []byte    `json:"body"`
+	Modified time.Time `json:"modified"`
+}
+
+// buildSitemapFile marshals file n of the sitemap: 0 is /sitemap.xml, the
+// only sitemap or an index of the shards, and n > 0 is /sitemap/{n}.xml.
+func (a *App) buildSitemapFile(n int) (sitemapFile, error) {
+	shards, err := splitSitemap(a.sitemapURLs())
+	if err != nil {
+		return sitemapFile{}, err
+	}
+	if n > len(shards) {
+		return sitemapFile{}, nil
+	}
+	if n > 0 || len(shards) == 1 {
+		s := shards[max(n-1, 0)]
+		return sitemapFile{Body: s.body(), Modified: s.modified}, nil
+	}
+
+	var file sitemapFile
+	var index sitemapIndex
+	for i, s := range shards {
+		index.Sitemaps = append(index.Sitemaps, sitemapIndexRef{
+			Loc:     fmt.Sprintf("%s/sitemap/%d.xml", a.Config.Site.URL, i+1),
+			LastMod: sitemapTime(s.modified),
+		})
+		if s.modified.After(file.Modified) {
+			file.Modified = s.modified
+		}
+	}
+	body, err := xml.Marshal(index)
+	if err != nil {
+		return sitemapFile{}, fmt.Errorf("index: %w", err)
+	}
+	file.Body = append([]byte(xml.Header), body...)
+	return file, nil
+}
+
+// getCachedSitemapFile returns file n of the sitemap, each file under its
+// own key in the sitemap cache group.
+func (a *App) getCachedSitemapFile(n int) (sitemapFile, error) {
+	key := fmt.Sprintf("sitemap:xml:%d", n)
+	return cache.Fetch(context.Background(), a.ReadThrough, key, a.cacheOpts(a.SitemapCacheTTL, sitemapCacheGroup), func(ctx context.Context) (sitemapFile, error) {
+		return a.buildSitemapFile(n)
+	})
+}
+
+// sitemapXML serves /sitemap.xml: the only sitemap while everything fits in
+// one file, otherwise a sitemap index of /sitemap/{n}.xml.
+func (a *App) sitemapXML(w http.ResponseWriter, r *http.Request) {
+	file, err := a.getCachedSitemapFile(0)
+	if err != nil {
+		log.Printf("sitemap error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeConditional(w, r, "application/xml; charset=utf-8", file.Modified, file.Body, sitemapMaxAge)
+}
+
+// sitemapShardHandler serves /sitemap/{n}.xml. /sitemap/, the old plain-text
+// sitemap, redirects to /sitemap.xml.
+func (a *App) sitemapShardHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/sitemap/")
+	if name == "" {
+		http.Redirect(w, r, "/sitemap.xml", http.StatusMovedPermanently)
+		return
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(name, ".xml"))
+	if err != nil || !strings.HasSuffix(name, ".xml") || n < 1 {
+		a.notFound(w, r)
+		return
+	}
+	file, err := a.getCachedSitemapFile(n)
+	if err != nil {
+		log.Printf("sitemap error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if file.Body == nil {
+		a.notFound(w, r)
+		return
+	}
+	writeConditional(w, r, "application/xml; charset=utf-8", file.Modified, file.Body, sitemapMaxAge)
+}
+
+// robots serves /robots.txt pointing crawlers at the sitemap.
+func (a *App) robots(w http.ResponseWriter, r *http.Request) {
+	body := fmt.Sprintf("User-agent: *\nAllow: /\nDisallow: /sync/\n\nSitemap: %s/sitemap.xml\n", a.Config.Site.URL)
+	writeConditional(w, r, "text/plain; charset=utf-8", time.Time{}, []byte(body), 86400)
+}
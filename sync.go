@@ -2,88 +2,598 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"math/rand/v2"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/toomore/lazyflickrgo/jsonstruct"
+	"github.com/toomore/toomorephotos/db"
 )
 
-const syncRatePerSec = 2
+const (
+	syncRatePerSec  = 4 // Flickr API calls per second, three per photo
+	syncWorkers     = 4
+	syncMaxAttempts = 4
+	syncBaseBackoff = time.Second
+	syncStateName   = "photos"
+	// syncOverlap re-checks a short window before the last sync so photos
+	// edited while the previous run was in progress are not missed.
+	syncOverlap = 10 * time.Minute
+	// A full sync removes at most syncPruneMaxFraction of the DB photos, or
+	// syncPruneMin when that is more.
+	syncPruneMaxFraction = 0.05
+	syncPruneMin         = 10
+)
+
+// Prune modes besides db.RemoveMode values.
+const (
+	pruneOff    = "off"
+	pruneDryRun = "dry-run"
+)
+
+// syncOptions controls runSync.
+type syncOptions struct {
+	Full  bool      // list every public photo instead of recently updated ones
+	Since time.Time // overrides the last sync time recorded in DB
+	Prune string    // off, dry-run, or a db.RemoveMode
+
+	Restart bool    // abandon an interrupted run instead of resuming it
+	Workers int     // concurrent fetchers
+	Rate    float64 // Flickr API calls per second shared by all workers
+}
+
+func parsePruneMode(value string) (string, error) {
+	switch value {
+	case pruneOff, pruneDryRun, string(db.RemoveSoft), string(db.RemoveHide), string(db.RemoveHard):
+		return value, nil
+	}
+	return "", fmt.Errorf("-sync-prune 必須是 off、dry-run、soft、hide 或 hard，收到 %q", value)
+}
 
-// runSync fetches all photos from Flickr and upserts to DB.
-func runSync(app *App) error {
+// parseSyncSince parses -sync-since: RFC3339, YYYY-MM-DD, or a duration
+// such as 72h meaning "72 hours ago".
+func parseSyncSince(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("-sync-since 格式錯誤 %q，請使用 RFC3339、YYYY-MM-DD 或 duration (例如 72h)", value)
+}
+
+// runSync fetches photos from Flickr and upserts to DB.
+// Without opts.Full it only fetches photos updated since the last successful
+// sync; the first run, or a run with no recorded sync, is always full.
+//
+// Progress is checkpointed in sync_runs/sync_items: after a crash or when ctx
+// is cancelled the next runSync resumes the interrupted run unless
+// opts.Restart is set. Callers must hold the sync lock (see trySyncLock).
+func runSync(ctx context.Context, app *App, opts syncOptions) error {
 	if app.DB == nil {
-		log.Fatal("sync 需要 DATABASE_URL，請設定環境變數")
+		return errors.New("sync 需要 DATABASE_URL，請設定環境變數")
+	}
+
+	run, resume, err := app.DB.GetUnfinishedSyncRun(ctx)
+	if err != nil {
+		return fmt.Errorf("讀取 sync run 失敗: %w", err)
+	}
+	if resume && opts.Restart {
+		log.Printf("Sync: 放棄中斷的 run #%d，重新開始", run.ID)
+		if err := app.DB.FinishSyncRun(ctx, run.ID, db.SyncFailed); err != nil {
+			return fmt.Errorf("更新 sync run 失敗: %w", err)
+		}
+		resume = false
+	}
+	if resume {
+		log.Printf("Sync: 接續中斷的 run #%d (%s, 開始於 %s)", run.ID, run.Kind, run.StartedAt.Format(time.RFC3339))
+	} else if run, err = startSyncRun(ctx, app, opts); err != nil {
+		return err
+	}
+
+	// 2. Fetch and upsert
+	items, err := app.DB.GetOpenSyncItems(ctx, run.ID, db.SyncActionUpsert)
+	if err != nil {
+		return fmt.Errorf("讀取 sync items 失敗: %w", err)
+	}
+	photoIDs, failCount := syncPhotos(ctx, app, run.ID, items, opts)
+	if ctx.Err() != nil {
+		log.Printf("Sync: 已中斷 (%d 成功, %d 失敗)，進度已儲存；再次執行 -sync 會接續 run #%d", len(photoIDs), failCount, run.ID)
+		return ctx.Err()
+	}
+	log.Printf("Sync: 完成 %d 成功, %d 失敗", len(photoIDs), failCount)
+
+	// 3. Take removed or private photos off the site
+	removes, err := app.DB.GetOpenSyncItems(ctx, run.ID, db.SyncActionRemove)
+	if err != nil {
+		return fmt.Errorf("讀取 sync items 失敗: %w", err)
+	}
+	removedIDs, removedTags, err := pruneRemoved(ctx, app, run.ID, removes, opts.Prune)
+	if err != nil {
+		return err
 	}
-	ctx := context.Background()
 
-	// 1. Get all photo IDs
-	var allIDs []string
-	args := map[string]string{
-		"sort":     "date-posted-desc",
-		"user_id":  app.UserID,
+	// 4. Albums; a failure here does not fail the photo run.
+	albumIDs, albumErr := syncAlbums(ctx, app, newTokenBucket(opts.Rate, 1))
+	if albumErr != nil {
+		log.Printf("Sync: 相簿同步失敗: %v", albumErr)
 	}
-	for _, page := range app.Flickr.PhotosSearch(args) {
-		for _, p := range page.Photos.Photo {
+
+	// 5. Refresh the changed feeds and notify WebSub hubs.
+	publishSyncChanges(ctx, app, photoIDs, removedIDs, removedTags, albumIDs)
+
+	status := db.SyncDone
+	if failCount > 0 {
+		status = db.SyncFailed
+	}
+	if err := app.DB.FinishSyncRun(ctx, run.ID, status); err != nil {
+		return fmt.Errorf("更新 sync run 失敗: %w", err)
+	}
+	if failCount > 0 {
+		log.Printf("Sync: 有失敗項目，不更新上次 sync 時間")
+		return albumErr
+	}
+	if err := app.DB.SetLastSync(ctx, syncStateName, run.StartedAt); err != nil {
+		return fmt.Errorf("寫入 sync 時間失敗: %w", err)
+	}
+	return albumErr
+}
+
+// startSyncRun lists what to sync and records it as a new run.
+func startSyncRun(ctx context.Context, app *App, opts syncOptions) (db.SyncRun, error) {
+	since := opts.Since
+	if !opts.Full && since.IsZero() {
+		last, ok, err := app.DB.GetLastSync(ctx, syncStateName)
+		if err != nil {
+			return db.SyncRun{}, fmt.Errorf("讀取上次 sync 時間失敗: %w", err)
+		}
+		if ok {
+			since = last.Add(-syncOverlap)
+		}
+	}
+
+	// 1. Get photo IDs, and IDs that should no longer be on the site
+	var ids, removed []string
+	kind := "full"
+	if opts.Full || since.IsZero() {
+		var complete bool
+		var err error
+		if ids, complete, err = listPublicPhotoIDs(ctx, app); err != nil {
+			return db.SyncRun{}, fmt.Errorf("取得照片列表失敗: %w", err)
+		}
+		log.Printf("Sync: 完整同步，取得 %d 張照片 ID", len(ids))
+		if !complete {
+			log.Printf("Sync: 照片列表不完整，跳過刪除比對")
+		} else if removed, err = findRemovedPhotoIDs(ctx, app, ids); err != nil {
+			return db.SyncRun{}, err
+		}
+	} else {
+		kind = "incremental"
+		var private []string
+		var err error
+		ids, private, err = listUpdatedPhotoIDs(ctx, app, since)
+		if err != nil {
+			return db.SyncRun{}, err
+		}
+		log.Printf("Sync: 增量同步 (since %s)，%d 張照片需更新", since.Format(time.RFC3339), len(ids))
+		if removed, err = filterExisting(ctx, app, private); err != nil {
+			return db.SyncRun{}, err
+		}
+	}
+
+	run, err := app.DB.CreateSyncRun(ctx, kind, ids, removed)
+	if err != nil {
+		return db.SyncRun{}, fmt.Errorf("建立 sync run 失敗: %w", err)
+	}
+	log.Printf("Sync: 建立 run #%d", run.ID)
+	return run, nil
+}
+
+// searchIDsPage is flickr.photos.search without extras. Flickr sends total
+// as a number or a string depending on the endpoint version.
+type searchIDsPage struct {
+	Photos struct {
+		Page  int         `json:"page"`
+		Pages int         `json:"pages"`
+		Total json.Number `json:"total"`
+		Photo []struct {
+			ID       string `json:"id"`
+			Ispublic int64  `json:"ispublic"`
+		} `json:"photo"`
+	} `json:"photos"`
+	Stat    string `json:"stat"`
+	Code    int64  `json:"code"`
+	Message string `json:"message"`
+}
+
+// listPublicPhotoIDs lists every public photo of app.UserID. complete is
+// false when the pages did not add up to the total Flickr reported, e.g.
+// photos shifting between pages; such a list must not be used for pruning.
+func listPublicPhotoIDs(ctx context.Context, app *App) (ids []string, complete bool, err error) {
+	// Fixed for every page, so photos uploaded meanwhile do not shift them.
+	maxUpload := strconv.FormatInt(time.Now().Unix(), 10)
+	seen := make(map[string]bool)
+	var total int64
+	for page, pages := 1, 1; page <= pages; page++ {
+		args := map[string]string{
+			"method":          "flickr.photos.search",
+			"sort":            "date-posted-desc",
+			"user_id":         app.UserID,
+			"max_upload_date": maxUpload,
+			"per_page":        "500",
+			"page":            strconv.Itoa(page),
+		}
+		var data searchIDsPage
+		if err := flickrGet(ctx, app, args, &data); err != nil {
+			return nil, false, err
+		}
+		if data.Stat != "ok" {
+			return nil, false, &flickrError{Stat: data.Stat, Code: data.Code, Message: data.Message}
+		}
+		if page == 1 {
+			if total, err = data.Photos.Total.Int64(); err != nil {
+				return nil, false, fmt.Errorf("flickr.photos.search: total %q: %w", data.Photos.Total, err)
+			}
+		}
+		pages = data.Photos.Pages
+		for _, p := range data.Photos.Photo {
+			if seen[p.ID] {
+				continue
+			}
+			seen[p.ID] = true
 			if p.Ispublic != 0 {
-				allIDs = append(allIDs, p.ID)
+				ids = append(ids, p.ID)
 			}
 		}
 	}
-	log.Printf("Sync: 取得 %d 張照片 ID", len(allIDs))
+	if int64(len(seen)) != total {
+		log.Printf("Sync: Flickr 回報 %d 張照片，分頁共取得 %d 張", total, len(seen))
+		return ids, false, nil
+	}
+	return ids, true, nil
+}
 
-	rate := time.NewTicker(time.Second / syncRatePerSec)
-	defer rate.Stop()
+// recentlyUpdatedPage is flickr.photos.recentlyUpdated with extras=last_update.
+type recentlyUpdatedPage struct {
+	Photos struct {
+		Page  int `json:"page"`
+		Pages int `json:"pages"`
+		Photo []struct {
+			ID         string `json:"id"`
+			Owner      string `json:"owner"`
+			Ispublic   int64  `json:"ispublic"`
+			LastUpdate string `json:"lastupdate"`
+		} `json:"photo"`
+	} `json:"photos"`
+	// Not jsonstruct.Common: its easyjson UnmarshalJSON would be promoted
+	// and skip every other field.
+	Stat    string `json:"stat"`
+	Message string `json:"message"`
+}
 
-	okCount, failCount := 0, 0
-	for i, id := range allIDs {
-		<-rate.C
-		info, width, height := fetchPhotoWithRetry(app, id)
-		if info.Common.Stat != "ok" {
-			log.Printf("Sync: 跳過 %s (API stat=%s)", id, info.Common.Stat)
-			failCount++
-			continue
+// listUpdatedPhotoIDs returns public photos changed on Flickr since t whose
+// lastupdate is newer than the copy in DB, and photos changed to private.
+//
+// https://www.flickr.com/services/api/flickr.photos.recentlyUpdated.html
+func listUpdatedPhotoIDs(ctx context.Context, app *App, since time.Time) (ids, private []string, err error) {
+	updated := make(map[string]int64)
+	var order []string
+	for page, pages := 1, 1; page <= pages; page++ {
+		args := map[string]string{
+			"method":     "flickr.photos.recentlyUpdated",
+			"min_date":   strconv.FormatInt(since.Unix(), 10),
+			"extras":     "last_update",
+			"per_page":   "500",
+			"page":       strconv.Itoa(page),
+			"auth_token": app.Flickr.AuthToken,
 		}
-		if err := app.DB.UpsertPhoto(ctx, id, info, width, height); err != nil {
-			log.Printf("Sync: 寫入 DB 失敗 %s: %v", id, err)
-			failCount++
+		var data recentlyUpdatedPage
+		if err := flickrGet(ctx, app, args, &data); err != nil {
+			return nil, nil, err
+		}
+		if data.Stat != "ok" {
+			return nil, nil, fmt.Errorf("recentlyUpdated: stat=%s %s", data.Stat, data.Message)
+		}
+		pages = data.Photos.Pages
+		for _, p := range data.Photos.Photo {
+			if p.Owner != app.UserID {
+				continue
+			}
+			if p.Ispublic == 0 {
+				private = append(private, p.ID)
+				continue
+			}
+			last, _ := strconv.ParseInt(p.LastUpdate, 10, 64)
+			if _, seen := updated[p.ID]; !seen {
+				order = append(order, p.ID)
+			}
+			updated[p.ID] = last
+		}
+	}
+	if len(order) == 0 {
+		return nil, private, nil
+	}
+
+	stored, err := app.DB.GetLastUpdates(ctx, order)
+	if err != nil {
+		return nil, nil, fmt.Errorf("讀取 DB lastupdate 失敗: %w", err)
+	}
+	for _, id := range order {
+		if dbLast, ok := stored[id]; ok && dbLast >= updated[id] && updated[id] > 0 {
 			continue
 		}
-		okCount++
-		if (i+1)%50 == 0 {
-			log.Printf("Sync: 進度 %d/%d", i+1, len(allIDs))
+		ids = append(ids, id)
+	}
+	return ids, private, nil
+}
+
+// findRemovedPhotoIDs returns visible DB photos missing from flickrIDs, at
+// most syncPruneMaxFraction of them per run.
+func findRemovedPhotoIDs(ctx context.Context, app *App, flickrIDs []string) ([]string, error) {
+	if len(flickrIDs) == 0 {
+		// An empty list is far more likely an API failure than a wiped account.
+		log.Printf("Sync: Flickr 回傳 0 張照片，跳過刪除比對")
+		return nil, nil
+	}
+	dbIDs, err := app.DB.ListPhotoIDs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("讀取 DB 照片 ID 失敗: %w", err)
+	}
+	onFlickr := make(map[string]bool, len(flickrIDs))
+	for _, id := range flickrIDs {
+		onFlickr[id] = true
+	}
+	var removed []string
+	for _, id := range dbIDs {
+		if !onFlickr[id] {
+			removed = append(removed, id)
 		}
 	}
-	log.Printf("Sync: 完成 %d 成功, %d 失敗", okCount, failCount)
-	return nil
+	// A bad list should not take the site down in one run; a real mass
+	// removal finishes over the next full syncs.
+	limit := max(syncPruneMin, int(float64(len(dbIDs))*syncPruneMaxFraction))
+	if len(removed) > limit {
+		log.Printf("Sync: %d 張照片不在 Flickr 列表，超過單次上限 %d，本次只移除 %d 張", len(removed), limit, limit)
+		removed = removed[:limit]
+	}
+	return removed, nil
 }
 
-func fetchPhotoWithRetry(app *App, photoID string) (jsonstruct.PhotosGetInfo, int64, int64) {
-	info := app.Flickr.PhotosGetInfo(photoID)
-	if info.Common.Stat != "ok" {
-		return info, 0, 0
-	}
-	sizes := app.Flickr.PhotosGetSizes(photoID)
-	preferredLabels := []string{"Large", "Large 1024", "Large 1600", "Medium 800", "Medium 640"}
-	for _, label := range preferredLabels {
-		for _, s := range sizes.Sizes.Size {
-			if s.Label == label {
-				w, errW := strconv.ParseInt(string(s.Width), 10, 64)
-				h, errH := strconv.ParseInt(string(s.Height), 10, 64)
-				if errW == nil && errH == nil && w > 0 && h > 0 {
-					return info, w, h
+// filterExisting keeps the ids that are visible in DB.
+func filterExisting(ctx context.Context, app *App, ids []string) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	stored, err := app.DB.GetLastUpdates(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("讀取 DB 照片失敗: %w", err)
+	}
+	var result []string
+	for _, id := range ids {
+		if _, ok := stored[id]; ok {
+			result = append(result, id)
+		}
+	}
+	return result, nil
+}
+
+// pruneRemoved reports items, then applies mode unless it is off or dry-run.
+// It returns the photos taken off the site and the tags they had, whose
+// caches publishSyncChanges drops.
+func pruneRemoved(ctx context.Context, app *App, runID int64, items []db.SyncItem, mode string) (removed, tags []string, err error) {
+	if len(items) == 0 {
+		return nil, nil, nil
+	}
+	ids := make([]string, len(items))
+	for i, it := range items {
+		ids[i] = it.PhotoID
+	}
+	if mode == pruneOff {
+		return nil, nil, app.DB.MarkSyncItems(ctx, runID, ids, db.SyncItemSkipped, 0, "")
+	}
+	log.Printf("Sync: %d 張照片已自 Flickr 刪除或設為非公開: %v", len(ids), ids)
+	if mode == pruneDryRun {
+		log.Printf("Sync: dry-run，未變更 DB；使用 -sync-prune=soft|hide|hard 移除")
+		return nil, nil, app.DB.MarkSyncItems(ctx, runID, ids, db.SyncItemSkipped, 0, "")
+	}
+
+	// Read the tags first: a hard delete removes them with the photos.
+	tags, err = app.DB.GetPhotoTags(ctx, ids)
+	if err != nil {
+		return nil, nil, fmt.Errorf("讀取照片標籤失敗: %w", err)
+	}
+	n, err := app.DB.RemovePhotos(ctx, ids, db.RemoveMode(mode))
+	if err != nil {
+		return nil, nil, fmt.Errorf("移除照片失敗: %w", err)
+	}
+	log.Printf("Sync: 已移除 (%s) %d 張照片", mode, n)
+	if err := app.DB.MarkSyncItems(ctx, runID, ids, db.SyncItemDone, 1, ""); err != nil {
+		return ids, tags, fmt.Errorf("更新 sync items 失敗: %w", err)
+	}
+	return ids, tags, nil
+}
+
+// syncPhotos fetches and upserts items with opts.Workers goroutines sharing
+// one rate limiter. Each finished item is checkpointed in sync_items. It
+// returns the IDs of the photos upserted and how many failed.
+func syncPhotos(ctx context.Context, app *App, runID int64, items []db.SyncItem, opts syncOptions) (done []string, failCount int) {
+	workers := max(opts.Workers, 1)
+	limiter := newTokenBucket(opts.Rate, workers)
+	// Checkpoints must be written even for items finishing after Ctrl-C.
+	dbCtx := context.WithoutCancel(ctx)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	jobs := make(chan db.SyncItem)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for it := range jobs {
+				attempts, err := syncPhoto(ctx, app, limiter, it.PhotoID)
+				if err != nil && ctx.Err() != nil {
+					continue // interrupted: leave pending for resume
+				}
+				status, msg := db.SyncItemDone, ""
+				if err != nil {
+					log.Printf("Sync: 失敗 %s: %v", it.PhotoID, err)
+					status, msg = db.SyncItemFailed, err.Error()
+				}
+				if err := app.DB.MarkSyncItems(dbCtx, runID, []string{it.PhotoID}, status, attempts, msg); err != nil {
+					log.Printf("Sync: 寫入 checkpoint 失敗 %s: %v", it.PhotoID, err)
 				}
-				break
+				mu.Lock()
+				if status == db.SyncItemDone {
+					done = append(done, it.PhotoID)
+				} else {
+					failCount++
+				}
+				if n := len(done) + failCount; n%50 == 0 {
+					log.Printf("Sync: 進度 %d/%d", n, len(items))
+				}
+				mu.Unlock()
 			}
+		}()
+	}
+
+feed:
+	for _, it := range items {
+		select {
+		case jobs <- it:
+		case <-ctx.Done():
+			break feed
 		}
 	}
-	for _, s := range sizes.Sizes.Size {
-		w, errW := strconv.ParseInt(string(s.Width), 10, 64)
-		h, errH := strconv.ParseInt(string(s.Height), 10, 64)
-		if errW == nil && errH == nil && w > 0 && h > 0 {
-			return info, w, h
+	close(jobs)
+	wg.Wait()
+	return done, failCount
+}
+
+// syncPhoto fetches one photo and upserts it. attempts counts Flickr tries.
+func syncPhoto(ctx context.Context, app *App, limiter *tokenBucket, photoID string) (attempts int, err error) {
+	fp, attempts, err := fetchPhotoWithRetry(ctx, app, limiter, photoID)
+	if err != nil {
+		return attempts, err
+	}
+	if err := app.DB.UpsertPhoto(ctx, photoID, fp.Info, fp.Width, fp.Height); err != nil {
+		return attempts, fmt.Errorf("寫入 DB: %w", err)
+	}
+	if fp.Exif != nil {
+		if err := app.DB.UpsertPhotoExif(ctx, photoID, *fp.Exif); err != nil {
+			return attempts, fmt.Errorf("寫入 EXIF: %w", err)
 		}
 	}
-	return info, 0, 0
+	return attempts, nil
+}
+
+// flickrError is a Flickr API response with stat other than ok.
+type flickrError struct {
+	Stat    string
+	Code    int64
+	Message string
+}
+
+func (e *flickrError) Error() string {
+	return fmt.Sprintf("flickr stat=%s code=%d %s", e.Stat, e.Code, e.Message)
+}
+
+// retryable reports whether err may succeed on another attempt. Flickr codes
+// 1 (photo not found) and 2 (permission denied) will not.
+func retryable(err error) bool {
+	var ferr *flickrError
+	if errors.As(err, &ferr) {
+		return ferr.Code != 1 && ferr.Code != 2
+	}
+	return true
+}
+
+// fetchedPhoto is everything sync stores for one photo. Exif is nil when
+// the photo has none, its owner hides it, or getExif failed.
+type fetchedPhoto struct {
+	Info   jsonstruct.PhotosGetInfo
+	Width  int64
+	Height int64
+	Exif   *db.PhotoExif
+}
+
+// fetchPhotoWithRetry fetches info, Large size and EXIF for photoID, retrying
+// transient failures with exponential backoff and jitter.
+func fetchPhotoWithRetry(ctx context.Context, app *App, limiter *tokenBucket, photoID string) (fp fetchedPhoto, attempts int, err error) {
+	attempts, err = withRetry(ctx, photoID, func() error {
+		fp, err = fetchPhoto(ctx, app, limiter, photoID)
+		return err
+	})
+	return fp, attempts, err
+}
+
+// withRetry calls fn until it succeeds, fails permanently (see retryable),
+// or syncMaxAttempts is reached, with exponential backoff and jitter. what
+// names the item in logs.
+func withRetry(ctx context.Context, what string, fn func() error) (attempts int, err error) {
+	backoff := syncBaseBackoff
+	for attempts = 1; ; attempts++ {
+		err = fn()
+		if err == nil || attempts >= syncMaxAttempts || !retryable(err) || ctx.Err() != nil {
+			return attempts, err
+		}
+		wait := backoff + time.Duration(rand.Int64N(int64(backoff/2)))
+		log.Printf("Sync: %s 第 %d 次失敗 (%v)，%s 後重試", what, attempts, err, wait.Round(time.Millisecond))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return attempts, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func fetchPhoto(ctx context.Context, app *App, limiter *tokenBucket, photoID string) (fp fetchedPhoto, err error) {
+	if err = limiter.Wait(ctx); err != nil {
+		return
+	}
+	info := &fp.Info
+	args := map[string]string{"method": "flickr.photos.getInfo", "photo_id": photoID}
+	if err = flickrGet(ctx, app, args, info); err != nil {
+		return
+	}
+	if info.Common.Stat != "ok" {
+		err = &flickrError{Stat: info.Common.Stat, Code: info.Common.Code, Message: info.Common.Message}
+		return
+	}
+
+	if err = limiter.Wait(ctx); err != nil {
+		return
+	}
+	var sizes jsonstruct.PhotoSizes
+	args = map[string]string{"method": "flickr.photos.getSizes", "photo_id": photoID}
+	if err = flickrGet(ctx, app, args, &sizes); err != nil {
+		return
+	}
+	// Missing sizes are not fatal; the page falls back to 4:3.
+	fp.Width, fp.Height, _ = pickPhotoSize(sizes)
+
+	if err = limiter.Wait(ctx); err != nil {
+		return
+	}
+	// EXIF is optional: a failure keeps the photo and whatever EXIF DB has.
+	exif, ok, err := fetchExif(ctx, app, photoID)
+	if err != nil {
+		log.Printf("Sync: %s 讀取 EXIF 失敗: %v", photoID, err)
+		return fp, nil
+	}
+	if ok {
+		fp.Exif = &exif
+	}
+	return fp, nil
 }
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/toomore/lazyflickrgo/jsonstruct"
+	"github.com/toomore/toomorephotos/cache"
+	"github.com/toomore/toomorephotos/db"
+)
+
+const tagPageSize = 60
+
+// pager describes one page of a paginated listing. Prev and Next are 0 when
+// there is no such page.
+type pager struct {
+	Page, Pages, Total int
+	Prev, Next         int
+}
+
+func newPager(page, perPage, total int) pager {
+	p := pager{Page: page, Total: total, Pages: (total + perPage - 1) / perPage}
+	if page > 1 {
+		p.Prev = page - 1
+	}
+	if page < p.Pages {
+		p.Next = page + 1
+	}
+	return p
+}
+
+func (p pager) offset(perPage int) int {
+	return (p.Page - 1) * perPage
+}
+
+// parsePage reads ?page=N; ok is false if it is present but not a positive integer.
+func parsePage(r *http.Request) (page int, ok bool) {
+	v := r.URL.Query().Get("page")
+	if v == "" {
+		return 1, true
+	}
+	page, err := strconv.Atoi(v)
+	if err != nil || page < 1 {
+		return 0, false
+	}
+	return page, true
+}
+
+// normalizeTag is the form of a tag in cache keys and groups, so /t/Taiwan
+// and /t/taiwan share one entry.
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// resolveTag returns the spelling of tag to query with. With DB it is the one
+// stored in photo_tags and ok is false for tags no visible photo has; Flickr
+// matches tags case-insensitively, so without DB it is normalizeTag(tag).
+func (a *App) resolveTag(ctx context.Context, tag string) (resolved string, ok bool, err error) {
+	if a.DB == nil {
+		resolved = normalizeTag(tag)
+		return resolved, resolved != "", nil
+	}
+	return a.DB.ResolveTag(ctx, strings.TrimSpace(tag))
+}
+
+type tagPage struct {
+	Photos []jsonstruct.Photo
+	Total  int
+}
+
+// errPageOutOfRange keeps pages past the last one out of the cache.
+var errPageOutOfRange = errors.New("page out of range")
+
+// getCachedTagPage returns photos on page of tag and the total count, from
+// DB when available, otherwise by slicing the Flickr search result. ok is
+// false for a page past the last one, or with DB for a tag no photo has.
+func (a *App) getCachedTagPage(tag string, page int) (tagPage, bool) {
+	ctx := context.Background()
+	key := fmt.Sprintf("tag:%s:%d", normalizeTag(tag), page)
+	result, err := cache.Fetch(ctx, a.ReadThrough, key, a.cacheOpts(a.IndexCacheTTL, tagCacheGroup(tag)), func(ctx context.Context) (tagPage, error) {
+		tag, ok, err := a.resolveTag(ctx, tag)
+		if err != nil || !ok {
+			// An unknown tag is cached as an empty first page.
+			return tagPage{}, pageInRange(page, 0, err)
+		}
+		if a.DB != nil {
+			total, err := a.DB.CountPhotosByTag(ctx, tag)
+			if err = pageInRange(page, total, err); err != nil {
+				return tagPage{}, err
+			}
+			photos, err := a.DB.GetPhotosByTagPage(ctx, tag, tagPageSize, (page-1)*tagPageSize)
+			if err != nil {
+				return tagPage{}, err
+			}
+			return tagPage{Photos: photos, Total: total}, nil
+		}
+		all := a.getCachedFromSearch(tag)
+		if err := pageInRange(page, len(all), nil); err != nil {
+			return tagPage{}, err
+		}
+		result := tagPage{Total: len(all)}
+		if start := (page - 1) * tagPageSize; start < len(all) {
+			result.Photos = all[start:min(start+tagPageSize, len(all))]
+		}
+		return result, nil
+	})
+	if err != nil {
+		if err != errPageOutOfRange {
+			log.Printf("tag %s page %d: %v", tag, page, err)
+		}
+		return tagPage{}, false
+	}
+	return result, result.Total > 0
+}
+
+// pageInRange returns err, or errPageOutOfRange when page is past the last
+// page of total items. Page 1 always exists.
+func pageInRange(page, total int, err error) error {
+	if err != nil {
+		return err
+	}
+	if page > 1 && (page-1)*tagPageSize >= total {
+		return errPageOutOfRange
+	}
+	return nil
+}
+
+// getCachedTagCounts returns all tags with photo counts. Without DB only the
+// tags in tags.txt are listed.
+func (a *App) getCachedTagCounts() []db.TagCount {
+	ctx := context.Background()
+	key := "tags"
+	result, _ := cache.Fetch(ctx, a.ReadThrough, key, a.cacheOpts(a.SitemapCacheTTL), func(ctx context.Context) ([]db.TagCount, error) {
+		if a.DB != nil {
+			if counts, err := a.DB.GetTagCounts(ctx); err == nil && len(counts) > 0 {
+				return counts, nil
+			}
+		}
+		var result []db.TagCount
+		for _, tag := range a.Tags {
+			if n := len(a.getCachedFromSearch(tag)); n > 0 {
+				result = append(result, db.TagCount{Tag: tag, Count: n})
+			}
+		}
+		sort.SliceStable(result, func(i, j int) bool { return result[i].Count > result[j].Count })
+		return result, nil
+	})
+	return result
+}
+
+// tagFromPath returns the unescaped tag in /t/{tag} and, for /t/{tag}/rss,
+// /t/{tag}/atom and /t/{tag}/feed.json, the feed format.
+func tagFromPath(r *http.Request) (tag, format string, ok bool) {
+	escaped, segment, _ := strings.Cut(strings.TrimPrefix(r.URL.EscapedPath(), "/t/"), "/")
+	if format = feedPathSegments[segment]; segment != "" && format == "" {
+		return "", "", false
+	}
+	tag, err := url.PathUnescape(escaped)
+	if err != nil || tag == "" || strings.Contains(tag, "/") {
+		return "", "", false
+	}
+	return tag, format, true
+}
+
+// tag serves /t/{tag}?page=N and the tag feeds.
+func (a *App) tag(w http.ResponseWriter, r *http.Request) {
+	logs(r, "")
+	tag, format, ok := tagFromPath(r)
+	if !ok {
+		a.notFound(w, r)
+		return
+	}
+	if format != "" {
+		a.writeTagFeed(w, r, tag, format)
+		return
+	}
+	page, ok := parsePage(r)
+	if !ok {
+		a.notFound(w, r)
+		return
+	}
+	result, ok := a.getCachedTagPage(tag, page)
+	if !ok {
+		a.notFound(w, r)
+		return
+	}
+	p := newPager(page, tagPageSize, result.Total)
+
+	w.Header().Set("X-Tags", tag)
+	w.Header().Set("Cache-Control", "max-age=120")
+	data := struct {
+		Tag   string
+		R     []jsonstruct.Photo
+		Pager pager
+	}{tag, result.Photos, p}
+	if err := a.TplTag.Execute(w, data); err != nil {
+		log.Printf("template execute error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// tags serves /tags, the tag index with counts.
+func (a *App) tags(w http.ResponseWriter, r *http.Request) {
+	logs(r, "")
+	w.Header().Set("Cache-Control", "max-age=600")
+	data := struct {
+		Tags []db.TagCount
+	}{a.getCachedTagCounts()}
+	if err := a.TplTags.Execute(w, data); err != nil {
+		log.Printf("template execute error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/toomore/toomorephotos/db"
+)
+
+// WebSub (https://www.w3.org/TR/websub/) publisher and optional built-in hub.
+const (
+	defaultWebSubHub = "https://pubsubhubbub.appspot.com/"
+	webSubPath       = "/websub"
+
+	webSubAttempts    = 3
+	webSubConcurrency = 4
+
+	webSubDefaultLease = 10 * 24 * time.Hour
+	webSubMinLease     = time.Hour
+	webSubMaxLease     = 30 * 24 * time.Hour
+	webSubMaxSecret    = 200
+
+	// The built-in hub accepts webSubSubscribeRate subscription requests per
+	// second, in bursts of webSubSubscribeBurst, and verifies at most
+	// webSubMaxVerifying of them at once.
+	webSubSubscribeRate  = 1
+	webSubSubscribeBurst = 10
+	webSubMaxVerifying   = 16
+)
+
+var webSubClient = &http.Client{Timeout: 10 * time.Second}
+
+// webSubBackoff is the wait before the first retry.
+var webSubBackoff = 2 * time.Second
+
+// webSubCallbackClient talks to subscriber callbacks. It dials public
+// addresses only, so a callback cannot reach the hub's own network, also
+// when its name resolves differently after the subscription was checked.
+var webSubCallbackClient = newWebSubCallbackClient()
+
+var (
+	webSubSubscribeLimiter = newTokenBucket(webSubSubscribeRate, webSubSubscribeBurst)
+	webSubVerifying        = make(chan struct{}, webSubMaxVerifying)
+)
+
+func newWebSubCallbackClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would dial for us and skip the address check.
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			return checkWebSubAddr(addr.Addr())
+		},
+	}).DialContext
+	return &http.Client{Timeout: 10 * time.Second, Transport: transport}
+}
+
+// checkWebSubAddr rejects loopback, private, link-local, multicast and
+// unspecified addresses as callback targets.
+func checkWebSubAddr(ip netip.Addr) error {
+	ip = ip.Unmap()
+	if !ip.IsValid() || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("不允許的 callback 位址 %s", ip)
+	}
+	return nil
+}
+
+// checkWebSubCallback resolves host and checks every address it has.
+func checkWebSubCallback(ctx context.Context, host string) error {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return checkWebSubAddr(ip)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if err := checkWebSubAddr(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// webSubTopicExpr matches the feeds that can be subscribed to: /rss, /atom,
+// /feed.json and the same under /t/{tag}/ and /a/{setid}/.
+var webSubTopicExpr = regexp.MustCompile(`^(?:/t/[^/]+|/a/[0-9]+)?/(?:rss|atom|feed\.json)$`)
+
+// feedPathSegments maps the last path segment of a feed URL to its format.
+var feedPathSegments = map[string]string{"rss": "rss", "atom": "atom", "feed.json": "json"}
+
+// feedPathSegment is the inverse of feedPathSegments.
+func feedPathSegment(format string) string {
+	if format == "json" {
+		return "feed.json"
+	}
+	return format
+}
+
+func (a *App) tagFeedURL(tag, format string) string {
+	return fmt.Sprintf("%s/t/%s/%s", a.Config.Site.URL, url.PathEscape(tag), feedPathSegment(format))
+}
+
+func (a *App) albumFeedURL(albumID, format string) string {
+	return fmt.Sprintf("%s/a/%s/%s", a.Config.Site.URL, albumID, feedPathSegment(format))
+}
+
+// hubURLs returns the hubs advertised in feeds.
+func (a *App) hubURLs() []string {
+	hubs := a.WebSubHubs
+	if a.WebSubBuiltinHub {
+		hubs = append(slices.Clip(hubs), a.Config.Site.URL+webSubPath)
+	}
+	return hubs
+}
+
+// setFeedLinks adds the WebSub discovery Link headers.
+func (a *App) setFeedLinks(w http.ResponseWriter, self string) {
+	for _, hub := range a.hubURLs() {
+		w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="hub"`, hub))
+	}
+	w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="self"`, self))
+}
+
+// publishSyncChanges drops the caches behind the pages and feeds a sync
+// changed and notifies hubs of those feeds. photoIDs are the upserted
+// photos, removedIDs the photos taken off the site and removedTags their
+// tags.
+func publishSyncChanges(ctx context.Context, app *App, photoIDs, removedIDs, removedTags, albumIDs []string) {
+	var keys, groups, topics []string
+	if len(photoIDs) > 0 || len(removedIDs) > 0 {
+		keys = append(keys, "feed", "tags", "sitemap", "sitemap:photos")
+		groups = append(groups, sitemapCacheGroup)
+		for _, format := range []string{"rss", "atom", "json"} {
+			topics = append(topics, app.Config.Site.URL+"/"+feedPathSegment(format))
+		}
+		for _, id := range slices.Concat(photoIDs, removedIDs) {
+			groups = append(groups, photoCacheGroup(id))
+		}
+		tags, err := app.DB.GetPhotoTags(ctx, photoIDs)
+		if err != nil {
+			log.Printf("WebSub: 讀取照片標籤失敗: %v", err)
+		}
+		seen := make(map[string]bool)
+		for _, tag := range slices.Concat(tags, removedTags) {
+			if seen[normalizeTag(tag)] {
+				continue
+			}
+			seen[normalizeTag(tag)] = true
+			groups = append(groups, tagCacheGroup(tag))
+			for _, format := range []string{"rss", "atom", "json"} {
+				topics = append(topics, app.tagFeedURL(tag, format))
+			}
+		}
+	}
+	for _, id := range albumIDs {
+		keys = append(keys, "album:"+id, "album-feed:"+id)
+		for _, format := range []string{"rss", "atom", "json"} {
+			topics = append(topics, app.albumFeedURL(id, format))
+		}
+	}
+	if len(groups) > 0 {
+		if _, err := app.Cache.InvalidateTags(ctx, groups...); err != nil {
+			log.Printf("WebSub: 清除快取群組失敗: %v", err)
+		}
+	}
+	if len(keys) > 0 {
+		if err := app.Cache.Delete(ctx, keys...); err != nil {
+			log.Printf("WebSub: 清除快取失敗: %v", err)
+		}
+	}
+	app.publishWebSub(ctx, topics)
+}
+
+// publishWebSub pings every external hub for each topic and, with the
+// built-in hub, pushes the topics to its subscribers.
+func (a *App) publishWebSub(ctx context.Context, topics []string) {
+	if len(topics) == 0 {
+		return
+	}
+	var failed int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, webSubConcurrency)
+	for _, hub := range a.WebSubHubs {
+		for _, topic := range topics {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				if err := webSubRetry(ctx, func() (bool, error) { return pingHub(ctx, hub, topic) }); err != nil {
+					log.Printf("WebSub: 通知 %s 失敗 (%s): %v", hub, topic, err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	if len(a.WebSubHubs) > 0 {
+		log.Printf("WebSub: 已通知 %d 個 hub，%d 個 topic，%d 個失敗", len(a.WebSubHubs), len(topics), failed)
+	}
+	if a.WebSubBuiltinHub {
+		a.distributeWebSub(ctx, topics)
+	}
+}
+
+// webSubRetry calls fn until it succeeds, reports a permanent failure, or
+// webSubAttempts is reached, doubling the wait each time.
+func webSubRetry(ctx context.Context, fn func() (retry bool, err error)) error {
+	backoff := webSubBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := fn()
+		if err == nil || !retry || attempt >= webSubAttempts {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// webSubStatusError is a non-2xx answer from a hub or subscriber.
+type webSubStatusError struct {
+	StatusCode int
+}
+
+func (e *webSubStatusError) Error() string {
+	return fmt.Sprintf("HTTP %d", e.StatusCode)
+}
+
+// retryableStatus reports whether a request answered with code may succeed
+// later.
+func retryableStatus(code int) bool {
+	return code >= 500 || code == http.StatusTooManyRequests
+}
+
+// pingHub sends a publish notification for topic to hub.
+func pingHub(ctx context.Context, hub, topic string) (retry bool, err error) {
+	form := url.Values{"hub.mode": {"publish"}, "hub.url": {topic}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hub, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := webSubClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return retryableStatus(resp.StatusCode), &webSubStatusError{StatusCode: resp.StatusCode}
+	}
+	return false, nil
+}
+
+// webSubHub serves the built-in hub at /websub: subscribe and unsubscribe
+// requests are accepted with 202 and confirmed by verification of intent.
+func (a *App) webSubHub(w http.ResponseWriter, r *http.Request) {
+	logs(r, "[websub]")
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !webSubSubscribeLimiter.Allow() {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+	mode := r.PostForm.Get("hub.mode")
+	topic := r.PostForm.Get("hub.topic")
+	callback := r.PostForm.Get("hub.callback")
+	secret := r.PostForm.Get("hub.secret")
+	if mode != "subscribe" && mode != "unsubscribe" {
+		http.Error(w, "hub.mode must be subscribe or unsubscribe", http.StatusBadRequest)
+		return
+	}
+	if !a.isWebSubTopic(topic) {
+		http.Error(w, "hub.topic is not a feed of this site", http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "hub.callback must be an absolute http(s) URL", http.StatusBadRequest)
+		return
+	}
+	if err := checkWebSubCallback(r.Context(), u.Hostname()); err != nil {
+		log.Printf("WebSub: 拒絕 callback %s: %v", callback, err)
+		http.Error(w, "hub.callback must be a public address", http.StatusBadRequest)
+		return
+	}
+	if len(secret) >= webSubMaxSecret {
+		http.Error(w, "hub.secret is too long", http.StatusBadRequest)
+		return
+	}
+	lease := webSubDefaultLease
+	if v := r.PostForm.Get("hub.lease_seconds"); v != "" {
+		if sec, err := strconv.Atoi(v); err == nil && sec > 0 {
+			lease = min(max(time.Duration(sec)*time.Second, webSubMinLease), webSubMaxLease)
+		}
+	}
+	select {
+	case webSubVerifying <- struct{}{}:
+	default:
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	go func() {
+		defer func() { <-webSubVerifying }()
+		a.verifyWebSubIntent(context.Background(), mode, topic, callback, secret, lease)
+	}()
+}
+
+func (a *App) isWebSubTopic(topic string) bool {
+	u, err := url.Parse(topic)
+	if err != nil || !strings.HasPrefix(topic, a.Config.Site.URL+"/") {
+		return false
+	}
+	return webSubTopicExpr.MatchString(u.EscapedPath())
+}
+
+// verifyWebSubIntent asks callback to echo a challenge and, if it does,
+// stores or removes the subscription.
+func (a *App) verifyWebSubIntent(ctx context.Context, mode, topic, callback, secret string, lease time.Duration) {
+	challenge := make([]byte, 16)
+	rand.Read(challenge)
+	u, _ := url.Parse(callback)
+	q := u.Query()
+	q.Set("hub.mode", mode)
+	q.Set("hub.topic", topic)
+	q.Set("hub.challenge", hex.EncodeToString(challenge))
+	if mode == "subscribe" {
+		q.Set("hub.lease_seconds", strconv.Itoa(int(lease/time.Second)))
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		log.Printf("WebSub: 驗證 %s 失敗: %v", callback, err)
+		return
+	}
+	resp, err := webSubCallbackClient.Do(req)
+	if err != nil {
+		log.Printf("WebSub: 驗證 %s 失敗: %v", callback, err)
+		return
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 || strings.TrimSpace(string(body)) != hex.EncodeToString(challenge) {
+		log.Printf("WebSub: %s 未確認 %s %s (HTTP %d)", callback, mode, topic, resp.StatusCode)
+		return
+	}
+
+	if mode == "unsubscribe" {
+		err = a.DB.DeleteWebSubSubscription(ctx, topic, callback)
+	} else {
+		err = a.DB.UpsertWebSubSubscription(ctx, db.WebSubSubscription{
+			Topic:     topic,
+			Callback:  callback,
+			Secret:    secret,
+			ExpiresAt: time.Now().Add(lease),
+		})
+	}
+	if err != nil {
+		log.Printf("WebSub: 寫入訂閱失敗 %s: %v", callback, err)
+		return
+	}
+	log.Printf("WebSub: %s %s → %s", mode, topic, callback)
+}
+
+// distributeWebSub pushes the current content of each topic to its
+// subscribers. A subscriber answering 410 Gone is removed.
+func (a *App) distributeWebSub(ctx context.Context, topics []string) {
+	if n, err := a.DB.DeleteExpiredWebSubSubscriptions(ctx); err != nil {
+		log.Printf("WebSub: 清除過期訂閱失敗: %v", err)
+	} else if n > 0 {
+		log.Printf("WebSub: 清除 %d 個過期訂閱", n)
+	}
+	for _, topic := range topics {
+		subs, err := a.DB.GetWebSubSubscriptions(ctx, topic)
+		if err != nil {
+			log.Printf("WebSub: 讀取訂閱失敗 %s: %v", topic, err)
+			continue
+		}
+		if len(subs) == 0 {
+			continue
+		}
+		body, contentType, err := a.renderFeedTopic(topic)
+		if err != nil {
+			log.Printf("WebSub: 產生 %s 失敗: %v", topic, err)
+			continue
+		}
+		a.pushWebSub(ctx, a.DB, subs, body, contentType)
+		log.Printf("WebSub: 已推送 %s 給 %d 個訂閱者", topic, len(subs))
+	}
+}
+
+// webSubStore removes subscriptions; *db.DB implements it.
+type webSubStore interface {
+	DeleteWebSubSubscription(ctx context.Context, topic, callback string) error
+}
+
+// pushWebSub delivers body to each subscriber and removes those answering
+// 410 Gone from store.
+func (a *App) pushWebSub(ctx context.Context, store webSubStore, subs []db.WebSubSubscription, body []byte, contentType string) {
+	for _, sub := range subs {
+		err := webSubRetry(ctx, func() (bool, error) { return a.deliverWebSub(ctx, sub, body, contentType) })
+		var status *webSubStatusError
+		switch {
+		case err == nil:
+		case errors.As(err, &status) && status.StatusCode == http.StatusGone:
+			log.Printf("WebSub: %s 已取消訂閱 %s", sub.Callback, sub.Topic)
+			if err := store.DeleteWebSubSubscription(ctx, sub.Topic, sub.Callback); err != nil {
+				log.Printf("WebSub: 刪除訂閱失敗 %s: %v", sub.Callback, err)
+			}
+		default:
+			log.Printf("WebSub: 推送 %s 到 %s 失敗: %v", sub.Topic, sub.Callback, err)
+		}
+	}
+}
+
+// deliverWebSub posts body to the subscriber, signed with its secret.
+func (a *App) deliverWebSub(ctx context.Context, sub db.WebSubSubscription, body []byte, contentType string) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Callback, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Add("Link", fmt.Sprintf(`<%s%s>; rel="hub"`, a.Config.Site.URL, webSubPath))
+	req.Header.Add("Link", fmt.Sprintf(`<%s>; rel="self"`, sub.Topic))
+	if sub.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(sub.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := webSubCallbackClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return retryableStatus(resp.StatusCode), &webSubStatusError{StatusCode: resp.StatusCode}
+	}
+	return false, nil
+}
+
+// renderFeedTopic renders a feed topic with writeFeed, the same bytes a
+// subscriber would fetch.
+func (a *App) renderFeedTopic(topic string) (body []byte, contentType string, err error) {
+	r, err := http.NewRequest(http.MethodGet, topic, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	path := r.URL.EscapedPath()
+	format := feedPathSegments[path[strings.LastIndex(path, "/")+1:]]
+	var feed *photoFeed
+	self := a.Config.Site.URL + path
+	switch {
+	case format == "":
+	case strings.HasPrefix(path, "/t/"):
+		if tag, _, ok := tagFromPath(r); ok {
+			feed = a.getCachedTagFeed(tag)
+			self = a.tagFeedURL(tag, format)
+		}
+	case strings.HasPrefix(path, "/a/"):
+		if m := albumPathExpr.FindStringSubmatch(r.URL.Path); m != nil {
+			if album, ok := a.getCachedAlbum(m[1]); ok && len(album.Photos) > 0 {
+				feed = a.getCachedAlbumFeed(album)
+			}
+		}
+	default:
+		feed = a.getCachedFeed()
+	}
+	if feed == nil {
+		return nil, "", &webSubStatusError{StatusCode: http.StatusNotFound}
+	}
+
+	var buf feedBuffer
+	a.writeFeed(&buf, r, feed, format, self)
+	if buf.status != http.StatusOK {
+		return nil, "", &webSubStatusError{StatusCode: buf.status}
+	}
+	return buf.body.Bytes(), buf.header.Get("Content-Type"), nil
+}
+
+// feedBuffer is the http.ResponseWriter renderFeedTopic writes a feed into.
+type feedBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *feedBuffer) Header() http.Header {
+	if b.header == nil {
+		b.header = make(http.Header)
+	}
+	return b.header
+}
+
+func (b *feedBuffer) WriteHeader(code int) {
+	if b.status == 0 {
+		b.status = code
+	}
+}
+
+func (b *feedBuffer) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/toomore/toomorephotos/db"
+)
+
+const testTopic = "https://photos.example.com/rss"
+
+// fastWebSubRetry shortens webSubBackoff for the test.
+func fastWebSubRetry(t *testing.T) {
+	t.Helper()
+	old := webSubBackoff
+	webSubBackoff = time.Millisecond
+	t.Cleanup(func() { webSubBackoff = old })
+}
+
+func TestPingHub(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("method = %s", r.Method)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/x-www-form-urlencoded" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		if got := r.PostForm.Get("hub.mode"); got != "publish" {
+			t.Errorf("hub.mode = %q", got)
+		}
+		if got := r.PostForm.Get("hub.url"); got != testTopic {
+			t.Errorf("hub.url = %q", got)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	retry, err := pingHub(context.Background(), srv.URL, testTopic)
+	if err != nil || retry {
+		t.Errorf("pingHub = %v, %v", retry, err)
+	}
+}
+
+func TestPingHubRetry(t *testing.T) {
+	fastWebSubRetry(t)
+	tests := []struct {
+		status   int
+		wantHits int32
+		wantErr  bool
+	}{
+		{http.StatusAccepted, 1, false},
+		{http.StatusInternalServerError, webSubAttempts, true},
+		{http.StatusServiceUnavailable, webSubAttempts, true},
+		{http.StatusTooManyRequests, webSubAttempts, true},
+		{http.StatusBadRequest, 1, true},
+		{http.StatusNotFound, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			var hits atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			ctx := context.Background()
+			err := webSubRetry(ctx, func() (bool, error) { return pingHub(ctx, srv.URL, testTopic) })
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got := hits.Load(); got != tt.wantHits {
+				t.Errorf("hub hit %d times, want %d", got, tt.wantHits)
+			}
+		})
+	}
+}
+
+// fakeWebSubStore records removed callbacks.
+type fakeWebSubStore struct {
+	deleted []string
+}
+
+func (s *fakeWebSubStore) DeleteWebSubSubscription(ctx context.Context, topic, callback string) error {
+	s.deleted = append(s.deleted, callback)
+	return nil
+}
+
+func TestPushWebSubRemovesGone(t *testing.T) {
+	fastWebSubRetry(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gone":
+			w.WriteHeader(http.StatusGone)
+		case "/bad":
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			if r.Header.Get("X-Hub-Signature") == "" {
+				t.Error("missing X-Hub-Signature")
+			}
+		}
+	}))
+	defer srv.Close()
+	old := webSubCallbackClient
+	webSubCallbackClient = srv.Client()
+	defer func() { webSubCallbackClient = old }()
+
+	app := &App{Config: &Config{Site: SiteConfig{URL: "https://photos.example.com"}}}
+	store := &fakeWebSubStore{}
+	subs := []db.WebSubSubscription{
+		{Topic: testTopic, Callback: srv.URL + "/ok", Secret: "s3cret"},
+		{Topic: testTopic, Callback: srv.URL + "/gone"},
+		{Topic: testTopic, Callback: srv.URL + "/bad"},
+	}
+	app.pushWebSub(context.Background(), store, subs, []byte("<rss/>"), "application/rss+xml")
+
+	if len(store.deleted) != 1 || store.deleted[0] != srv.URL+"/gone" {
+		t.Errorf("deleted = %v, want only /gone", store.deleted)
+	}
+}
+
+func TestCheckWebSubAddr(t *testing.T) {
+	for addr, ok := range map[string]bool{
+		"93.184.216.34":    true,
+		"2606:4700::1111":  true,
+		"127.0.0.1":        false,
+		"::1":              false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"fe80::1":          false,
+		"fd00::1":          false,
+		"0.0.0.0":          false,
+		"::ffff:127.0.0.1": false,
+	} {
+		if err := checkWebSubAddr(netip.MustParseAddr(addr)); (err == nil) != ok {
+			t.Errorf("%s: err = %v, want allowed %v", addr, err, ok)
+		}
+	}
+}
+
+func TestWebSubCallbackClientRefusesLoopback(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer srv.Close()
+
+	resp, err := webSubCallbackClient.Get(srv.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("want error dialing loopback")
+	}
+	if hits.Load() != 0 {
+		t.Error("callback server was reached")
+	}
+}